@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/diag"
+)
+
+// runDiag runs each diagnosis in the format of "op[:target]", such as "dns:example.com" or "listen".
+func runDiag(master *dehub.Master, list []string, timeout time.Duration, asJSON bool) {
+	for _, item := range list {
+		op, target, _ := strings.Cut(item, ":")
+
+		res, err := master.Diagnose(diag.Request{Op: diag.Op(op), Target: target, Timeout: timeout})
+		e(err)
+
+		if asJSON {
+			printJSON(res)
+			continue
+		}
+
+		printDiag(res)
+	}
+}
+
+func printDiag(res *diag.Result) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint: mnd
+
+	fmt.Fprintf(w, "%s %s (%s)\n", strings.ToUpper(string(res.Op)), res.Target, res.Duration.Round(time.Microsecond))
+
+	switch {
+	case res.DNS != nil:
+		if res.DNS.CNAME != "" {
+			fmt.Fprintf(w, "CNAME\t%s\n", res.DNS.CNAME)
+		}
+
+		for _, addr := range res.DNS.Addrs {
+			fmt.Fprintf(w, "ADDR\t%s\n", addr)
+		}
+	case res.TCP != nil:
+		fmt.Fprintf(w, "LOCAL\t%s\n", res.TCP.LocalAddr)
+		fmt.Fprintf(w, "REMOTE\t%s\n", res.TCP.RemoteAddr)
+	case res.HTTP != nil:
+		printHTTPDiag(w, res.HTTP)
+	case res.Listen != nil:
+		fmt.Fprintln(w, "PROTO\tLOCAL\tPID\tNAME")
+
+		for _, l := range res.Listen {
+			pid := "-"
+			if l.PID != 0 {
+				pid = fmt.Sprint(l.PID)
+			}
+
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", l.Proto, l.Local, pid, l.Name)
+		}
+	case res.Interfaces != nil:
+		fmt.Fprintln(w, "NAME\tMTU\tFLAGS\tMAC\tADDRS")
+
+		for _, i := range res.Interfaces {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\n", i.Name, i.MTU, i.Flags, i.HardwareAddr, strings.Join(i.Addrs, " "))
+		}
+	}
+
+	if res.Error != "" {
+		fmt.Fprintf(w, "ERROR\t%s\n", res.Error)
+	}
+
+	fmt.Fprintln(w)
+
+	e(w.Flush())
+}
+
+func printHTTPDiag(w *tabwriter.Writer, res *diag.HTTP) {
+	fmt.Fprintf(w, "REMOTE\t%s\n", res.RemoteAddr)
+	fmt.Fprintf(w, "STATUS\t%s %s\n", res.Proto, res.Status)
+	fmt.Fprintf(w, "TIMING\tdns %s, connect %s, tls %s, first byte %s\n", res.DNS, res.Connect, res.TLS, res.FirstByte)
+	fmt.Fprintf(w, "BODY\t%s\n", formatBytes(res.BodySize))
+
+	keys := make([]string, 0, len(res.Header))
+	for k := range res.Header {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "HEADER\t%s: %s\n", k, strings.Join(res.Header[k], ", "))
+	}
+
+	if res.TLSInfo == nil {
+		return
+	}
+
+	fmt.Fprintf(w, "TLS\t%s %s, alpn %q\n", res.TLSInfo.Version, res.TLSInfo.CipherSuite, res.TLSInfo.ALPN)
+
+	for _, c := range res.TLSInfo.Certs {
+		fmt.Fprintf(w, "CERT\t%s, issuer %s, expires %s\n", c.Subject, c.Issuer, c.NotAfter.Format(time.DateOnly))
+	}
+
+	if res.TLSInfo.VerifyError == "" {
+		fmt.Fprintf(w, "VERIFY\tok\n")
+	} else {
+		fmt.Fprintf(w, "VERIFY\t%s\n", res.TLSInfo.VerifyError)
+	}
+}
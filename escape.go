@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	dehub "github.com/ysmood/dehub/lib"
+	"golang.org/x/crypto/ssh"
+)
+
+const escapeChar = '~'
+
+const escapeHelp = "Supported escape sequences:\r\n" +
+	" ~.  - disconnect\r\n" +
+	" ~t  - send SIGTERM to the remote command\r\n" +
+	" ~q  - send SIGQUIT to the remote command, Go programs will dump the goroutine stacks\r\n" +
+	" ~u  - send SIGUSR1 to the remote command\r\n" +
+	" ~k  - send SIGKILL to the remote command\r\n" +
+	" ~?  - this message\r\n" +
+	" ~~  - send the escape character by typing it twice\r\n" +
+	"(Note that escapes are only recognized immediately after newline.)\r\n"
+
+var escapeSignals = map[byte]ssh.Signal{
+	't': ssh.SIGTERM,
+	'q': ssh.SIGQUIT,
+	'u': ssh.SIGUSR1,
+	'k': ssh.SIGKILL,
+}
+
+// escapeReader handles the escape sequences like the ones of ssh, it wraps the stdin for [dehub.Master.Exec].
+type escapeReader struct {
+	file   *os.File
+	master *dehub.Master
+
+	afterNewline bool
+	escaping     bool
+	pending      []byte // The filtered bytes that are not read yet.
+}
+
+func newEscapeReader(file *os.File, master *dehub.Master) *escapeReader {
+	return &escapeReader{file: file, master: master, afterNewline: true}
+}
+
+// Fd is used by the [dehub.Master.Exec] to make the terminal raw.
+func (r *escapeReader) Fd() uintptr {
+	return r.file.Fd()
+}
+
+func (r *escapeReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		buf := make([]byte, len(p))
+
+		n, err := r.file.Read(buf)
+
+		r.pending = r.filter(buf[:n])
+
+		if err != nil && len(r.pending) == 0 {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+
+	return n, nil
+}
+
+func (r *escapeReader) filter(in []byte) []byte {
+	out := make([]byte, 0, len(in)+1)
+
+	for _, b := range in {
+		switch {
+		case r.escaping:
+			r.escaping = false
+
+			if b == escapeChar {
+				out = append(out, b)
+			} else if !r.command(b) {
+				out = append(out, escapeChar, b)
+			}
+		case r.afterNewline && b == escapeChar:
+			r.escaping = true
+		default:
+			out = append(out, b)
+		}
+
+		r.afterNewline = b == '\r' || b == '\n'
+	}
+
+	return out
+}
+
+func (r *escapeReader) command(b byte) bool {
+	if b == '.' {
+		fmt.Fprint(os.Stderr, "\r\nConnection closed.\r\n")
+		_ = r.master.Close()
+
+		return true
+	}
+
+	if b == '?' {
+		fmt.Fprint(os.Stderr, "\r\n"+escapeHelp)
+		return true
+	}
+
+	sig, ok := escapeSignals[b]
+	if !ok {
+		return false
+	}
+
+	err := r.master.Signal(sig)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "\r\nfailed to send SIG%s: %s\r\n", sig, err)
+	} else {
+		fmt.Fprintf(os.Stderr, "\r\nsent SIG%s\r\n", sig)
+	}
+
+	return true
+}
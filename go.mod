@@ -6,40 +6,62 @@ require (
 	github.com/creack/pty v1.1.21
 	github.com/hashicorp/yamux v0.1.1
 	github.com/ysmood/got v0.39.5
-	golang.org/x/crypto v0.22.0
-	golang.org/x/net v0.24.0
-	golang.org/x/term v0.19.0
+	golang.org/x/crypto v0.26.0
+	golang.org/x/net v0.28.0
+	golang.org/x/term v0.23.0
 )
 
 require (
-	github.com/cyphar/filepath-securejoin v0.2.4 // indirect
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/go-logr/logr v1.4.2 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
 	github.com/golang/snappy v0.0.1 // indirect
-	github.com/google/uuid v1.5.0 // indirect
+	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
+	github.com/google/uuid v1.6.0 // indirect
 	github.com/hashicorp/golang-lru/v2 v2.0.7 // indirect
 	github.com/klauspost/compress v1.13.6 // indirect
 	github.com/montanaflynn/stats v0.0.0-20171201202039-1bf9dbcd8cbe // indirect
+	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
 	github.com/rasky/go-xdr v0.0.0-20170124162913-1a41d1a06c93 // indirect
 	github.com/xdg-go/pbkdf2 v1.0.0 // indirect
 	github.com/xdg-go/scram v1.1.2 // indirect
 	github.com/xdg-go/stringprep v1.0.4 // indirect
 	github.com/youmark/pkcs8 v0.0.0-20181117223130-1be2e3e5546d // indirect
 	github.com/ysmood/gop v0.2.0 // indirect
-	golang.org/x/sync v0.5.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	github.com/yuin/gopher-lua v1.1.0 // indirect
+	go.opentelemetry.io/otel/metric v1.28.0 // indirect
+	go.uber.org/mock v0.4.0 // indirect
+	golang.org/x/exp v0.0.0-20240506185415-9bf2ced13842 // indirect
+	golang.org/x/mod v0.17.0 // indirect
+	golang.org/x/sync v0.10.0 // indirect
+	golang.org/x/text v0.17.0 // indirect
+	golang.org/x/tools v0.21.1-0.20240508182429-e35e4ccd0d2d // indirect
 )
 
 require (
+	github.com/alicebob/miniredis/v2 v2.31.1
+	github.com/cyphar/filepath-securejoin v0.2.4
 	github.com/go-git/go-billy/v5 v5.5.0
 	github.com/gobwas/ws v1.4.0
+	github.com/hanwen/go-fuse/v2 v2.9.0
 	github.com/jawher/mow.cli v1.2.0
 	github.com/lmittmann/tint v1.0.4
+	github.com/quic-go/quic-go v0.48.2
+	github.com/redis/go-redis/v9 v9.5.1
 	github.com/things-go/go-socks5 v0.0.5
 	github.com/willscott/go-nfs v0.0.2
 	github.com/willscott/go-nfs-client v0.0.0-20240104095149-b44639837b00
 	github.com/ysmood/byframe v1.1.3
 	github.com/ysmood/myip v1.0.3
+	go.etcd.io/bbolt v1.3.10
 	go.mongodb.org/mongo-driver v1.15.0
-	golang.org/x/sys v0.19.0
+	go.opentelemetry.io/otel v1.28.0
+	go.opentelemetry.io/otel/sdk v1.28.0
+	go.opentelemetry.io/otel/trace v1.28.0
+	golang.org/x/sys v0.28.0
 )
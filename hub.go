@@ -1,11 +1,27 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
 	cli "github.com/jawher/mow.cli"
+	"github.com/redis/go-redis/v9"
 	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/hubdb"
 	"github.com/ysmood/myip"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type hubConf struct {
@@ -13,6 +29,17 @@ type hubConf struct {
 	localhostIP bool
 	addr        string
 	websocket   bool
+	quic        bool
+	relayQUIC   bool
+	tlsCert     string
+	tlsKey      string
+	httpPoll    string
+	traceFile   string
+
+	shutdownTimeout int
+	duplicate       string
+	db              string
+	keepalive       keepaliveConf
 }
 
 func setupHubCLI(app *cli.Cli) {
@@ -24,14 +51,43 @@ func setupHubCLI(app *cli.Cli) {
 			"Use 127.0.0.1 as the ip address for the hub server. If false it will use the interface IP.")
 		c.BoolOptPtr(&conf.jsonOutput, "j json", true, "json output to stdout")
 		c.BoolOptPtr(&conf.websocket, "w ws", false, "Handle each tcp connection as websocket.")
+		c.BoolOptPtr(&conf.quic, "quic", false,
+			"Also listen the udp port of the addr for the QUIC clients, they connect with the quic:// address.")
+		c.BoolOptPtr(&conf.relayQUIC, "relay-quic", false,
+			"Relay the master sessions between the hub nodes via QUIC, all the hub nodes should be upgraded first.")
+		c.StringOptPtr(&conf.tlsCert, "tls-cert", "",
+			"The certificate file of the QUIC server, a self-signed one is generated if not set. "+
+				"The clients verify it with their --tls-ca option.")
+		c.StringOptPtr(&conf.tlsKey, "tls-key", "", "The private key file of the tls-cert.")
+		c.StringOptPtr(&conf.httpPoll, "http-poll", "",
+			"Also serve the HTTP long-polling transport on the address, such as :8080 , "+
+				"the clients connect with the http+poll://host:port address, use it behind a reverse proxy for https.")
+		c.StringOptPtr(&conf.db, "db", "memory://",
+			"The db to store the servant locations, such as memory://, file:///path/to/dehub.db, "+
+				"mongodb://host:27017/dbname, or redis://host:6379/0 . "+
+				"Use mongodb or redis when running multiple hub nodes as a cluster.")
+		c.StringOptPtr(&conf.duplicate, "duplicate", string(dehub.DuplicateReplace),
+			"The policy when a servant connects with an id that is already connected, "+
+				"one of: reject, replace, suffix.")
+		c.IntOptPtr(&conf.shutdownTimeout, "shutdown-timeout", 30, //nolint: mnd
+			"The seconds to wait for the in-flight master sessions when the hub receives SIGTERM.")
+		conf.keepalive.setup(c)
+		c.StringOptPtr(&conf.traceFile, "trace-file", "",
+			"Append the OpenTelemetry spans as OTLP/JSON lines to the file, use - for stdout.")
 
 		c.Action = func() { runHub(conf) }
 	})
 }
 
 func runHub(conf hubConf) {
+	defer setupTracing("dehub-hub", conf.traceFile)()
+
 	hub := dehub.NewHub()
 	hub.Logger = output(conf.jsonOutput)
+	hub.Duplicate = duplicatePolicy(conf.duplicate)
+	hub.Keepalive = conf.keepalive.get()
+	hub.DB = openDB(conf.db)
+	hub.RelayQUIC = conf.relayQUIC
 	hub.GetIP = func() (string, error) {
 		if conf.localhostIP {
 			return "127.0.0.1", nil
@@ -47,9 +103,50 @@ func runHub(conf hubConf) {
 
 	hub.Logger.Info("hub server started", "addr", conf.addr)
 
+	listeners := []net.Listener{hubSrv}
+
+	if conf.quic {
+		quicSrv, err := dehub.ListenQUIC(conf.addr, tlsConfig(conf.tlsCert, conf.tlsKey), hub.Keepalive)
+		e(err)
+
+		hub.Logger.Info("hub quic server started", "addr", quicSrv.Addr().String())
+
+		listeners = append(listeners, quicSrv)
+
+		go func() {
+			for {
+				conn, err := quicSrv.Accept()
+				if err != nil {
+					return
+				}
+
+				go hub.Handle(conn)
+			}
+		}()
+	}
+
+	if conf.httpPoll != "" {
+		pollSrv, err := net.Listen("tcp", conf.httpPoll)
+		e(err)
+
+		hub.Logger.Info("hub http poll server started", "addr", pollSrv.Addr().String())
+
+		listeners = append(listeners, pollSrv)
+
+		go func() {
+			_ = (&http.Server{Handler: hub.HTTPPollHandler(), ReadHeaderTimeout: dialTimeout}).Serve(pollSrv)
+		}()
+	}
+
+	shutdown := handleShutdown(hub, listeners, time.Duration(conf.shutdownTimeout)*time.Second)
+
 	for {
 		conn, err := hubSrv.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				<-shutdown
+			}
+
 			return
 		}
 
@@ -66,3 +163,106 @@ func runHub(conf hubConf) {
 		go hub.Handle(conn)
 	}
 }
+
+// handleShutdown shuts down the hub on SIGTERM or interrupt, the returned channel is closed when it's done.
+func handleShutdown(hub *dehub.Hub, listeners []net.Listener, timeout time.Duration) chan struct{} {
+	done := make(chan struct{})
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+
+		for _, l := range listeners {
+			_ = l.Close()
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		err := hub.Shutdown(ctx)
+		if err != nil {
+			hub.Logger.Error("failed to shutdown gracefully", "err", err)
+		}
+
+		close(done)
+	}()
+
+	return done
+}
+
+// tlsConfig returns nil if the cert is not set.
+func tlsConfig(cert, key string) *tls.Config {
+	if cert == "" {
+		return nil
+	}
+
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	e(err)
+
+	return &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS13}
+}
+
+func duplicatePolicy(name string) dehub.DuplicatePolicy {
+	switch p := dehub.DuplicatePolicy(name); p {
+	case dehub.DuplicateReject, dehub.DuplicateReplace, dehub.DuplicateSuffix:
+		return p
+	}
+
+	e(fmt.Errorf("unknown duplicate policy: %s", name))
+
+	return ""
+}
+
+func openDB(uri string) dehub.DB {
+	u, err := url.Parse(uri)
+	e(err)
+
+	switch u.Scheme {
+	case "memory":
+		return hubdb.NewMemory()
+
+	case "file":
+		path := filepath.FromSlash(u.Host + u.Path)
+
+		_ = os.MkdirAll(filepath.Dir(path), 0o755) //nolint: mnd
+
+		db, err := hubdb.NewFile(path)
+		e(err)
+
+		return db
+
+	case "mongodb", "mongodb+srv":
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+		e(err)
+
+		e(client.Ping(ctx, nil))
+
+		name := strings.TrimPrefix(u.Path, "/")
+		if name == "" {
+			name = "dehub"
+		}
+
+		return hubdb.NewMongo(client.Database(name), "locations")
+
+	case "redis", "rediss":
+		opts, err := redis.ParseURL(uri)
+		e(err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		client := redis.NewClient(opts)
+
+		e(client.Ping(ctx).Err())
+
+		return hubdb.NewRedis(client, "dehub:")
+	}
+
+	e(fmt.Errorf("unknown db scheme: %s", uri))
+
+	return nil
+}
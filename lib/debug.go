@@ -0,0 +1,177 @@
+package dehub
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ForwardDebugger exposes the Delve server of the servant on the listenTo,
+// so that "dlv connect" or the DAP client of an editor can use the address of listenTo directly.
+// Each accepted connection gets its own Delve server on the servant side,
+// the server is stopped and detached from the process when the connection is closed.
+func (m *Master) ForwardDebugger(listenTo net.Listener, meta DebugMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal DebugMeta: %w", err)
+	}
+
+	for {
+		src, err := listenTo.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to accept debugger connection: %w", err)
+		}
+
+		m.Logger.Info("debugger connection")
+
+		go func() {
+			defer func() { _ = src.Close() }()
+
+			ch, err := m.OpenChannel(CommandDebug, b)
+			if err != nil {
+				m.Logger.Error("failed to open debug channel", "err", err)
+				return
+			}
+
+			go func() {
+				_, _ = io.Copy(ch, src)
+				_ = ch.CloseWrite()
+			}()
+
+			_, _ = io.Copy(src, ch)
+			_ = ch.Close()
+		}()
+	}
+}
+
+func (s *Servant) debug(newChan ssh.NewChannel) {
+	var meta DebugMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	addr := meta.Addr
+
+	if addr == "" {
+		var stop func()
+
+		addr, stop, err = startDelve(meta)
+		if err != nil {
+			_ = newChan.Reject(FailedStartDebugger, err.Error())
+			return
+		}
+
+		defer stop()
+	}
+
+	dst, err := net.Dial("tcp", addr)
+	if err != nil {
+		_ = newChan.Reject(FailedStartDebugger, fmt.Sprintf("failed to connect to delve: %s", err))
+		return
+	}
+
+	defer func() { _ = dst.Close() }()
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept debug channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	go func() {
+		_, _ = io.Copy(dst, ch)
+		_ = dst.Close()
+	}()
+
+	_, _ = io.Copy(ch, dst)
+}
+
+// startDelve runs "dlv attach --headless" and returns the address that the Delve server listens on.
+// When the servant process itself is attached, the process keeps running after the attach,
+// because a stopped process can't serve the tunnel. For the same reason breakpoints will freeze the
+// tunnel too, use tracepoints instead.
+func startDelve(meta DebugMeta) (string, func(), error) {
+	dlv := meta.Dlv
+	if dlv == "" {
+		dlv = "dlv"
+	}
+
+	pid := meta.PID
+	args := []string{}
+
+	if pid == 0 {
+		pid = os.Getpid()
+		args = append(args, "--accept-multiclient", "--continue")
+	}
+
+	args = append([]string{"attach", strconv.Itoa(pid), "--headless", "--listen=127.0.0.1:0"}, args...)
+
+	cmd := exec.Command(dlv, args...)
+	stderr := bytes.NewBuffer(nil)
+	cmd.Stderr = stderr
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get delve stdout: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to start delve: %w", err)
+	}
+
+	stop := func() {
+		// Delve detaches from the process on interrupt, a kill may leave the breakpoints in the process.
+		_ = cmd.Process.Signal(os.Interrupt)
+
+		done := make(chan struct{})
+		go func() {
+			_ = cmd.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second): //nolint: mnd
+			_ = cmd.Process.Kill()
+			<-done
+		}
+	}
+
+	// The output looks like "API server listening at: 127.0.0.1:40000"
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		_, addr, found := strings.Cut(scanner.Text(), "listening at:")
+		if !found {
+			continue
+		}
+
+		// Drain the rest of the output so that delve won't be blocked by the pipe.
+		go func() { _, _ = io.Copy(io.Discard, stdout) }()
+
+		return strings.TrimSpace(addr), stop, nil
+	}
+
+	stop()
+
+	return "", nil, fmt.Errorf("failed to start delve: %s", strings.TrimSpace(stderr.String()))
+}
@@ -0,0 +1,369 @@
+// Package diag implements the network diagnostics in pure Go,
+// so that they work in the minimal images that have no curl, dig, or nc.
+package diag
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/ysmood/dehub/lib/procfs"
+)
+
+type Op string
+
+const (
+	// OpDNS resolves the Target host with the system resolver.
+	OpDNS Op = "dns"
+
+	// OpTCP dials the Target address, such as "example.com:443".
+	OpTCP Op = "tcp"
+
+	// OpHTTP sends a GET request to the Target url.
+	OpHTTP Op = "http"
+
+	// OpListen lists the listening sockets.
+	OpListen Op = "listen"
+
+	// OpInterfaces lists the network interfaces.
+	OpInterfaces Op = "interfaces"
+)
+
+// DefaultTimeout is used when the [Request.Timeout] is zero.
+const DefaultTimeout = 10 * time.Second
+
+// The max size of the http response body to read.
+const maxBodySize = 10 * 1024 * 1024
+
+type Request struct {
+	Op      Op
+	Target  string
+	Timeout time.Duration
+}
+
+type Result struct {
+	Op       Op
+	Target   string
+	Duration time.Duration
+
+	// Error is the failure of the diagnosis, the other fields may be partially filled.
+	Error string
+
+	DNS        *DNS              `json:",omitempty"`
+	TCP        *TCP              `json:",omitempty"`
+	HTTP       *HTTP             `json:",omitempty"`
+	Listen     []procfs.Listener `json:",omitempty"`
+	Interfaces []Interface       `json:",omitempty"`
+}
+
+type DNS struct {
+	CNAME string
+	Addrs []string
+}
+
+type TCP struct {
+	LocalAddr  string
+	RemoteAddr string
+}
+
+type HTTP struct {
+	Proto      string
+	Status     string
+	Header     http.Header
+	BodySize   int64
+	RemoteAddr string
+
+	// The time spent on each phase.
+	DNS       time.Duration
+	Connect   time.Duration
+	TLS       time.Duration
+	FirstByte time.Duration
+
+	TLSInfo *TLSInfo `json:",omitempty"`
+}
+
+type TLSInfo struct {
+	Version     string
+	CipherSuite string
+	ALPN        string
+	ServerName  string
+	Certs       []Cert
+
+	// VerifyError is the reason why the certificate chain is not trusted by the servant, empty if trusted.
+	VerifyError string
+}
+
+type Cert struct {
+	Subject   string
+	Issuer    string
+	DNSNames  []string
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+type Interface struct {
+	Name         string
+	MTU          int
+	Flags        string
+	HardwareAddr string
+	Addrs        []string
+}
+
+// Options customizes how the diagnosis reaches the network.
+type Options struct {
+	// Resolver is used by the [OpDNS] and the default dial, [net.DefaultResolver] if nil.
+	Resolver *net.Resolver
+
+	// Dial connects the [OpTCP] and [OpHTTP] targets, such as to check them with rules.
+	// If it's set, the [OpHTTP] doesn't use the proxy from the environment, so that the Dial gets the real target.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+func (o Options) resolver() *net.Resolver {
+	if o.Resolver != nil {
+		return o.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+func (o Options) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if o.Dial != nil {
+		return o.Dial(ctx, network, addr)
+	}
+
+	return (&net.Dialer{Resolver: o.resolver()}).DialContext(ctx, network, addr)
+}
+
+// Run the diagnosis of the req, the failure is reported via the [Result.Error].
+func Run(ctx context.Context, req Request) *Result {
+	return RunWithOptions(ctx, req, Options{})
+}
+
+// RunWithOptions is the same as [Run], but with the opts to reach the network.
+func RunWithOptions(ctx context.Context, req Request, opts Options) *Result {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	res := &Result{Op: req.Op, Target: req.Target}
+	start := time.Now()
+
+	var err error
+
+	switch req.Op {
+	case OpDNS:
+		res.DNS, err = resolve(ctx, opts.resolver(), req.Target)
+	case OpTCP:
+		res.TCP, err = dialTCP(ctx, opts, req.Target)
+	case OpHTTP:
+		res.HTTP, err = get(ctx, opts, req.Target)
+	case OpListen:
+		res.Listen, err = procfs.Listening()
+	case OpInterfaces:
+		res.Interfaces, err = interfaces()
+	default:
+		err = fmt.Errorf("unknown diagnosis op: %s", req.Op)
+	}
+
+	res.Duration = time.Since(start)
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	return res
+}
+
+func resolve(ctx context.Context, resolver *net.Resolver, host string) (*DNS, error) {
+	d := &DNS{}
+
+	// The CNAME lookup fails for the hosts that are not in DNS, such as the ones in /etc/hosts.
+	d.CNAME, _ = resolver.LookupCNAME(ctx, host)
+
+	addrs, err := resolver.LookupHost(ctx, host)
+	if err != nil {
+		return d, fmt.Errorf("failed to resolve host: %w", err)
+	}
+
+	d.Addrs = addrs
+
+	return d, nil
+}
+
+func dialTCP(ctx context.Context, opts Options, addr string) (*TCP, error) {
+	conn, err := opts.dial(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial: %w", err)
+	}
+
+	_ = conn.Close()
+
+	return &TCP{LocalAddr: conn.LocalAddr().String(), RemoteAddr: conn.RemoteAddr().String()}, nil
+}
+
+func get(ctx context.Context, opts Options, u string) (*HTTP, error) { //nolint: funlen
+	target, err := url.Parse(u)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse url: %w", err)
+	}
+
+	res := &HTTP{}
+
+	var dnsStart, connectStart, tlsStart time.Time
+
+	// The ConnectStart and ConnectDone may be called concurrently when the host has multiple ips.
+	var connectLock sync.Mutex
+
+	start := time.Now()
+
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone:  func(httptrace.DNSDoneInfo) { res.DNS = time.Since(dnsStart) },
+		ConnectStart: func(string, string) {
+			connectLock.Lock()
+			defer connectLock.Unlock()
+
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			connectLock.Lock()
+			defer connectLock.Unlock()
+
+			res.Connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { res.TLS = time.Since(tlsStart) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			res.RemoteAddr = info.Conn.RemoteAddr().String()
+		},
+		GotFirstResponseByte: func() { res.FirstByte = time.Since(start) },
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if opts.Dial != nil {
+		proxy = nil
+	}
+
+	// The certificate is verified separately, so that the details of an untrusted one can still be reported.
+	// Each diagnosis uses a new connection, it's closed after the response is read.
+	transport := &http.Transport{
+		Proxy:             proxy,
+		DialContext:       opts.dial,
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+		DisableKeepAlives: true,
+	}
+	defer transport.CloseIdleConnections()
+
+	client := &http.Client{
+		Transport:     transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return res, fmt.Errorf("failed to send request: %w", err)
+	}
+
+	defer func() { _ = resp.Body.Close() }()
+
+	res.Proto = resp.Proto
+	res.Status = resp.Status
+	res.Header = resp.Header
+
+	if resp.TLS != nil {
+		res.TLSInfo = tlsInfo(target.Hostname(), resp.TLS)
+	}
+
+	res.BodySize, err = io.Copy(io.Discard, io.LimitReader(resp.Body, maxBodySize))
+	if err != nil {
+		return res, fmt.Errorf("failed to read body: %w", err)
+	}
+
+	return res, nil
+}
+
+func tlsInfo(host string, state *tls.ConnectionState) *TLSInfo {
+	info := &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+		ServerName:  state.ServerName,
+	}
+
+	for _, c := range state.PeerCertificates {
+		info.Certs = append(info.Certs, Cert{
+			Subject:   c.Subject.String(),
+			Issuer:    c.Issuer.String(),
+			DNSNames:  c.DNSNames,
+			NotBefore: c.NotBefore,
+			NotAfter:  c.NotAfter,
+		})
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		intermediates := x509.NewCertPool()
+		for _, c := range state.PeerCertificates[1:] {
+			intermediates.AddCert(c)
+		}
+
+		_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+			DNSName:       host,
+			Intermediates: intermediates,
+		})
+		if err != nil {
+			info.VerifyError = err.Error()
+		}
+	}
+
+	return info
+}
+
+func interfaces() ([]Interface, error) {
+	list, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list interfaces: %w", err)
+	}
+
+	res := []Interface{}
+
+	for _, i := range list {
+		item := Interface{
+			Name:         i.Name,
+			MTU:          i.MTU,
+			Flags:        i.Flags.String(),
+			HardwareAddr: i.HardwareAddr.String(),
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list interface addresses: %w", err)
+		}
+
+		for _, a := range addrs {
+			item.Addrs = append(item.Addrs, a.String())
+		}
+
+		res = append(res, item)
+	}
+
+	return res, nil
+}
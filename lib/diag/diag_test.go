@@ -0,0 +1,97 @@
+package diag_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ysmood/dehub/lib/diag"
+	"github.com/ysmood/got"
+)
+
+func TestDNS(t *testing.T) {
+	g := got.T(t)
+
+	res := diag.Run(context.Background(), diag.Request{Op: diag.OpDNS, Target: "localhost"})
+	g.Eq(res.Error, "")
+	g.Gt(len(res.DNS.Addrs), 0)
+}
+
+func TestTCP(t *testing.T) {
+	g := got.T(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	addr := l.Addr().String()
+
+	res := diag.Run(context.Background(), diag.Request{Op: diag.OpTCP, Target: addr})
+	g.Eq(res.Error, "")
+	g.Eq(res.TCP.RemoteAddr, addr)
+
+	g.E(l.Close())
+
+	res = diag.Run(context.Background(), diag.Request{Op: diag.OpTCP, Target: addr})
+	g.Has(res.Error, "connection refused")
+}
+
+func TestHTTP(t *testing.T) {
+	g := got.T(t)
+
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer s.Close()
+
+	res := diag.Run(context.Background(), diag.Request{Op: diag.OpHTTP, Target: s.URL})
+	g.Eq(res.Error, "")
+	g.Eq(res.HTTP.Status, "200 OK")
+	g.Eq(res.HTTP.BodySize, 2)
+	g.Eq(res.HTTP.TLSInfo.Version, "TLS 1.3")
+	g.Has(res.HTTP.TLSInfo.VerifyError, "certificate")
+	g.Len(res.HTTP.TLSInfo.Certs, 1)
+}
+
+func TestHTTPConnClosed(t *testing.T) {
+	g := got.T(t)
+
+	closed := make(chan struct{}, 1)
+
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	s.Start()
+	defer s.Close()
+
+	res := diag.Run(context.Background(), diag.Request{Op: diag.OpHTTP, Target: s.URL})
+	g.Eq(res.Error, "")
+
+	// The connection isn't kept alive after the diagnosis.
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		g.Fatal("the connection is not closed")
+	}
+}
+
+func TestInterfaces(t *testing.T) {
+	g := got.T(t)
+
+	res := diag.Run(context.Background(), diag.Request{Op: diag.OpInterfaces})
+	g.Eq(res.Error, "")
+	g.Gt(len(res.Interfaces), 0)
+}
+
+func TestUnknownOp(t *testing.T) {
+	g := got.T(t)
+
+	res := diag.Run(context.Background(), diag.Request{Op: "unknown"})
+	g.Eq(res.Error, "unknown diagnosis op: unknown")
+}
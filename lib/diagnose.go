@@ -0,0 +1,100 @@
+package dehub
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/ysmood/dehub/lib/diag"
+	"golang.org/x/crypto/ssh"
+)
+
+// Diagnose runs the network diagnosis on the servant side, with the resolver and network of the servant.
+func (m *Master) Diagnose(req diag.Request) (*diag.Result, error) {
+	meta, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal diag request: %w", err)
+	}
+
+	ch, err := m.OpenChannel(CommandDiag, meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open diag channel: %w", err)
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	b, err := io.ReadAll(ch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read diag result: %w", err)
+	}
+
+	var res diag.Result
+
+	err = json.Unmarshal(b, &res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal diag result: %w", err)
+	}
+
+	return &res, nil
+}
+
+func (s *Servant) diagnose(ctx context.Context, newChan ssh.NewChannel) {
+	var req diag.Request
+	err := json.Unmarshal(newChan.ExtraData(), &req)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept diag channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	logger := s.Logger.With(slog.String("master-pubkey", masterPubKey(ctx)))
+
+	b, err := json.Marshal(diag.RunWithOptions(ctx, req, diag.Options{
+		Resolver: s.resolver(),
+		Dial:     s.diagDial(logger),
+	}))
+	if err != nil {
+		s.Logger.Error("failed to marshal diag result", "err", err)
+		return
+	}
+
+	_, _ = ch.Write(b)
+}
+
+// diagDial checks the destinations of the diagnosis with the [Servant.ForwardRules] like the other forwardings.
+func (s *Servant) diagDial(logger *slog.Logger) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		resolved, err := s.checkForward(ctx, addr)
+		if err != nil {
+			logger.Warn("diag destination denied", "dest", addr, "err", err)
+			return nil, err
+		}
+
+		conn, err := (&net.Dialer{}).DialContext(ctx, network, resolved)
+		if err != nil {
+			logger.Warn("diag failed to dial", "dest", addr, "addr", resolved, "err", err)
+			return nil, err
+		}
+
+		return newAuditConn(conn, func(sent, received int64, duration time.Duration) {
+			logger.Info("diag connection closed",
+				"dest", addr,
+				"addr", resolved,
+				"sent", sent,
+				"received", received,
+				"duration", duration.String(),
+			)
+		}), nil
+	}
+}
@@ -0,0 +1,472 @@
+package dehub
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/ysmood/dehub/lib/dirsync"
+	"golang.org/x/crypto/ssh"
+)
+
+// RemoteDir is a directory on the servant side, it implements [dirsync.Side].
+// The calls are sent as JSON lines over the channel, one response for each request.
+type RemoteDir struct {
+	lock sync.Mutex
+	ch   ssh.Channel
+	enc  *json.Encoder
+	dec  *json.Decoder
+}
+
+var _ dirsync.Side = (*RemoteDir)(nil)
+
+// OpenDir opens the directory of the servant to sync with [dirsync.Sync].
+func (m *Master) OpenDir(meta SyncMeta) (*RemoteDir, error) {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal SyncMeta: %w", err)
+	}
+
+	ch, err := m.OpenChannel(CommandSync, b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sync channel: %w", err)
+	}
+
+	return &RemoteDir{ch: ch, enc: json.NewEncoder(ch), dec: json.NewDecoder(ch)}, nil
+}
+
+func (d *RemoteDir) Close() error {
+	return d.ch.Close()
+}
+
+type syncMethod string
+
+const (
+	syncScan      syncMethod = "scan"
+	syncSignature syncMethod = "signature"
+	syncDelta     syncMethod = "delta"
+	syncApply     syncMethod = "apply"
+	syncRemove    syncMethod = "remove"
+)
+
+type syncRequest struct {
+	Method    syncMethod
+	Path      string             `json:",omitempty"`
+	Options   *dirsync.Options   `json:",omitempty"`
+	Signature *dirsync.Signature `json:",omitempty"`
+	Entry     *dirsync.Entry     `json:",omitempty"`
+	Delta     *dirsync.Delta     `json:",omitempty"`
+
+	// More means the delta continues in the next request.
+	More bool `json:",omitempty"`
+
+	// Error aborts the delta that is being streamed.
+	Error string `json:",omitempty"`
+}
+
+type syncResponse struct {
+	Error     string             `json:",omitempty"`
+	Entries   []dirsync.Entry    `json:",omitempty"`
+	Signature *dirsync.Signature `json:",omitempty"`
+	Delta     *dirsync.Delta     `json:",omitempty"`
+
+	// More means the delta continues in the next response.
+	More bool `json:",omitempty"`
+}
+
+// The max number of the chunks in a message of a streamed delta.
+const syncMaxChunks = 1024
+
+func (d *RemoteDir) call(req syncRequest) (*syncResponse, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	err := d.enc.Encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send sync request: %w", err)
+	}
+
+	return d.receive()
+}
+
+func (d *RemoteDir) receive() (*syncResponse, error) {
+	var res syncResponse
+
+	err := d.dec.Decode(&res)
+	if err != nil {
+		return nil, fmt.Errorf("failed to receive sync response: %w", err)
+	}
+
+	if res.Error != "" {
+		return nil, errors.New(res.Error)
+	}
+
+	return &res, nil
+}
+
+func (d *RemoteDir) Scan(opts dirsync.Options) ([]dirsync.Entry, error) {
+	res, err := d.call(syncRequest{Method: syncScan, Options: &opts})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Entries, nil
+}
+
+func (d *RemoteDir) Signature(path string) (*dirsync.Signature, error) {
+	res, err := d.call(syncRequest{Method: syncSignature, Path: path})
+	if err != nil {
+		return nil, err
+	}
+
+	return res.Signature, nil
+}
+
+// Delta streams the chunks from the servant, the other calls are blocked until the returned reader is closed.
+func (d *RemoteDir) Delta(path string, sig *dirsync.Signature) (dirsync.DeltaReader, error) {
+	d.lock.Lock()
+
+	err := d.enc.Encode(syncRequest{Method: syncDelta, Path: path, Signature: sig})
+	if err != nil {
+		d.lock.Unlock()
+		return nil, fmt.Errorf("failed to send sync request: %w", err)
+	}
+
+	res, err := d.receive()
+	if err != nil {
+		d.lock.Unlock()
+		return nil, err
+	}
+
+	if res.Delta == nil {
+		d.lock.Unlock()
+		return nil, errors.New("missing delta")
+	}
+
+	return &remoteDelta{dir: d, blockSize: res.Delta.BlockSize, chunks: res.Delta.Chunks, more: res.More}, nil
+}
+
+// Apply streams the delta to the servant.
+func (d *RemoteDir) Apply(e dirsync.Entry, delta dirsync.DeltaReader) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	req := syncRequest{Method: syncApply, Entry: &e}
+
+	if delta == nil {
+		err := d.enc.Encode(req)
+		if err != nil {
+			return fmt.Errorf("failed to send sync request: %w", err)
+		}
+
+		_, err = d.receive()
+
+		return err
+	}
+
+	readErr, sendErr := sendDelta(delta, func(batch *dirsync.Delta, more bool) error {
+		req.Delta, req.More = batch, more
+		err := d.enc.Encode(req)
+		req = syncRequest{}
+
+		return err
+	}, func(err error) error {
+		return d.enc.Encode(syncRequest{Error: err.Error()})
+	})
+	if sendErr != nil {
+		return sendErr
+	}
+
+	// The servant still responds after the delta is aborted.
+	_, err := d.receive()
+	if readErr != nil {
+		return readErr
+	}
+
+	return err
+}
+
+func (d *RemoteDir) Remove(path string) error {
+	_, err := d.call(syncRequest{Method: syncRemove, Path: path})
+	return err
+}
+
+// remoteDelta reads the chunks of the delta responses.
+type remoteDelta struct {
+	dir       *RemoteDir
+	blockSize int
+	chunks    []dirsync.Chunk
+	more      bool
+	closed    bool
+}
+
+func (r *remoteDelta) BlockSize() int {
+	return r.blockSize
+}
+
+func (r *remoteDelta) Next() (*dirsync.Chunk, error) {
+	for len(r.chunks) == 0 {
+		if !r.more {
+			return nil, io.EOF
+		}
+
+		res, err := r.dir.receive()
+		if err != nil {
+			r.more = false
+			return nil, err
+		}
+
+		if res.Delta == nil {
+			r.more = false
+			return nil, errors.New("missing delta")
+		}
+
+		r.chunks, r.more = res.Delta.Chunks, res.More
+	}
+
+	c := r.chunks[0]
+	r.chunks = r.chunks[1:]
+
+	return &c, nil
+}
+
+// Close drains the rest of the delta, so that the next call gets its own response.
+func (r *remoteDelta) Close() error {
+	if r.closed {
+		return nil
+	}
+
+	r.closed = true
+	defer r.dir.lock.Unlock()
+
+	var err error
+
+	for err == nil && r.more {
+		r.chunks = nil
+		_, err = r.Next()
+	}
+
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+
+	return err
+}
+
+// sendDelta sends the chunks of the delta in batches, the last batch is sent with more set to false.
+// If reading the delta fails, the abort is sent instead of the rest so that the receiver can stop waiting,
+// and the error is returned as the readErr.
+func sendDelta(
+	delta dirsync.DeltaReader, send func(batch *dirsync.Delta, more bool) error, abort func(error) error,
+) (readErr, sendErr error) {
+	batch := &dirsync.Delta{BlockSize: delta.BlockSize()}
+	size := 0
+
+	for {
+		c, err := delta.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err, abort(err)
+		}
+
+		batch.Chunks = append(batch.Chunks, *c)
+		size += len(c.Data)
+
+		if size >= dirsync.MaxChunkSize || len(batch.Chunks) >= syncMaxChunks {
+			err = send(batch, true)
+			if err != nil {
+				return nil, fmt.Errorf("failed to send delta: %w", err)
+			}
+
+			batch = &dirsync.Delta{BlockSize: delta.BlockSize()}
+			size = 0
+		}
+	}
+
+	err := send(batch, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send delta: %w", err)
+	}
+
+	return nil, nil
+}
+
+func (s *Servant) syncDir(newChan ssh.NewChannel) {
+	var meta SyncMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	root, err := s.shareRoot(meta.Path)
+	if err != nil {
+		_ = newChan.Reject(ShareDirDenied, err.Error())
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept sync channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	readOnly := meta.ReadOnly || s.ShareReadOnly
+
+	s.Logger.Info("sync dir", "path", root, "read-only", readOnly)
+
+	dir := &dirsync.Local{Root: root, ReadOnly: readOnly}
+	enc := json.NewEncoder(ch)
+	dec := json.NewDecoder(ch)
+
+	for {
+		var req syncRequest
+		err := dec.Decode(&req)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.Logger.Error("failed to decode sync request", "err", err)
+			}
+
+			return
+		}
+
+		err = serveSync(dir, req, dec, enc)
+		if err != nil {
+			s.Logger.Error("failed to send sync response", "err", err)
+			return
+		}
+	}
+}
+
+// serveSync handles the req, the delta of the apply is streamed from the dec,
+// and the delta of the delta method is streamed to the enc.
+func serveSync(dir *dirsync.Local, req syncRequest, dec *json.Decoder, enc *json.Encoder) error {
+	res := &syncResponse{}
+
+	var err error
+
+	switch req.Method {
+	case syncScan:
+		if req.Options == nil {
+			req.Options = &dirsync.Options{}
+		}
+
+		res.Entries, err = dir.Scan(*req.Options)
+	case syncSignature:
+		res.Signature, err = dir.Signature(req.Path)
+	case syncDelta:
+		if req.Signature == nil {
+			req.Signature = &dirsync.Signature{BlockSize: dirsync.DefaultBlockSize}
+		}
+
+		var delta dirsync.DeltaReader
+
+		delta, err = dir.Delta(req.Path, req.Signature)
+		if err == nil {
+			defer func() { _ = delta.Close() }()
+
+			// The read error is sent to the master as the response.
+			_, err = sendDelta(delta, func(batch *dirsync.Delta, more bool) error {
+				return enc.Encode(syncResponse{Delta: batch, More: more})
+			}, func(err error) error {
+				return enc.Encode(syncResponse{Error: err.Error()})
+			})
+
+			return err
+		}
+	case syncApply:
+		var delta *requestDelta
+		if req.Delta != nil {
+			delta = &requestDelta{dec: dec, blockSize: req.Delta.BlockSize, chunks: req.Delta.Chunks, more: req.More}
+		}
+
+		switch {
+		case req.Entry == nil:
+			err = errors.New("missing entry")
+		case delta == nil:
+			err = dir.Apply(*req.Entry, nil)
+		default:
+			err = dir.Apply(*req.Entry, delta)
+		}
+
+		if delta != nil {
+			err = errors.Join(err, delta.Close())
+		}
+	case syncRemove:
+		err = dir.Remove(req.Path)
+	default:
+		err = fmt.Errorf("unknown sync method: %s", req.Method)
+	}
+
+	if err != nil {
+		res.Error = err.Error()
+	}
+
+	return enc.Encode(res)
+}
+
+// requestDelta reads the chunks of the delta requests.
+type requestDelta struct {
+	dec       *json.Decoder
+	blockSize int
+	chunks    []dirsync.Chunk
+	more      bool
+}
+
+func (r *requestDelta) BlockSize() int {
+	return r.blockSize
+}
+
+func (r *requestDelta) Next() (*dirsync.Chunk, error) {
+	for len(r.chunks) == 0 {
+		if !r.more {
+			return nil, io.EOF
+		}
+
+		var req syncRequest
+
+		err := r.dec.Decode(&req)
+		if err != nil {
+			r.more = false
+			return nil, fmt.Errorf("failed to decode sync request: %w", err)
+		}
+
+		if req.Error != "" {
+			r.more = false
+			return nil, errors.New(req.Error)
+		}
+
+		if req.Delta == nil {
+			r.more = false
+			return nil, errors.New("missing delta")
+		}
+
+		r.chunks, r.more = req.Delta.Chunks, req.More
+	}
+
+	c := r.chunks[0]
+	r.chunks = r.chunks[1:]
+
+	return &c, nil
+}
+
+// Close drains the rest of the delta, such as when the apply fails early.
+func (r *requestDelta) Close() error {
+	for r.more {
+		r.chunks = nil
+
+		_, err := r.Next()
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,410 @@
+package dirsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// DefaultBlockSize of the [Signature].
+const DefaultBlockSize = 4 * 1024
+
+// MaxBlockSize of the [Signature] and [Delta], the larger ones are invalid.
+const MaxBlockSize = 1024 * 1024
+
+// Signature of the blocks of a file, the receiver sends it to the sender,
+// so that the sender only needs to send the blocks that the receiver doesn't have.
+type Signature struct {
+	BlockSize int
+	Blocks    []Block
+}
+
+type Block struct {
+	Weak   uint32 // The rolling checksum.
+	Strong string // The sha256 of the block.
+}
+
+// Delta to rebuild the new file from the old file of the receiver.
+type Delta struct {
+	BlockSize int
+	Chunks    []Chunk
+}
+
+// Chunk is either the index of a block in the old file or the literal data if the Data is not empty.
+type Chunk struct {
+	Block int    `json:",omitempty"`
+	Data  []byte `json:",omitempty"`
+}
+
+// NewSignature of the old file.
+func NewSignature(r io.Reader, blockSize int) (*Signature, error) {
+	sig := &Signature{BlockSize: blockSize}
+	buf := make([]byte, blockSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			sig.Blocks = append(sig.Blocks, Block{Weak: weakSum(buf[:n]), Strong: strongSum(buf[:n])})
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return sig, nil
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+}
+
+// MaxChunkSize of the literal data of a [Chunk].
+const MaxChunkSize = 64 * 1024
+
+// DeltaReader reads the chunks of a delta one by one, so that the whole file doesn't need to be in memory.
+type DeltaReader interface {
+	BlockSize() int
+
+	// Next chunk of the delta, it returns [io.EOF] when there's no more chunk.
+	Next() (*Chunk, error)
+
+	Close() error
+}
+
+// NewDelta of the data against the sig of the old file.
+// If the block size of the sig is invalid, the whole data is sent as literal.
+func NewDelta(sig *Signature, data []byte) *Delta {
+	r := NewDeltaReader(sig, bytes.NewReader(data))
+	d := &Delta{BlockSize: r.BlockSize()}
+
+	for {
+		c, err := r.Next()
+		if err != nil {
+			return d
+		}
+
+		d.Chunks = append(d.Chunks, *c)
+	}
+}
+
+// NewDeltaReader computes the delta of the new file r against the sig of the old file while reading r,
+// the memory usage is bounded by the block size and [MaxChunkSize].
+// If the block size of the sig is invalid, the whole data is sent as literal.
+// If r is an [io.Closer], it's closed by the Close of the returned reader.
+func NewDeltaReader(sig *Signature, r io.Reader) DeltaReader {
+	if sig.BlockSize <= 0 || sig.BlockSize > MaxBlockSize {
+		sig = &Signature{BlockSize: DefaultBlockSize}
+	}
+
+	b := &deltaBuilder{sig: sig, r: r, index: map[uint32][]int{}, tail: -1}
+
+	for i, block := range sig.Blocks {
+		b.index[block.Weak] = append(b.index[block.Weak], i)
+	}
+
+	// The last block of the old file may be shorter than the block size.
+	if len(sig.Blocks) > 0 {
+		b.tail = len(sig.Blocks) - 1
+	}
+
+	return b
+}
+
+// deltaBuilder moves a window of the block size over the new file,
+// buf[0] is the start of the pending literal data, and buf[i] is the start of the window.
+type deltaBuilder struct {
+	sig   *Signature
+	index map[uint32][]int
+	tail  int
+
+	r   io.Reader
+	eof bool
+
+	buf     []byte
+	i       int
+	sum     rolling
+	summed  bool // The sum is of the current window.
+	pending []Chunk
+	done    bool
+}
+
+func (b *deltaBuilder) BlockSize() int {
+	return b.sig.BlockSize
+}
+
+func (b *deltaBuilder) Next() (*Chunk, error) {
+	for len(b.pending) == 0 {
+		if b.done {
+			return nil, io.EOF
+		}
+
+		err := b.step()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c := b.pending[0]
+	b.pending = b.pending[1:]
+
+	return &c, nil
+}
+
+func (b *deltaBuilder) Close() error {
+	if c, ok := b.r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// step moves the window until some chunks are ready or the new file ends.
+func (b *deltaBuilder) step() error {
+	size := b.sig.BlockSize
+
+	for len(b.pending) == 0 {
+		err := b.fill(b.i + size)
+		if err != nil {
+			return err
+		}
+
+		if len(b.buf) < b.i+size {
+			b.finish()
+			return nil
+		}
+
+		window := b.buf[b.i : b.i+size]
+
+		if !b.summed {
+			b.sum.reset(window)
+			b.summed = true
+		}
+
+		if block, ok := b.match(b.sum.sum(), window); ok {
+			b.literal(b.buf[:b.i])
+			b.pending = append(b.pending, Chunk{Block: block})
+			b.shift(b.i + size)
+			b.summed = false
+
+			continue
+		}
+
+		err = b.fill(b.i + size + 1)
+		if err != nil {
+			return err
+		}
+
+		if b.i+size < len(b.buf) {
+			b.sum.roll(b.buf[b.i], b.buf[b.i+size])
+		} else {
+			b.summed = false
+		}
+
+		b.i++
+
+		// The window is unchanged by the shift, so is its sum.
+		if b.i >= MaxChunkSize {
+			b.literal(b.buf[:b.i])
+			b.shift(b.i)
+		}
+	}
+
+	return nil
+}
+
+// finish sends the rest of the new file, which is shorter than a block.
+func (b *deltaBuilder) finish() {
+	b.done = true
+
+	rest := b.buf
+	if b.tail >= 0 && len(rest) > 0 && len(rest) < b.sig.BlockSize && b.sig.Blocks[b.tail].Strong == strongSum(rest) {
+		b.pending = append(b.pending, Chunk{Block: b.tail})
+		return
+	}
+
+	b.literal(rest)
+}
+
+// fill reads the new file until the buf has n bytes or the file ends.
+func (b *deltaBuilder) fill(n int) error {
+	for len(b.buf) < n && !b.eof {
+		start := len(b.buf)
+		b.buf = slices.Grow(b.buf, max(n-start, readSize))[:cap(b.buf)]
+
+		l, err := b.r.Read(b.buf[start:])
+		b.buf = b.buf[:start+l]
+
+		if errors.Is(err, io.EOF) {
+			b.eof = true
+			break
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read file: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// shift drops the first n bytes of the buf, the window moves to the start of the buf.
+func (b *deltaBuilder) shift(n int) {
+	b.buf = append(b.buf[:0], b.buf[n:]...)
+	b.i = 0
+}
+
+func (b *deltaBuilder) match(weak uint32, window []byte) (int, bool) {
+	candidates, has := b.index[weak]
+	if !has {
+		return 0, false
+	}
+
+	strong := strongSum(window)
+
+	for _, i := range candidates {
+		if b.sig.Blocks[i].Strong == strong {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+func (b *deltaBuilder) literal(data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	b.pending = append(b.pending, Chunk{Data: bytes.Clone(data)})
+}
+
+// The size of each read from the new file.
+const readSize = 32 * 1024
+
+// Reader of the chunks of the delta.
+func (d *Delta) Reader() DeltaReader {
+	return &sliceDelta{blockSize: d.BlockSize, chunks: d.Chunks}
+}
+
+type sliceDelta struct {
+	blockSize int
+	chunks    []Chunk
+}
+
+func (d *sliceDelta) BlockSize() int {
+	return d.blockSize
+}
+
+func (d *sliceDelta) Next() (*Chunk, error) {
+	if len(d.chunks) == 0 {
+		return nil, io.EOF
+	}
+
+	c := d.chunks[0]
+	d.chunks = d.chunks[1:]
+
+	return &c, nil
+}
+
+func (d *sliceDelta) Close() error {
+	return nil
+}
+
+// Apply the delta to the old file and write the new file to w.
+func (d *Delta) Apply(old io.ReaderAt, w io.Writer) error {
+	return ApplyDelta(d.Reader(), old, w)
+}
+
+// ApplyDelta reads the chunks of the delta, applies them to the old file, and writes the new file to w.
+func ApplyDelta(d DeltaReader, old io.ReaderAt, w io.Writer) error {
+	if d.BlockSize() <= 0 || d.BlockSize() > MaxBlockSize {
+		return fmt.Errorf("invalid block size: %d", d.BlockSize())
+	}
+
+	buf := make([]byte, d.BlockSize())
+
+	for {
+		c, err := d.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if len(c.Data) > 0 {
+			_, err := w.Write(c.Data)
+			if err != nil {
+				return fmt.Errorf("failed to write data: %w", err)
+			}
+
+			continue
+		}
+
+		n, err := old.ReadAt(buf, int64(c.Block)*int64(d.BlockSize()))
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read block %d: %w", c.Block, err)
+		}
+
+		_, err = w.Write(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to write block %d: %w", c.Block, err)
+		}
+	}
+}
+
+// Size of the literal data in the delta, it's the data that needs to be transferred.
+func (d *Delta) Size() int64 {
+	var n int64
+	for _, c := range d.Chunks {
+		n += int64(len(c.Data))
+	}
+
+	return n
+}
+
+func strongSum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// The modulus of the rolling checksum.
+const mod = 1 << 16
+
+func weakSum(b []byte) uint32 {
+	var r rolling
+	r.reset(b)
+
+	return r.sum()
+}
+
+// rolling checksum of the rsync algorithm.
+type rolling struct {
+	a, b uint32
+	n    uint32
+}
+
+func (r *rolling) reset(b []byte) {
+	r.a, r.b, r.n = 0, 0, uint32(len(b))
+
+	for i, c := range b {
+		r.a += uint32(c)
+		r.b += (r.n - uint32(i)) * uint32(c)
+	}
+
+	r.a %= mod
+	r.b %= mod
+}
+
+func (r *rolling) roll(out, in byte) {
+	r.a = (r.a + mod - uint32(out) + uint32(in)) % mod
+	r.b = (r.b + mod*r.n - r.n*uint32(out) + r.a) % mod
+}
+
+func (r *rolling) sum() uint32 {
+	return r.a | r.b<<16 //nolint: mnd
+}
@@ -0,0 +1,583 @@
+// Package dirsync syncs the directories with the rsync-style delta transfer,
+// the files are compared with the checksums and only the changed blocks are transferred.
+package dirsync
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	securejoin "github.com/cyphar/filepath-securejoin"
+)
+
+type Options struct {
+	// Include only syncs the files that match one of the glob patterns, empty includes all.
+	// A pattern matches the slash-separated relative path or the base name of a file, such as "*.log".
+	Include []string
+
+	// Exclude skips the files and directories that match one of the glob patterns.
+	Exclude []string
+
+	// Delete removes the files of the destination that don't exist in the source.
+	Delete bool
+
+	// DryRun only reports the changes without applying them.
+	DryRun bool
+}
+
+// Entry of a file, directory, or symlink.
+type Entry struct {
+	// Path is the slash-separated path relative to the root.
+	Path    string
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+
+	// Hash is the sha256 of the regular file.
+	Hash string `json:",omitempty"`
+
+	// Link is the target of the symlink.
+	Link string `json:",omitempty"`
+}
+
+type ChangeType string
+
+const (
+	ChangeCreate ChangeType = "create"
+	ChangeUpdate ChangeType = "update"
+	ChangeDelete ChangeType = "delete"
+)
+
+type Change struct {
+	Type  ChangeType
+	Entry Entry
+
+	// Transferred is the size of the literal data sent for the file.
+	Transferred int64
+}
+
+// Side of the sync, it can be a local directory or a remote one.
+type Side interface {
+	// Scan the entries that match the opts, the parents are listed before the children.
+	Scan(opts Options) ([]Entry, error)
+
+	// Signature of the file, it has no blocks if the file doesn't exist.
+	Signature(path string) (*Signature, error)
+
+	// Delta of the file against the sig, the caller should close it.
+	Delta(path string, sig *Signature) (DeltaReader, error)
+
+	// Apply creates or updates the entry, for a regular file the delta is applied to the old file.
+	// The delta is nil for the other types.
+	Apply(e Entry, delta DeltaReader) error
+
+	// Remove the path recursively.
+	Remove(path string) error
+}
+
+// Sync the dst to make it the same as the src.
+func Sync(src, dst Side, opts Options) ([]Change, error) {
+	srcList, err := src.Scan(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan source: %w", err)
+	}
+
+	dstList, err := dst.Scan(opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan destination: %w", err)
+	}
+
+	dstMap := map[string]Entry{}
+	for _, e := range dstList {
+		dstMap[e.Path] = e
+	}
+
+	changes := []Change{}
+
+	for _, e := range srcList {
+		old, has := dstMap[e.Path]
+		delete(dstMap, e.Path)
+
+		change := Change{Type: ChangeCreate, Entry: e}
+
+		if has {
+			if same(old, e) {
+				continue
+			}
+
+			change.Type = ChangeUpdate
+		}
+
+		if !opts.DryRun {
+			change.Transferred, err = apply(src, dst, old, has, e)
+			if err != nil {
+				return changes, err
+			}
+		}
+
+		changes = append(changes, change)
+	}
+
+	if !opts.Delete {
+		return changes, nil
+	}
+
+	// Remove the children before the parents.
+	for i := len(dstList) - 1; i >= 0; i-- {
+		e := dstList[i]
+
+		if _, has := dstMap[e.Path]; !has {
+			continue
+		}
+
+		if !opts.DryRun {
+			err := dst.Remove(e.Path)
+			if err != nil {
+				return changes, fmt.Errorf("failed to remove %s: %w", e.Path, err)
+			}
+		}
+
+		changes = append(changes, Change{Type: ChangeDelete, Entry: e})
+	}
+
+	return changes, nil
+}
+
+func apply(src, dst Side, old Entry, has bool, e Entry) (int64, error) {
+	if has && old.Mode.Type() != e.Mode.Type() {
+		err := dst.Remove(e.Path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to remove %s: %w", e.Path, err)
+		}
+
+		has = false
+	}
+
+	if !e.Mode.IsRegular() {
+		err := dst.Apply(e, nil)
+		if err != nil {
+			return 0, fmt.Errorf("failed to apply %s: %w", e.Path, err)
+		}
+
+		return 0, nil
+	}
+
+	sig := &Signature{BlockSize: DefaultBlockSize}
+
+	if has {
+		var err error
+
+		sig, err = dst.Signature(e.Path)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get signature of %s: %w", e.Path, err)
+		}
+	}
+
+	delta, err := src.Delta(e.Path, sig)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get delta of %s: %w", e.Path, err)
+	}
+
+	defer func() { _ = delta.Close() }()
+
+	counter := &literalCounter{DeltaReader: delta}
+
+	err = dst.Apply(e, counter)
+	if err != nil {
+		return 0, fmt.Errorf("failed to apply %s: %w", e.Path, err)
+	}
+
+	return counter.n, nil
+}
+
+// literalCounter counts the size of the literal data that is transferred.
+type literalCounter struct {
+	DeltaReader
+	n int64
+}
+
+func (c *literalCounter) Next() (*Chunk, error) {
+	chunk, err := c.DeltaReader.Next()
+	if err == nil {
+		c.n += int64(len(chunk.Data))
+	}
+
+	return chunk, err
+}
+
+func same(a, b Entry) bool {
+	if a.Mode.Type() != b.Mode.Type() {
+		return false
+	}
+
+	switch {
+	case a.Mode.IsDir():
+		return true
+	case a.Mode.Type() == fs.ModeSymlink:
+		return a.Link == b.Link
+	default:
+		return a.Hash == b.Hash && a.Mode.Perm() == b.Mode.Perm()
+	}
+}
+
+// ErrReadOnly is returned when a read-only [Local] is changed.
+var ErrReadOnly = errors.New("directory is read-only")
+
+// ErrInvalidPath is returned when the path is empty, the root itself, or outside the root.
+var ErrInvalidPath = errors.New("invalid path")
+
+// ErrNotRegular is returned when the content of a path that isn't a regular file is read,
+// such as a symlink, so that a symlink in the root can't expose the file it points to.
+var ErrNotRegular = errors.New("not a regular file")
+
+// Local directory.
+type Local struct {
+	Root     string
+	ReadOnly bool
+
+	// The entries of the last scan, a file is only hashed again if its size or modification time changes.
+	hashes map[string]Entry
+}
+
+func (l *Local) Scan(opts Options) ([]Entry, error) {
+	list := []Entry{}
+
+	err := filepath.WalkDir(l.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(l.Root, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		rel = filepath.ToSlash(rel)
+
+		if match(opts.Exclude, rel) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		// The parent directories of the included files are created on demand.
+		if len(opts.Include) > 0 && (d.IsDir() || !match(opts.Include, rel)) {
+			return nil
+		}
+
+		e, err := l.entry(rel)
+		if err != nil {
+			return err
+		}
+
+		list = append(list, e)
+
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk directory: %w", err)
+	}
+
+	l.hashes = map[string]Entry{}
+
+	for _, e := range list {
+		if e.Hash != "" {
+			l.hashes[e.Path] = e
+		}
+	}
+
+	return list, nil
+}
+
+func (l *Local) entry(rel string) (Entry, error) {
+	p, err := l.path(rel)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	info, err := os.Lstat(p)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	e := Entry{Path: rel, Mode: info.Mode(), Size: info.Size(), ModTime: info.ModTime()}
+
+	switch {
+	case info.Mode().Type() == fs.ModeSymlink:
+		e.Link, err = os.Readlink(p)
+	case info.Mode().IsRegular():
+		if old, has := l.hashes[rel]; has && old.Size == e.Size && old.ModTime.Equal(e.ModTime) && old.Mode == e.Mode {
+			e.Hash = old.Hash
+		} else {
+			e.Hash, err = hashFile(p)
+		}
+	}
+
+	return e, err
+}
+
+func (l *Local) Signature(rel string) (*Signature, error) {
+	p, err := l.path(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openRegular(p)
+	if err != nil {
+		// The symlink will be replaced by the new file as a whole.
+		if errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrNotRegular) {
+			return &Signature{BlockSize: DefaultBlockSize}, nil
+		}
+
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSignature(f, blockSize(info.Size()))
+}
+
+// blockSize grows with the square root of the file size like rsync, so that the signature of a large file is small.
+func blockSize(size int64) int {
+	n := int(math.Sqrt(float64(size)))
+	n = (n + DefaultBlockSize - 1) / DefaultBlockSize * DefaultBlockSize
+
+	return min(max(n, DefaultBlockSize), MaxBlockSize)
+}
+
+func (l *Local) Delta(rel string, sig *Signature) (DeltaReader, error) {
+	p, err := l.path(rel)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openRegular(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDeltaReader(sig, f), nil
+}
+
+func (l *Local) Apply(e Entry, delta DeltaReader) error {
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	p, err := l.path(e.Path)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0o755) //nolint: mnd
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case e.Mode.IsDir():
+		err := os.Mkdir(p, e.Mode.Perm())
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+
+		return nil
+	case e.Mode.Type() == fs.ModeSymlink:
+		_ = os.Remove(p)
+		return os.Symlink(e.Link, p)
+	case e.Mode.IsRegular():
+		return l.applyFile(p, e, delta)
+	}
+
+	return fmt.Errorf("unsupported file type: %s", e.Mode.Type())
+}
+
+// applyFile writes the new file to a temp file then renames it, so the old file is intact if it fails.
+func (l *Local) applyFile(p string, e Entry, delta DeltaReader) error {
+	if delta == nil {
+		delta = (&Delta{BlockSize: DefaultBlockSize}).Reader()
+	}
+
+	old, err := openRegular(p)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) && !errors.Is(err, ErrNotRegular) {
+			return err
+		}
+
+		old = nil
+	} else {
+		defer func() { _ = old.Close() }()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".dehub-sync-*")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	h := sha256.New()
+
+	var base io.ReaderAt = emptyReaderAt{}
+	if old != nil {
+		base = old
+	}
+
+	err = ApplyDelta(delta, base, io.MultiWriter(tmp, h))
+	if err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != e.Hash {
+		return fmt.Errorf("checksum mismatch of %s", e.Path)
+	}
+
+	err = os.Chmod(tmp.Name(), e.Mode.Perm())
+	if err != nil {
+		return err
+	}
+
+	err = os.Chtimes(tmp.Name(), e.ModTime, e.ModTime)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp.Name(), p)
+	if err != nil {
+		return err
+	}
+
+	if l.hashes != nil {
+		l.hashes[e.Path] = e
+	}
+
+	return nil
+}
+
+func (l *Local) Remove(rel string) error {
+	if l.ReadOnly {
+		return ErrReadOnly
+	}
+
+	p, err := l.path(rel)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(p)
+}
+
+// path converts the rel to the os path, the symlinks in the parents of the rel can't escape the root.
+// The last element isn't followed, so that the symlink itself can be synced.
+// The rel must be a relative path inside the root, the root itself is rejected,
+// so that a bad path can't remove or overwrite the whole root.
+func (l *Local) path(rel string) (string, error) {
+	clean := path.Clean(rel)
+	if rel == "" || path.IsAbs(rel) || clean == "." || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPath, rel)
+	}
+
+	rel = path.Clean("/" + clean)
+
+	dir, err := securejoin.SecureJoin(l.Root, filepath.FromSlash(path.Dir(rel)))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, path.Base(rel)), nil
+}
+
+func match(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+
+		if ok, _ := path.Match(p, path.Base(rel)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// openRegular opens the regular file at the p without following the symlink of the last element.
+// The opened file is compared with the checked one, so that it can't be swapped to a symlink in between.
+func openRegular(p string) (*os.File, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s", ErrNotRegular, p)
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	opened, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+
+	if !os.SameFile(info, opened) {
+		_ = f.Close()
+		return nil, fmt.Errorf("%w: %s", ErrNotRegular, p)
+	}
+
+	return f, nil
+}
+
+func hashFile(p string) (string, error) {
+	f, err := openRegular(p)
+	if err != nil {
+		return "", err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	h := sha256.New()
+
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+type emptyReaderAt struct{}
+
+func (emptyReaderAt) ReadAt([]byte, int64) (int, error) {
+	return 0, io.EOF
+}
@@ -0,0 +1,224 @@
+package dirsync_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ysmood/dehub/lib/dirsync"
+	"github.com/ysmood/got"
+)
+
+func TestDelta(t *testing.T) {
+	g := got.T(t)
+
+	old := make([]byte, 10*dirsync.DefaultBlockSize+100)
+	_, _ = rand.Read(old)
+
+	// Insert data in the middle and change the tail.
+	data := bytes.Clone(old[:3*dirsync.DefaultBlockSize+7])
+	data = append(data, []byte("inserted")...)
+	data = append(data, old[3*dirsync.DefaultBlockSize+7:len(old)-50]...)
+	data = append(data, []byte("tail")...)
+
+	sig, err := dirsync.NewSignature(bytes.NewReader(old), dirsync.DefaultBlockSize)
+	g.E(err)
+
+	delta := dirsync.NewDelta(sig, data)
+	g.Lt(delta.Size(), 2*dirsync.DefaultBlockSize+100)
+
+	buf := bytes.NewBuffer(nil)
+	g.E(delta.Apply(bytes.NewReader(old), buf))
+	g.Eq(buf.Bytes(), data)
+
+	// The same file only sends the block indexes.
+	delta = dirsync.NewDelta(sig, old)
+	g.Eq(delta.Size(), 0)
+
+	buf.Reset()
+	g.E(delta.Apply(bytes.NewReader(old), buf))
+	g.Eq(buf.Bytes(), old)
+}
+
+func TestDeltaReader(t *testing.T) {
+	g := got.T(t)
+
+	old := make([]byte, 3*dirsync.MaxChunkSize)
+	_, _ = rand.Read(old)
+
+	data := make([]byte, 3*dirsync.MaxChunkSize+10)
+	_, _ = rand.Read(data)
+	data = append(data, old[dirsync.MaxChunkSize:]...)
+
+	sig, err := dirsync.NewSignature(bytes.NewReader(old), dirsync.DefaultBlockSize)
+	g.E(err)
+
+	delta := dirsync.NewDeltaReader(sig, bytes.NewReader(data))
+
+	buf := bytes.NewBuffer(nil)
+	g.E(dirsync.ApplyDelta(&maxChunk{g, delta}, bytes.NewReader(old), buf))
+	g.Eq(buf.Bytes(), data)
+}
+
+// maxChunk checks that the literal data of each chunk is bounded.
+type maxChunk struct {
+	g got.G
+	dirsync.DeltaReader
+}
+
+func (m *maxChunk) Next() (*dirsync.Chunk, error) {
+	c, err := m.DeltaReader.Next()
+	if err == nil {
+		m.g.Lte(len(c.Data), dirsync.MaxChunkSize)
+	}
+
+	return c, err
+}
+
+func TestInvalidPath(t *testing.T) {
+	g := got.T(t)
+
+	root := t.TempDir()
+	g.E(os.WriteFile(filepath.Join(root, "a"), nil, 0o600))
+
+	dir := &dirsync.Local{Root: root}
+
+	for _, p := range []string{"", ".", "/", "..", "../a", "a/../..", "/a"} {
+		g.Is(dir.Remove(p), dirsync.ErrInvalidPath)
+		g.Is(dir.Apply(dirsync.Entry{Path: p, Mode: 0o600}, nil), dirsync.ErrInvalidPath)
+	}
+
+	g.PathExists(filepath.Join(root, "a"))
+}
+
+func TestSymlinkContent(t *testing.T) {
+	g := got.T(t)
+
+	root, outside := t.TempDir(), t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	g.E(os.WriteFile(secret, []byte("secret"), 0o600))
+	g.E(os.Symlink(secret, filepath.Join(root, "x")))
+
+	dir := &dirsync.Local{Root: root}
+
+	sig, err := dir.Signature("x")
+	g.E(err)
+	g.Len(sig.Blocks, 0)
+
+	_, err = dir.Delta("x", sig)
+	g.Is(err, dirsync.ErrNotRegular)
+
+	// The file that replaces the symlink can't copy the blocks of the file it points to.
+	delta := &dirsync.Delta{BlockSize: dirsync.DefaultBlockSize, Chunks: []dirsync.Chunk{{Block: 0}}}
+	g.Err(dir.Apply(dirsync.Entry{Path: "x", Mode: 0o600}, delta.Reader()))
+
+	info, err := os.Lstat(filepath.Join(root, "x"))
+	g.E(err)
+	g.Eq(info.Mode()&os.ModeSymlink, os.ModeSymlink)
+	g.Eq(g.Read(secret).String(), "secret")
+}
+
+func TestScanCache(t *testing.T) {
+	g := got.T(t)
+
+	root := t.TempDir()
+	p := filepath.Join(root, "a")
+	g.E(os.WriteFile(p, []byte("a"), 0o600))
+
+	dir := &dirsync.Local{Root: root}
+
+	list, err := dir.Scan(dirsync.Options{})
+	g.E(err)
+
+	info, err := os.Stat(p)
+	g.E(err)
+
+	// The same size and modification time, the file is not hashed again.
+	g.E(os.WriteFile(p, []byte("b"), 0o600))
+	g.E(os.Chtimes(p, info.ModTime(), info.ModTime()))
+
+	cached, err := dir.Scan(dirsync.Options{})
+	g.E(err)
+	g.Eq(cached[0].Hash, list[0].Hash)
+
+	g.E(os.WriteFile(p, []byte("bb"), 0o600))
+
+	updated, err := dir.Scan(dirsync.Options{})
+	g.E(err)
+	g.Neq(updated[0].Hash, list[0].Hash)
+}
+
+func TestSync(t *testing.T) {
+	g := got.T(t)
+
+	src, dst := t.TempDir(), t.TempDir()
+
+	write := func(p, content string) {
+		p = filepath.Join(src, p)
+		g.E(os.MkdirAll(filepath.Dir(p), 0o755))
+		g.E(os.WriteFile(p, []byte(content), 0o600))
+	}
+
+	write("a.txt", "a")
+	write("sub/b.txt", "b")
+	write("sub/c.log", "c")
+	write("skip/d.txt", "d")
+	g.E(os.Symlink("a.txt", filepath.Join(src, "link")))
+	g.E(os.WriteFile(filepath.Join(dst, "extra"), nil, 0o600))
+
+	opts := dirsync.Options{Exclude: []string{"skip", "*.log"}, Delete: true, DryRun: true}
+
+	changes, err := dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst}, opts)
+	g.E(err)
+	g.Len(changes, 5)
+	g.Eq(changes[4].Type, dirsync.ChangeDelete)
+	g.PathExists(filepath.Join(dst, "extra"))
+	g.False(g.PathExists(filepath.Join(dst, "a.txt")))
+
+	opts.DryRun = false
+
+	_, err = dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst}, opts)
+	g.E(err)
+	g.Eq(g.Read(filepath.Join(dst, "sub/b.txt")).String(), "b")
+	link, err := os.Readlink(filepath.Join(dst, "link"))
+	g.E(err)
+	g.Eq(link, "a.txt")
+	g.False(g.PathExists(filepath.Join(dst, "sub/c.log")))
+	g.False(g.PathExists(filepath.Join(dst, "skip")))
+	g.False(g.PathExists(filepath.Join(dst, "extra")))
+
+	write("a.txt", "updated")
+
+	changes, err = dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst}, opts)
+	g.E(err)
+	g.Len(changes, 1)
+	g.Eq(changes[0].Type, dirsync.ChangeUpdate)
+	g.Eq(g.Read(filepath.Join(dst, "a.txt")).String(), "updated")
+
+	_, err = dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst, ReadOnly: true}, opts)
+	g.E(err)
+
+	write("new", "")
+
+	_, err = dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst, ReadOnly: true}, opts)
+	g.Is(err, dirsync.ErrReadOnly)
+}
+
+func TestSyncInclude(t *testing.T) {
+	g := got.T(t)
+
+	src, dst := t.TempDir(), t.TempDir()
+
+	g.E(os.MkdirAll(filepath.Join(src, "a/b"), 0o755))
+	g.E(os.WriteFile(filepath.Join(src, "a/b/c.log"), []byte("c"), 0o600))
+	g.E(os.WriteFile(filepath.Join(src, "a/d.txt"), []byte("d"), 0o600))
+
+	changes, err := dirsync.Sync(&dirsync.Local{Root: src}, &dirsync.Local{Root: dst},
+		dirsync.Options{Include: []string{"*.log"}})
+	g.E(err)
+	g.Len(changes, 1)
+	g.Eq(g.Read(filepath.Join(dst, "a/b/c.log")).String(), "c")
+	g.False(g.PathExists(filepath.Join(dst, "a/d.txt")))
+}
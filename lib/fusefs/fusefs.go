@@ -0,0 +1,387 @@
+//go:build linux || darwin
+
+// Package fusefs mounts a nfs server via FUSE with a userspace nfs client,
+// so that neither the root privilege nor the kernel nfs client is needed.
+package fusefs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+	"github.com/hanwen/go-fuse/v2/fuse/nodefs"
+	"github.com/hanwen/go-fuse/v2/fuse/pathfs"
+	"github.com/willscott/go-nfs-client/nfs"
+	"github.com/willscott/go-nfs-client/nfs/rpc"
+)
+
+// Server of a mounted directory.
+type Server struct {
+	fuse   *fuse.Server
+	client *rpc.Client
+}
+
+// Mount the nfs server at the nfsAddr to the dir.
+func Mount(nfsAddr, dir string) (*Server, error) {
+	client, err := rpc.DialTCP("tcp", nfsAddr, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial nfs server: %w", err)
+	}
+
+	mount := &nfs.Mount{Client: client}
+
+	target, err := mount.Mount("/", rpc.AuthNull)
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to mount nfs: %w", err)
+	}
+
+	pfs := pathfs.NewPathNodeFs(&fileSystem{
+		FileSystem: pathfs.NewDefaultFileSystem(),
+		target:     target,
+	}, nil)
+
+	conn := nodefs.NewFileSystemConnector(pfs.Root(), nil)
+
+	srv, err := fuse.NewServer(conn.RawFS(), dir, &fuse.MountOptions{
+		Name:   "dehub",
+		FsName: "dehub",
+
+		// Use the mount syscall when running as root, otherwise fallback to fusermount.
+		DirectMount: true,
+	})
+	if err != nil {
+		_ = mount.Unmount()
+		client.Close()
+
+		return nil, fmt.Errorf("failed to mount fuse: %w", err)
+	}
+
+	go srv.Serve()
+
+	err = srv.WaitMount()
+	if err != nil {
+		_ = srv.Unmount()
+		_ = mount.Unmount()
+		client.Close()
+
+		return nil, fmt.Errorf("failed to wait fuse mount: %w", err)
+	}
+
+	return &Server{fuse: srv, client: client}, nil
+}
+
+// Unmount the dir and close the nfs client.
+func (s *Server) Unmount() error {
+	err := s.fuse.Unmount()
+	if err != nil {
+		return fmt.Errorf("failed to unmount fuse: %w", err)
+	}
+
+	// The nfs unmount call is only advisory, it blocks forever if the servant is gone, so it's skipped.
+	s.client.Close()
+
+	return nil
+}
+
+// Wait until the dir is unmounted.
+func (s *Server) Wait() {
+	s.fuse.Wait()
+}
+
+// fileSystem translates the path based FUSE operations to the nfs client calls.
+// The nfs client isn't safe for concurrent use, so all the calls are serialized.
+type fileSystem struct {
+	pathfs.FileSystem
+
+	lock   sync.Mutex
+	target *nfs.Target
+}
+
+func (fs *fileSystem) String() string {
+	return "dehub"
+}
+
+func (fs *fileSystem) GetAttr(name string, _ *fuse.Context) (*fuse.Attr, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	info, _, err := fs.target.Lookup(name)
+	if err != nil {
+		return nil, status(err)
+	}
+
+	return toAttr(info.(*nfs.Fattr)), fuse.OK
+}
+
+func (fs *fileSystem) OpenDir(name string, _ *fuse.Context) ([]fuse.DirEntry, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	list, err := fs.target.ReadDirPlus(name)
+	if err != nil {
+		return nil, status(err)
+	}
+
+	entries := make([]fuse.DirEntry, 0, len(list))
+	for _, e := range list {
+		entries = append(entries, fuse.DirEntry{
+			Name: e.Name(),
+			Ino:  e.FileId,
+			Mode: fileType(e.Attr.Attr.Type),
+		})
+	}
+
+	return entries, fuse.OK
+}
+
+func (fs *fileSystem) Open(name string, flags uint32, _ *fuse.Context) (nodefs.File, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	if flags&syscall.O_TRUNC != 0 {
+		err := fs.target.Setattr(name, nfs.Sattr3{Size: nfs.SetSize{SetIt: true}})
+		if err != nil {
+			return nil, status(err)
+		}
+	}
+
+	f, err := fs.target.Open(name)
+	if err != nil {
+		return nil, status(err)
+	}
+
+	return fs.newFile(f), fuse.OK
+}
+
+func (fs *fileSystem) Create(name string, flags uint32, mode uint32, _ *fuse.Context) (nodefs.File, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	// The OpenFile opens the existing file as it is, so the O_EXCL and O_TRUNC are handled here.
+	_, _, err := fs.target.Lookup(name)
+	if err == nil {
+		if flags&syscall.O_EXCL != 0 {
+			return nil, fuse.Status(syscall.EEXIST)
+		}
+
+		if flags&syscall.O_TRUNC != 0 {
+			err = fs.target.Setattr(name, nfs.Sattr3{Size: nfs.SetSize{SetIt: true}})
+			if err != nil {
+				return nil, status(err)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, status(err)
+	}
+
+	f, err := fs.target.OpenFile(name, os.FileMode(mode).Perm())
+	if err != nil {
+		return nil, status(err)
+	}
+
+	return fs.newFile(f), fuse.OK
+}
+
+func (fs *fileSystem) Mkdir(name string, mode uint32, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error {
+		_, err := fs.target.Mkdir(name, os.FileMode(mode).Perm())
+		return err
+	})
+}
+
+func (fs *fileSystem) Rmdir(name string, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error { return fs.target.RmDir(name) })
+}
+
+func (fs *fileSystem) Unlink(name string, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error { return fs.target.Remove(name) })
+}
+
+func (fs *fileSystem) Rename(oldName string, newName string, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error { return fs.target.Rename(oldName, newName) })
+}
+
+func (fs *fileSystem) Symlink(value string, linkName string, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error { return fs.target.Symlink(value, linkName) })
+}
+
+func (fs *fileSystem) Readlink(name string, _ *fuse.Context) (string, fuse.Status) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	f, err := fs.target.Open(name)
+	if err != nil {
+		return "", status(err)
+	}
+
+	link, err := f.Readlink()
+
+	return link, status(err)
+}
+
+func (fs *fileSystem) Truncate(name string, size uint64, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error {
+		return fs.target.Setattr(name, nfs.Sattr3{Size: nfs.SetSize{SetIt: true, Size: size}})
+	})
+}
+
+func (fs *fileSystem) Chmod(name string, mode uint32, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error {
+		return fs.target.Setattr(name, nfs.Sattr3{Mode: nfs.SetMode{SetIt: true, Mode: mode & 0o7777}}) //nolint: mnd
+	})
+}
+
+func (fs *fileSystem) Utimens(name string, atime *time.Time, mtime *time.Time, _ *fuse.Context) fuse.Status {
+	return fs.do(func() error {
+		return fs.target.Setattr(name, nfs.Sattr3{Atime: setTime(atime), Mtime: setTime(mtime)})
+	})
+}
+
+func (fs *fileSystem) do(fn func() error) fuse.Status {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+
+	return status(fn())
+}
+
+func (fs *fileSystem) newFile(f *nfs.File) nodefs.File {
+	return &file{File: nodefs.NewDefaultFile(), fs: fs, f: f}
+}
+
+type file struct {
+	nodefs.File
+
+	fs *fileSystem
+	f  *nfs.File
+}
+
+func (f *file) Read(dest []byte, off int64) (fuse.ReadResult, fuse.Status) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	n, err := f.f.ReadAt(dest, off)
+	if err != nil && n == 0 && !errors.Is(err, io.EOF) {
+		return nil, status(err)
+	}
+
+	return fuse.ReadResultData(dest[:n]), fuse.OK
+}
+
+func (f *file) Write(data []byte, off int64) (uint32, fuse.Status) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	_, err := f.f.Seek(off, io.SeekStart)
+	if err != nil {
+		return 0, status(err)
+	}
+
+	n, err := f.f.Write(data)
+
+	return uint32(n), status(err)
+}
+
+// Flush is called on every close of the duplicated fds, the writes are already synced to the nfs server,
+// so there's nothing to flush. The file is closed by the [file.Release] once all the fds are closed.
+func (f *file) Flush() fuse.Status {
+	return fuse.OK
+}
+
+func (f *file) Release() {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	_ = f.f.Close()
+}
+
+func (f *file) Fsync(int) fuse.Status {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	return status(f.f.Close())
+}
+
+func toAttr(a *nfs.Fattr) *fuse.Attr {
+	return &fuse.Attr{
+		Ino:       a.Fileid,
+		Size:      a.Filesize,
+		Blocks:    (a.Used + 511) / 512,                 //nolint: mnd
+		Mode:      fileType(a.Type) | a.FileMode&0o7777, //nolint: mnd
+		Nlink:     a.Nlink,
+		Owner:     fuse.Owner{Uid: a.UID, Gid: a.GID},
+		Atime:     uint64(a.Atime.Seconds),
+		Atimensec: a.Atime.Nseconds,
+		Mtime:     uint64(a.Mtime.Seconds),
+		Mtimensec: a.Mtime.Nseconds,
+		Ctime:     uint64(a.Ctime.Seconds),
+		Ctimensec: a.Ctime.Nseconds,
+	}
+}
+
+func fileType(t uint32) uint32 {
+	switch t {
+	case nfs.NF3Dir:
+		return syscall.S_IFDIR
+	case nfs.NF3Blk:
+		return syscall.S_IFBLK
+	case nfs.NF3Chr:
+		return syscall.S_IFCHR
+	case nfs.NF3Lnk:
+		return syscall.S_IFLNK
+	case nfs.NF3Sock:
+		return syscall.S_IFSOCK
+	case nfs.NF3FIFO:
+		return syscall.S_IFIFO
+	default:
+		return syscall.S_IFREG
+	}
+}
+
+func setTime(t *time.Time) nfs.SetTime {
+	if t == nil {
+		return nfs.SetTime{}
+	}
+
+	return nfs.SetTime{
+		SetIt: nfs.SetToClientTime,
+		Time:  nfs.NFS3Time{Seconds: uint32(t.Unix()), Nseconds: uint32(t.Nanosecond())},
+	}
+}
+
+// status converts the nfs errors to the FUSE status, the nfs error numbers below 10000 are the same as the errno.
+func status(err error) fuse.Status {
+	if err == nil {
+		return fuse.OK
+	}
+
+	var nfsErr *nfs.Error
+	if errors.As(err, &nfsErr) {
+		switch {
+		case nfsErr.ErrorNum == nfs.NFS3ErrNotSupp:
+			return fuse.ENOSYS
+		case nfsErr.ErrorNum < nfs.NFS3ErrBadHandle:
+			return fuse.Status(nfsErr.ErrorNum)
+		default:
+			return fuse.EIO
+		}
+	}
+
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return fuse.ENOENT
+	case errors.Is(err, os.ErrExist):
+		return fuse.Status(syscall.EEXIST)
+	case errors.Is(err, os.ErrPermission):
+		return fuse.EPERM
+	case errors.Is(err, os.ErrInvalid):
+		return fuse.EINVAL
+	}
+
+	return fuse.EIO
+}
@@ -0,0 +1,21 @@
+//go:build !linux && !darwin
+
+package fusefs
+
+import "errors"
+
+// Server of a mounted directory.
+type Server struct{}
+
+// Mount the nfs server at the nfsAddr to the dir.
+func Mount(_, _ string) (*Server, error) {
+	return nil, errors.New("fuse is only supported on linux and macos")
+}
+
+// Unmount the dir and close the nfs client.
+func (s *Server) Unmount() error {
+	return nil
+}
+
+// Wait until the dir is unmounted.
+func (s *Server) Wait() {}
@@ -0,0 +1,86 @@
+//go:build linux
+
+package fusefs_test
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/willscott/go-nfs"
+	nfshelper "github.com/willscott/go-nfs/helpers"
+	"github.com/ysmood/dehub/lib/fusefs"
+	osfsx "github.com/ysmood/dehub/lib/osfs"
+	"github.com/ysmood/dehub/lib/utils"
+	"github.com/ysmood/got"
+)
+
+func TestMount(t *testing.T) {
+	g := got.T(t)
+
+	remote := t.TempDir()
+	local := t.TempDir()
+
+	nfs.Log.SetLevel(-1)
+
+	g.E(os.WriteFile(filepath.Join(remote, "a.txt"), []byte("ok"), 0o600))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l.Close() }()
+
+	handler := nfshelper.NewNullAuthHandler(osfsx.New(osfs.New(remote, osfs.WithBoundOS())))
+	go func() { _ = nfs.Serve(l, nfshelper.NewCachingHandler(handler, 1024)) }()
+
+	srv, err := fusefs.Mount(l.Addr().String(), local)
+	if err != nil {
+		g.Skip("fuse is not available: ", err)
+	}
+	defer func() { g.E(srv.Unmount()) }()
+
+	mounts, err := utils.Mounts()
+	g.E(err)
+	g.Has(mounts, local)
+	g.False(utils.IsStaleMount(local))
+
+	g.Eq(g.Read(filepath.Join(local, "a.txt")).String(), "ok")
+
+	g.E(os.WriteFile(filepath.Join(local, "b.txt"), []byte("hello"), 0o600))
+	g.Eq(g.Read(filepath.Join(remote, "b.txt")).String(), "hello")
+
+	// The file is still writable after a duplicated fd is closed.
+	f, err := os.Create(filepath.Join(local, "d.txt"))
+	g.E(err)
+	dup, err := syscall.Dup(int(f.Fd()))
+	g.E(err)
+	g.E(syscall.Close(dup))
+	_, err = f.WriteString("dup")
+	g.E(err)
+	g.E(f.Close())
+	g.Eq(g.Read(filepath.Join(remote, "d.txt")).String(), "dup")
+
+	_, err = os.OpenFile(filepath.Join(local, "d.txt"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	g.True(os.IsExist(err))
+
+	g.E(os.WriteFile(filepath.Join(local, "d.txt"), []byte("x"), 0o600))
+	g.Eq(g.Read(filepath.Join(remote, "d.txt")).String(), "x")
+
+	g.E(os.Mkdir(filepath.Join(local, "dir"), 0o755))
+	g.E(os.Rename(filepath.Join(local, "b.txt"), filepath.Join(local, "dir", "c.txt")))
+	g.Eq(g.Read(filepath.Join(remote, "dir", "c.txt")).String(), "hello")
+
+	list, err := os.ReadDir(local)
+	g.E(err)
+	g.Len(list, 3)
+	g.Eq(list[0].Name(), "a.txt")
+	g.Eq(list[1].Name(), "d.txt")
+	g.True(list[2].IsDir())
+
+	g.E(os.Remove(filepath.Join(local, "a.txt")))
+	_, err = os.Stat(filepath.Join(remote, "a.txt"))
+	g.True(os.IsNotExist(err))
+
+}
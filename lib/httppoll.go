@@ -0,0 +1,455 @@
+package dehub
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ysmood/dehub/lib/xsync"
+)
+
+// The address prefixes to connect via the HTTP long-polling, such as "https+poll://dehub.ysmood.org/poll".
+const (
+	HTTPPollScheme  = "http+poll://"
+	HTTPSPollScheme = "https+poll://"
+)
+
+// The max duration that a poll request waits for the data,
+// it's shorter than the common idle timeout of the proxies.
+const pollTimeout = 20 * time.Second
+
+// A session is closed if it isn't polled for the duration, it's also how long the client retries.
+const pollSessionTimeout = time.Minute
+
+// The wait between the retries of a failed request.
+const pollRetryInterval = time.Second
+
+// The max bytes of a request or response body, it's also the max bytes buffered for each direction.
+const pollMaxChunk = 1 << 20
+
+var (
+	errPollClosed        = errors.New("poll session closed")
+	errPollInvalidOffset = errors.New("invalid poll offset")
+)
+
+// IsHTTPPollAddr returns true if the addr has the [HTTPPollScheme] or [HTTPSPollScheme] prefix.
+func IsHTTPPollAddr(addr string) bool {
+	return strings.HasPrefix(addr, HTTPPollScheme) || strings.HasPrefix(addr, HTTPSPollScheme)
+}
+
+// HTTPPollHandler serves the HTTP long-polling transport for the networks that only allow plain HTTP requests.
+// Each session is handled by [Hub.Handle] as a normal connection, the clients connect to it with [DialHTTPPoll].
+func (h *Hub) HTTPPollHandler() http.Handler {
+	return &pollHandler{handle: func(conn net.Conn) { h.Handle(conn) }}
+}
+
+// The protocol of a session:
+//   - POST without id opens a session, the response is the session id.
+//   - GET with the id and offset acknowledges the bytes before the offset,
+//     and waits for the bytes after it, the response is empty if there's none before the [pollTimeout].
+//   - POST with the id and offset sends the body as the bytes at the offset, the duplicated bytes are skipped.
+//   - DELETE with the id closes the session.
+//
+// Because every request carries the offset, a failed request can be retried to resume the session.
+type pollHandler struct {
+	handle   func(net.Conn)
+	sessions xsync.Map[string, *pollSession]
+}
+
+type pollSession struct {
+	conn   net.Conn // The pipe end to the handle.
+	down   *pollBuffer
+	expire *time.Timer
+
+	upLock sync.Mutex
+	up     int64 // The bytes received from the client.
+}
+
+func (p *pollHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get("id")
+
+	if id == "" {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		p.open(w)
+
+		return
+	}
+
+	s, has := p.sessions.Load(id)
+	if !has {
+		http.Error(w, errPollClosed.Error(), http.StatusGone)
+		return
+	}
+
+	s.expire.Reset(pollSessionTimeout)
+
+	if r.Method == http.MethodDelete {
+		p.close(id, s)
+		return
+	}
+
+	offset, err := strconv.ParseInt(q.Get("offset"), 10, 64)
+	if err != nil {
+		http.Error(w, errPollInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		p.poll(w, r, id, s, offset)
+	case http.MethodPost:
+		p.receive(w, r, id, s, offset)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *pollHandler) open(w http.ResponseWriter) {
+	id, err := randomToken()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	conn, pipe := net.Pipe()
+
+	s := &pollSession{conn: pipe, down: newPollBuffer()}
+	s.expire = time.AfterFunc(pollSessionTimeout, func() { p.close(id, s) })
+
+	p.sessions.Store(id, s)
+
+	go s.down.fill(pipe)
+	go p.handle(conn)
+
+	_, _ = io.WriteString(w, id)
+}
+
+func (p *pollHandler) close(id string, s *pollSession) {
+	s.expire.Stop()
+	_ = s.conn.Close()
+	p.sessions.Delete(id)
+}
+
+func (p *pollHandler) poll(w http.ResponseWriter, r *http.Request, id string, s *pollSession, offset int64) {
+	timeout := time.NewTimer(pollTimeout)
+	defer timeout.Stop()
+
+	for {
+		data, changed, err := s.down.next(offset)
+
+		switch {
+		case errors.Is(err, errPollInvalidOffset):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, errPollClosed):
+			p.close(id, s)
+			http.Error(w, err.Error(), http.StatusGone)
+
+			return
+		case len(data) > 0:
+			_, _ = w.Write(data)
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (p *pollHandler) receive(w http.ResponseWriter, r *http.Request, id string, s *pollSession, offset int64) {
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, pollMaxChunk))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// The retries of the same request may overlap, they are skipped by the offset.
+	s.upLock.Lock()
+	defer s.upLock.Unlock()
+
+	skip := s.up - offset
+	if skip < 0 {
+		http.Error(w, errPollInvalidOffset.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if skip < int64(len(b)) {
+		n, err := s.conn.Write(b[skip:])
+		s.up += int64(n)
+
+		if err != nil {
+			p.close(id, s)
+			http.Error(w, errPollClosed.Error(), http.StatusGone)
+
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// DialHTTPPoll connects to the [Hub.HTTPPollHandler] with the HTTP long-polling,
+// the addr is the url of the handler with the [HTTPPollScheme] or [HTTPSPollScheme] prefix.
+// The returned conn works with [Servant.Serve] and [Master.Connect].
+// The failed requests are retried, the conn is closed if the hub is unreachable for a minute.
+func DialHTTPPoll(ctx context.Context, addr string) (net.Conn, error) {
+	u := strings.Replace(strings.Replace(addr, HTTPSPollScheme, "https://", 1), HTTPPollScheme, "http://", 1)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http poll request: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open http poll session: %w", err)
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	id, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http poll session id: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to open http poll session: %s %s", res.Status, id)
+	}
+
+	conn, pipe := net.Pipe()
+
+	c := &pollClient{url: u + pollQuerySep(u) + "id=" + url.QueryEscape(string(id)), pipe: pipe, up: newPollBuffer()}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	go c.up.fill(pipe)
+	go c.send()
+	go c.receive()
+
+	return conn, nil
+}
+
+func pollQuerySep(u string) string {
+	if strings.Contains(u, "?") {
+		return "&"
+	}
+
+	return "?"
+}
+
+type pollClient struct {
+	url  string
+	pipe net.Conn // The pipe end to the user.
+	up   *pollBuffer
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// send the bytes written by the user until the user closes the conn.
+func (c *pollClient) send() {
+	defer c.cancel()
+
+	var offset int64
+
+	for {
+		data, changed, err := c.up.next(offset)
+		if errors.Is(err, errPollClosed) {
+			_, _ = c.request(context.Background(), http.MethodDelete, -1, nil)
+			return
+		}
+
+		if len(data) == 0 {
+			select {
+			case <-changed:
+				continue
+			case <-c.ctx.Done():
+				return
+			}
+		}
+
+		_, err = c.retry(http.MethodPost, offset, data)
+		if err != nil {
+			_ = c.pipe.Close()
+			return
+		}
+
+		offset += int64(len(data))
+	}
+}
+
+// receive the bytes from the hub until the session is closed.
+func (c *pollClient) receive() {
+	defer func() { _ = c.pipe.Close() }()
+
+	var offset int64
+
+	for {
+		data, err := c.retry(http.MethodGet, offset, nil)
+		if err != nil {
+			return
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		_, err = c.pipe.Write(data)
+		if err != nil {
+			return
+		}
+
+		offset += int64(len(data))
+	}
+}
+
+// retry the request until it succeeds, the session is closed, or the [pollSessionTimeout] is exceeded.
+func (c *pollClient) retry(method string, offset int64, body []byte) ([]byte, error) {
+	deadline := time.Now().Add(pollSessionTimeout)
+
+	for {
+		ctx, cancel := context.WithTimeout(c.ctx, pollTimeout+pollRetryInterval*10) //nolint: mnd
+		data, err := c.request(ctx, method, offset, body)
+		cancel()
+
+		if err == nil || errors.Is(err, errPollClosed) || c.ctx.Err() != nil || time.Now().After(deadline) {
+			return data, err
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		case <-time.After(pollRetryInterval):
+		}
+	}
+}
+
+func (c *pollClient) request(ctx context.Context, method string, offset int64, body []byte) ([]byte, error) {
+	u := c.url
+	if offset >= 0 {
+		u += "&offset=" + strconv.FormatInt(offset, 10)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create http poll request: %w", err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send http poll request: %w", err)
+	}
+
+	defer func() { _ = res.Body.Close() }()
+
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read http poll response: %w", err)
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return data, nil
+	case http.StatusGone:
+		return nil, errPollClosed
+	default:
+		return nil, fmt.Errorf("http poll response error: %s %s", res.Status, data)
+	}
+}
+
+// pollBuffer buffers the bytes of one direction of a session until the peer acknowledges them,
+// so that the bytes of a failed request can be sent again.
+type pollBuffer struct {
+	lock    sync.Mutex
+	data    []byte
+	offset  int64 // The stream offset of the data[0].
+	err     error // The source has ended.
+	changed chan struct{}
+}
+
+func newPollBuffer() *pollBuffer {
+	return &pollBuffer{changed: make(chan struct{})}
+}
+
+// fill the buffer from the r until it fails, it waits when the buffer is full.
+func (b *pollBuffer) fill(r io.Reader) {
+	buf := make([]byte, 32*1024) //nolint: mnd
+
+	for {
+		n, err := r.Read(buf)
+
+		b.lock.Lock()
+
+		b.data = append(b.data, buf[:n]...)
+		if err != nil {
+			b.err = err
+		}
+
+		b.broadcast()
+
+		for b.err == nil && len(b.data) >= pollMaxChunk {
+			changed := b.changed
+			b.lock.Unlock()
+			<-changed
+			b.lock.Lock()
+		}
+
+		b.lock.Unlock()
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// next acknowledges the bytes before the offset and returns the bytes after it.
+// If there's none, the returned channel is closed when the buffer changes.
+func (b *pollBuffer) next(offset int64) ([]byte, <-chan struct{}, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	acked := offset - b.offset
+	if acked < 0 || acked > int64(len(b.data)) {
+		return nil, nil, errPollInvalidOffset
+	}
+
+	if acked > 0 {
+		b.data = b.data[acked:]
+		b.offset = offset
+		b.broadcast()
+	}
+
+	if len(b.data) > 0 {
+		return bytes.Clone(b.data[:min(len(b.data), pollMaxChunk)]), nil, nil
+	}
+
+	if b.err != nil {
+		return nil, nil, errPollClosed
+	}
+
+	return nil, b.changed, nil
+}
+
+func (b *pollBuffer) broadcast() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
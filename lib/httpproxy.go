@@ -0,0 +1,197 @@
+package dehub
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// HTTPProxyDialTimeout is the timeout to connect to the destination via the servant.
+const HTTPProxyDialTimeout = 30 * time.Second
+
+type HTTPProxyOptions struct {
+	// User and Password enable the proxy basic auth on the local listener if the User is not empty.
+	User     string
+	Password string
+}
+
+// ForwardHTTP serves a forward http proxy on the listenTo, the requests are sent from the servant side.
+// The connections to the destinations are reused across the requests.
+// It also serves a PAC file at "/proxy.pac" that routes all the traffic to the proxy.
+func (m *Master) ForwardHTTP(listenTo net.Listener) error {
+	return m.ForwardHTTPWithOptions(listenTo, HTTPProxyOptions{})
+}
+
+// ForwardHTTPWithOptions is similar to [Master.ForwardHTTP] with the opts.
+func (m *Master) ForwardHTTPWithOptions(listenTo net.Listener, opts HTTPProxyOptions) error {
+	tunnel, err := m.openTunnel(CommandForwardSocks5, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = tunnel.Close() }()
+
+	socks, _ := proxy.SOCKS5("tcp", "", nil, &tunnelDialer{tunnel})
+	dialer, _ := socks.(proxy.ContextDialer)
+
+	p := &httpProxy{master: m, opts: opts, dialer: dialer}
+
+	p.proxy = &httputil.ReverseProxy{
+		// The outgoing request is already the clone of the absolute-form request,
+		// the hop-by-hop headers are removed by the [httputil.ReverseProxy].
+		Rewrite: func(*httputil.ProxyRequest) {},
+		Transport: &http.Transport{
+			DialContext:         p.dial,
+			MaxIdleConns:        100,              //nolint: mnd
+			MaxIdleConnsPerHost: 10,               //nolint: mnd
+			IdleConnTimeout:     90 * time.Second, //nolint: mnd
+			ForceAttemptHTTP2:   true,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			p.fail(w, r, err)
+		},
+	}
+
+	return http.Serve(listenTo, p)
+}
+
+type httpProxy struct {
+	master *Master
+	opts   HTTPProxyOptions
+	dialer proxy.ContextDialer
+	proxy  *httputil.ReverseProxy
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The origin-form requests are sent to the proxy itself.
+	if r.Method != http.MethodConnect && !r.URL.IsAbs() {
+		if r.URL.Path == "/proxy.pac" {
+			// The PAC file is fetched as a normal request, so it uses the www auth instead of the proxy auth.
+			if !p.authorized(r.Header.Get("Authorization")) {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dehub"`)
+				http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+
+				return
+			}
+
+			p.pac(w, r)
+
+			return
+		}
+
+		http.Error(w, "not a proxy request", http.StatusBadRequest)
+
+		return
+	}
+
+	if !p.authorized(r.Header.Get("Proxy-Authorization")) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="dehub"`)
+		http.Error(w, http.StatusText(http.StatusProxyAuthRequired), http.StatusProxyAuthRequired)
+
+		return
+	}
+
+	p.master.Logger.Info("http proxy connection", "method", r.Method, "host", r.Host)
+
+	if r.Method == http.MethodConnect {
+		p.connect(w, r)
+		return
+	}
+
+	p.proxy.ServeHTTP(w, r)
+}
+
+func (p *httpProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, HTTPProxyDialTimeout)
+	defer cancel()
+
+	return p.dialer.DialContext(ctx, network, addr)
+}
+
+// authorized checks the basic auth header value against the [HTTPProxyOptions].
+func (p *httpProxy) authorized(header string) bool {
+	if p.opts.User == "" {
+		return true
+	}
+
+	auth, found := strings.CutPrefix(header, "Basic ")
+	if !found {
+		return false
+	}
+
+	b, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return false
+	}
+
+	expected := p.opts.User + ":" + p.opts.Password
+
+	return subtle.ConstantTimeCompare(b, []byte(expected)) == 1
+}
+
+// pac routes all the traffic to the address that the client used to reach the proxy.
+func (p *httpProxy) pac(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	_, _ = fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n  return \"PROXY %s\";\n}\n", r.Host)
+}
+
+func (p *httpProxy) connect(w http.ResponseWriter, r *http.Request) {
+	dst, err := p.dial(r.Context(), "tcp", r.Host)
+	if err != nil {
+		p.fail(w, r, err)
+		return
+	}
+
+	defer func() { _ = dst.Close() }()
+
+	src, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		p.master.Logger.Error("failed to hijack http proxy connection", "err", err)
+		return
+	}
+
+	defer func() { _ = src.Close() }()
+
+	_, err = fmt.Fprintf(src, "%s 200 Connection established\r\n\r\n", r.Proto)
+	if err != nil {
+		p.master.Logger.Error("failed to write http proxy response", "err", err)
+		return
+	}
+
+	go func() {
+		// The buf may have read the data that the client sent right after the CONNECT request.
+		_, _ = io.Copy(dst, buf)
+
+		if cw, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}()
+
+	_, _ = io.Copy(src, dst)
+}
+
+// fail responds 504 if the destination timed out, otherwise 502.
+func (p *httpProxy) fail(w http.ResponseWriter, r *http.Request, err error) {
+	p.master.Logger.Warn("http proxy failed", "method", r.Method, "host", r.Host, "err", err)
+
+	status := http.StatusBadGateway
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		status = http.StatusGatewayTimeout
+	}
+
+	http.Error(w, http.StatusText(status), status)
+}
@@ -1,50 +1,73 @@
 package dehub
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
 	"github.com/ysmood/dehub/lib/hubdb"
 	"github.com/ysmood/dehub/lib/xsync"
 	"github.com/ysmood/myip"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func NewHub() *Hub {
 	h := &Hub{
 		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
-		list:   xsync.Map[ServantID, *yamux.Session]{},
-		DB:     hubdb.NewMemory(),
-		addr:   "",
+		Tracer: defaultTracer(),
+		list:   xsync.Map[ServantID, *servantSession]{},
+
+		relayConns: map[string]quic.Connection{},
+		DB:         hubdb.NewMemory(),
+		addr:       "",
+
+		Duplicate: DuplicateReplace,
+		Keepalive: DefaultKeepalive,
 		GetIP: func() (string, error) {
 			return myip.New().GetInterfaceIP()
 		},
+		closing: make(chan struct{}),
+		kill:    make(chan struct{}),
 	}
 
 	return h
 }
 
-func connectHub(conn io.ReadWriter, typ ClientType, name ServantID) error {
+// connectHub returns the [ProtocolVersion] of the hub node.
+func connectHub(
+	ctx context.Context, tracer trace.Tracer, conn io.ReadWriter, typ ClientType, name ServantID,
+) (_ int, err error) {
+	ctx, span := tracer.Start(ctx, "connectHub", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("servant.id", name.String()), attribute.Int("client.type", int(typ))))
+	defer func() { endSpan(span, err) }()
+
 	writeMsg(conn, &HubHeader{
-		Type: typ,
-		ID:   name,
+		Type:    typ,
+		ID:      name,
+		Trace:   injectTrace(ctx),
+		Version: ProtocolVersion,
 	})
 
-	res, err := readMsg[string](conn)
+	ack, err := readAck(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read ack: %w", err)
+		return 0, fmt.Errorf("failed to read ack: %w", err)
 	}
 
-	if *res != "" {
-		return fmt.Errorf("hub response error: %s", *res)
+	if ack.Error != "" {
+		return 0, fmt.Errorf("hub response error: %s", ack.Error)
 	}
 
-	return nil
+	return ack.Version, nil
 }
 
 func (h *Hub) Handle(conn io.ReadWriteCloser) {
@@ -53,6 +76,12 @@ func (h *Hub) Handle(conn io.ReadWriteCloser) {
 		return
 	}
 
+	if h.isClosing() {
+		writeMsg(conn, ErrHubShutdown.Error())
+		_ = conn.Close()
+		return
+	}
+
 	header, err := readMsg[HubHeader](conn)
 	if err != nil {
 		h.Logger.Error("failed to read header", slog.Any("err", err))
@@ -65,7 +94,7 @@ func (h *Hub) Handle(conn io.ReadWriteCloser) {
 		err = h.handleServant(conn, header)
 
 	case ClientTypeMaster:
-		err = h.handleMaster(conn, header)
+		err = h.handleMaster(extractTrace(header.Trace), conn, header)
 	}
 
 	if err != nil {
@@ -74,38 +103,59 @@ func (h *Hub) Handle(conn io.ReadWriteCloser) {
 }
 
 func (h *Hub) handleServant(conn io.ReadWriteCloser, header *HubHeader) error {
-	tunnel, err := yamux.Client(conn, nil)
+	id, session, old, err := h.register(conn, header)
 	if err != nil {
-		return fmt.Errorf("failed to create yamux session: %w", err)
+		return err
 	}
 
-	h.list.Store(header.ID, tunnel)
+	tunnel := session.tunnel
 
-	err = h.DB.StoreLocation(header.ID.String(), h.addr)
+	if old != nil {
+		h.Logger.Warn("servant replaced by a new connection with the same id",
+			slog.String("servantId", id.String()), slog.String("token", old.token))
+
+		go old.replaced()
+	}
+
+	err = h.storeLocation(id)
 	if err != nil {
 		return fmt.Errorf("failed to store location: %w", err)
 	}
 
 	go func() {
-		for !tunnel.IsClosed() {
-			time.Sleep(hubdb.HeartbeatInterval)
-			_ = h.DB.StoreLocation(header.ID.String(), h.addr)
+		for {
+			select {
+			case <-tunnel.CloseChan():
+				return
+			case <-h.closing:
+				return
+			case <-time.After(hubdb.HeartbeatInterval):
+				_ = h.storeLocation(id)
+			}
 		}
 	}()
 
-	startTunnel(conn)
+	startTunnel(conn, header.Version)
 
-	h.Logger.Info("servant connected hub", slog.String("servantId", header.ID.String()))
+	if id != header.ID {
+		session.notify(&Notice{Type: NoticeRenamed, ID: id})
+	}
 
-	<-tunnel.CloseChan()
+	h.Logger.Info("servant connected hub", slog.String("servantId", id.String()), slog.String("token", session.token),
+		slog.Int("version", header.Version))
 
-	h.Logger.Info("servant disconnected from hub", slog.String("servantId", header.ID.String()))
+	<-tunnel.CloseChan()
 
-	h.list.Delete(header.ID)
+	h.Logger.Info("servant disconnected from hub", slog.String("servantId", id.String()),
+		slog.String("token", session.token))
 
-	err = h.DB.DeleteLocation(header.ID.String())
-	if err != nil {
-		return fmt.Errorf("failed to delete location: %w", err)
+	// Only clean up the entry of this connection, it may have been replaced by another connection.
+	// When the hub is shutting down or the servant has moved, the location belongs to another hub node.
+	if h.list.CompareAndDelete(id, session) && !h.isClosing() && !session.moved.Load() {
+		err = h.DB.DeleteLocation(id.String())
+		if err != nil {
+			return fmt.Errorf("failed to delete location: %w", err)
+		}
 	}
 
 	_ = conn.Close()
@@ -113,31 +163,71 @@ func (h *Hub) handleServant(conn io.ReadWriteCloser, header *HubHeader) error {
 	return nil
 }
 
-func (h *Hub) handleMaster(conn io.ReadWriteCloser, header *HubHeader) error {
-	addr, id, err := h.DB.LoadLocation(header.ID.String())
+// register stores the servant connection to the list according to the [Hub.Duplicate] policy.
+// It returns the id that the servant is registered as, and the old session it replaced.
+func (h *Hub) register(conn io.ReadWriteCloser, header *HubHeader) (ServantID, *servantSession, *servantSession, error) {
+	id := header.ID
+
+	token, err := randomToken()
 	if err != nil {
-		return fmt.Errorf("failed to get servant location: %w", err)
+		return "", nil, nil, err
+	}
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	old, has := h.list.Load(id)
+	if has {
+		switch h.Duplicate {
+		case DuplicateReject:
+			return "", nil, nil, fmt.Errorf("%w: %s", ErrDuplicateServant, id)
+		case DuplicateSuffix:
+			id = ServantID(id.String() + "-" + token[:8])
+			old = nil
+		case DuplicateReplace:
+		}
 	}
 
-	relay, err := net.Dial("tcp", addr)
+	tunnel, err := h.Keepalive.newMuxSession(conn, true, h.Logger)
 	if err != nil {
-		return fmt.Errorf("failed to dial relay: %w", err)
+		return "", nil, nil, fmt.Errorf("failed to create yamux session: %w", err)
+	}
+
+	session := &servantSession{token: token, tunnel: tunnel, version: header.Version}
+
+	h.list.Store(id, session)
+
+	go h.Keepalive.watch(tunnel, func() {
+		h.Logger.Warn("servant stopped responding", slog.String("servantId", id.String()), slog.String("token", token))
+	})
+
+	return id, session, old, nil
+}
+
+func (h *Hub) handleMaster(ctx context.Context, conn io.ReadWriteCloser, header *HubHeader) (err error) {
+	done, ok := h.track(conn)
+	if !ok {
+		return ErrHubShutdown
 	}
+	defer done()
 
-	writeMsg(relay, id)
+	ctx, span := h.Tracer.Start(ctx, "Hub.handleMaster", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("servant.id", header.ID.String())))
+	defer func() { endSpan(span, err) }()
 
-	res, err := readMsg[string](relay)
+	addr, id, version, err := h.loadLocation(ctx, header.ID)
 	if err != nil {
-		return fmt.Errorf("failed to read relay ack: %w", err)
+		return fmt.Errorf("failed to get servant location: %w", err)
 	}
 
-	if *res != "" {
-		return fmt.Errorf("relay response error: %s", *res)
+	relay, err := h.dialRelay(ctx, addr, id, version)
+	if err != nil {
+		return err
 	}
 
-	startTunnel(conn)
+	startTunnel(conn, header.Version)
 
-	h.Logger.Info("master connected to hub", slog.String("name", header.ID.String()))
+	h.Logger.Info("master connected to hub", slog.String("name", header.ID.String()), slog.Int("version", header.Version))
 
 	go func() {
 		_, _ = io.Copy(relay, conn)
@@ -152,6 +242,117 @@ func (h *Hub) handleMaster(conn io.ReadWriteCloser, header *HubHeader) error {
 	return nil
 }
 
+func (h *Hub) storeLocation(id ServantID) error {
+	if db, ok := h.DB.(VersionedLocator); ok {
+		return db.StoreVersionedLocation(id.String(), h.addr, ProtocolVersion)
+	}
+
+	return h.DB.StoreLocation(id.String(), h.addr)
+}
+
+// loadLocation returns the version 0 if the DB doesn't implement the [VersionedLocator].
+func (h *Hub) loadLocation(ctx context.Context, idPrefix ServantID) (string, ServantID, int, error) {
+	_, span := h.Tracer.Start(ctx, "DB.LoadLocation",
+		trace.WithAttributes(attribute.String("servant.idPrefix", idPrefix.String())))
+
+	var addr, id string
+
+	var version int
+
+	var err error
+
+	if db, ok := h.DB.(VersionedLocator); ok {
+		addr, id, version, err = db.LoadVersionedLocation(idPrefix.String())
+	} else {
+		addr, id, err = h.DB.LoadLocation(idPrefix.String())
+	}
+
+	endSpan(span, err)
+
+	return addr, ServantID(id), version, err
+}
+
+// dialRelay sends the bare id to the relays before the versioning, they can't read the [RelayHeader].
+func (h *Hub) dialRelay(ctx context.Context, addr string, id ServantID, version int) (_ net.Conn, err error) {
+	ctx, span := h.Tracer.Start(ctx, "Hub.dialRelay", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("relay.addr", addr), attribute.String("servant.id", id.String())))
+	defer func() { endSpan(span, err) }()
+
+	relay, err := h.dialRelayConn(ctx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial relay: %w", err)
+	}
+
+	if version > 0 {
+		writeMsg(relay, &RelayHeader{
+			ID:      id,
+			Trace:   injectTrace(ctx),
+			Version: ProtocolVersion,
+		})
+	} else {
+		writeMsg(relay, id)
+	}
+
+	ack, err := readAck(relay)
+	if err != nil {
+		_ = relay.Close()
+		return nil, fmt.Errorf("failed to read relay ack: %w", err)
+	}
+
+	if ack.Error != "" {
+		_ = relay.Close()
+		return nil, fmt.Errorf("relay response error: %s", ack.Error)
+	}
+
+	return relay, nil
+}
+
+// dialRelayConn opens a QUIC stream to the relay if the addr has the [QUICScheme] prefix,
+// the QUIC connection to each relay is shared by the master sessions.
+// It falls back to tcp if the QUIC handshake fails, such as when the udp is blocked between the hub nodes.
+func (h *Hub) dialRelayConn(ctx context.Context, addr string) (net.Conn, error) {
+	if !IsQUICAddr(addr) {
+		return net.Dial("tcp", addr)
+	}
+
+	addr = strings.TrimPrefix(addr, QUICScheme)
+
+	conn, err := h.relayConn(ctx, addr)
+	if err != nil {
+		h.Logger.Warn("failed to dial quic relay, fall back to tcp", slog.String("addr", addr), slog.Any("err", err))
+		return net.Dial("tcp", addr)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open quic relay stream: %w", err)
+	}
+
+	return &quicStream{Stream: stream, conn: conn}, nil
+}
+
+func (h *Hub) relayConn(ctx context.Context, addr string) (quic.Connection, error) {
+	h.relayConnsLock.Lock()
+	defer h.relayConnsLock.Unlock()
+
+	conn, has := h.relayConns[addr]
+	if has && conn.Context().Err() == nil {
+		return conn, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, QUICDialTimeout)
+	defer cancel()
+
+	conn, err := dialQUIC(ctx, addr, nil, h.Keepalive)
+	if err != nil {
+		return nil, err
+	}
+
+	h.relayConns[addr] = conn
+
+	return conn, nil
+}
+
 // MustStartRelay is similar to [Hub.StartRelay].
 func (h *Hub) MustStartRelay() func() {
 	fn, err := h.StartRelay(":0")
@@ -168,6 +369,8 @@ func (h *Hub) StartRelay(addr string) (func(), error) {
 		return nil, fmt.Errorf("failed to listen relay: %w", err)
 	}
 
+	h.relay = relay
+
 	ip, err := h.GetIP()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get ip for relay: %w", err)
@@ -175,48 +378,87 @@ func (h *Hub) StartRelay(addr string) (func(), error) {
 
 	h.addr = net.JoinHostPort(ip, strconv.Itoa(relay.Addr().(*net.TCPAddr).Port))
 
+	if h.RelayQUIC {
+		// The udp port is the same as the tcp one, so the other hub nodes can fall back to tcp.
+		h.relayQUIC, err = ListenQUIC(relay.Addr().String(), nil, h.Keepalive)
+		if err != nil {
+			_ = relay.Close()
+			return nil, fmt.Errorf("failed to listen quic relay: %w", err)
+		}
+
+		h.addr = QUICScheme + h.addr
+	}
+
 	h.Logger.Info("relay server started", slog.String("addr", h.addr))
 
+	if w, ok := h.DB.(MoveWatcher); ok {
+		err = h.watchMoves(w)
+		if err != nil {
+			_ = relay.Close()
+			return nil, err
+		}
+	}
+
 	return func() {
-		for {
-			conn, err := relay.Accept()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					return
-				}
+		if h.relayQUIC != nil {
+			go h.serveRelay(h.relayQUIC)
+		}
 
-				h.Logger.Error("failed to accept", slog.Any("err", err))
+		h.serveRelay(relay)
+	}, nil
+}
 
+func (h *Hub) serveRelay(relay net.Listener) {
+	for {
+		conn, err := relay.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return
 			}
 
-			go func() {
-				err = h.handleRelay(conn)
-				if err != nil {
-					writeMsg(conn, err.Error())
-				}
+			h.Logger.Error("failed to accept", slog.Any("err", err))
 
-				h.Logger.Info("relay disconnected")
-			}()
+			return
 		}
-	}, nil
+
+		go func() {
+			err := h.handleRelay(conn)
+			if err != nil {
+				writeMsg(conn, err.Error())
+			}
+
+			h.Logger.Info("relay disconnected")
+		}()
+	}
 }
 
-func (h *Hub) handleRelay(conn net.Conn) error {
-	id, err := readMsg[ServantID](conn)
+func (h *Hub) handleRelay(conn net.Conn) (err error) {
+	header, err := readRelayHeader(conn)
 	if err != nil {
-		return fmt.Errorf("failed to read servant name: %w", err)
+		return fmt.Errorf("failed to read relay header: %w", err)
 	}
 
-	servant, has := h.list.Load(*id)
+	id := header.ID
+
+	done, ok := h.track(conn)
+	if !ok {
+		return ErrHubShutdown
+	}
+	defer done()
+
+	ctx, span := h.Tracer.Start(extractTrace(header.Trace), "Hub.handleRelay", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("servant.id", id.String())))
+	defer func() { endSpan(span, err) }()
+
+	servant, has := h.list.Load(id)
 	if !has {
 		_ = h.DB.DeleteLocation(id.String())
 		return fmt.Errorf("servant not found: %s", id.String())
 	}
 
-	h.Logger.Info("relay connected", slog.String("name", id.String()))
+	h.Logger.Info("relay connected", slog.String("name", id.String()), slog.Int("version", header.Version))
 
-	tunnel, err := servant.Open()
+	tunnel, err := servant.tunnel.Open()
 	if err != nil {
 		if errors.Is(err, yamux.ErrSessionShutdown) {
 			return nil
@@ -225,7 +467,23 @@ func (h *Hub) handleRelay(conn net.Conn) error {
 		return fmt.Errorf("failed to open stream: %w", err)
 	}
 
-	startTunnel(conn)
+	// The servants before the versioning don't read the stream header.
+	if servant.version > 0 {
+		writeMsg(tunnel, &StreamHeader{Trace: injectTrace(ctx)})
+
+		ack, err := readAck(tunnel)
+		if err != nil {
+			_ = tunnel.Close()
+			return fmt.Errorf("failed to read servant ack: %w", err)
+		}
+
+		if ack.Error != "" {
+			_ = tunnel.Close()
+			return fmt.Errorf("servant response error: %s", ack.Error)
+		}
+	}
+
+	startTunnel(conn, header.Version)
 
 	defer func() { _ = tunnel.Close() }()
 
@@ -239,3 +497,194 @@ func (h *Hub) handleRelay(conn net.Conn) error {
 
 	return nil
 }
+
+// readRelayHeader reads the [RelayHeader], or the bare [ServantID] sent by the hub nodes before the versioning.
+func readRelayHeader(conn io.Reader) (*RelayHeader, error) {
+	raw, err := readMsg[json.RawMessage](conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var id ServantID
+	if json.Unmarshal(*raw, &id) == nil {
+		return &RelayHeader{ID: id}, nil
+	}
+
+	var header RelayHeader
+
+	err = json.Unmarshal(*raw, &header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal relay header: %w", err)
+	}
+
+	return &header, nil
+}
+
+func (h *Hub) watchMoves(w MoveWatcher) error {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	moves, err := w.WatchMoves(ctx)
+	if err != nil {
+		cancel()
+		return fmt.Errorf("failed to watch servant moves: %w", err)
+	}
+
+	go func() {
+		<-h.closing
+		cancel()
+	}()
+
+	go func() {
+		for m := range moves {
+			if m.From != h.addr || m.To == h.addr {
+				continue
+			}
+
+			session, has := h.list.Load(ServantID(m.ID))
+			if !has {
+				continue
+			}
+
+			h.Logger.Info("servant moved to another hub node, close the stale session",
+				slog.String("servantId", m.ID), slog.String("to", m.To), slog.String("token", session.token))
+
+			session.moved.Store(true)
+			_ = session.tunnel.Close()
+		}
+	}()
+
+	return nil
+}
+
+// Shutdown gracefully shuts down the hub node.
+// It stops accepting new connections, deletes the locations of its servants from the [DB],
+// tells the servants to reconnect to other hub nodes, then waits for the in-flight master sessions.
+// When the ctx is done before all sessions finish, the remaining sessions are closed forcibly,
+// and the ctx error is returned.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.lock.Lock()
+	select {
+	case <-h.closing:
+		h.lock.Unlock()
+		return nil
+	default:
+		close(h.closing)
+	}
+	h.lock.Unlock()
+
+	h.Logger.Info("hub is shutting down")
+
+	if h.relay != nil {
+		_ = h.relay.Close()
+	}
+
+	if h.relayQUIC != nil {
+		_ = h.relayQUIC.Close()
+	}
+
+	h.list.Range(func(id ServantID, servant *servantSession) bool {
+		err := h.DB.DeleteLocation(id.String())
+		if err != nil {
+			h.Logger.Error("failed to delete location", slog.String("servantId", id.String()), slog.Any("err", err))
+		}
+
+		servant.notify(&Notice{Type: NoticeReconnect})
+
+		return true
+	})
+
+	drained := make(chan struct{})
+	go func() {
+		h.sessions.Wait()
+		close(drained)
+	}()
+
+	var err error
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("failed to wait for master sessions: %w", ctx.Err())
+	}
+
+	close(h.kill)
+
+	h.list.Range(func(_ ServantID, servant *servantSession) bool {
+		_ = servant.tunnel.Close()
+		return true
+	})
+
+	h.Logger.Info("hub shutdown")
+
+	return err
+}
+
+// notify sends the notice to the servant via a new stream of the tunnel,
+// the servants before the versioning can't read the notices, they are skipped.
+func (s *servantSession) notify(notice *Notice) {
+	if s.version == 0 {
+		return
+	}
+
+	stream, err := s.tunnel.Open()
+	if err != nil {
+		return
+	}
+
+	writeMsg(stream, &StreamHeader{Notice: notice})
+
+	_ = stream.Close()
+}
+
+// replaced notifies the servant that it's replaced, then closes the tunnel.
+// The servant is given time to read the notice and close the tunnel itself,
+// so that it knows it should stop reconnecting.
+func (s *servantSession) replaced() {
+	s.notify(&Notice{Type: NoticeReplaced})
+
+	if s.version > 0 {
+		select {
+		case <-s.tunnel.CloseChan():
+		case <-time.After(noticeTimeout):
+		}
+	}
+
+	_ = s.tunnel.Close()
+}
+
+func (h *Hub) isClosing() bool {
+	select {
+	case <-h.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+// track registers an in-flight master session, it returns false if the hub is shutting down.
+// The conn will be closed if the session is still alive when the shutdown deadline is reached.
+func (h *Hub) track(conn io.Closer) (func(), bool) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.isClosing() {
+		return nil, false
+	}
+
+	h.sessions.Add(1)
+
+	finished := make(chan struct{})
+
+	go func() {
+		select {
+		case <-h.kill:
+			_ = conn.Close()
+		case <-finished:
+		}
+	}()
+
+	return func() {
+		close(finished)
+		h.sessions.Done()
+	}, true
+}
@@ -1,22 +1,48 @@
 package dehub_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/alicebob/miniredis/v2"
+	"github.com/hashicorp/yamux"
+	"github.com/redis/go-redis/v9"
 	"github.com/willscott/go-nfs-client/nfs"
 	"github.com/willscott/go-nfs-client/nfs/rpc"
+	"github.com/ysmood/byframe"
 	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/diag"
+	"github.com/ysmood/dehub/lib/dirsync"
 	"github.com/ysmood/dehub/lib/hubdb"
+	"github.com/ysmood/dehub/lib/otlpfile"
 	"github.com/ysmood/got"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/net/proxy"
 )
@@ -44,6 +70,292 @@ func TestExec(t *testing.T) {
 	g.Has(out.String(), txt)
 }
 
+func TestExecSignal(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	g.Is(master.Signal(ssh.SIGTERM), dehub.ErrNoExec)
+
+	done := make(chan struct{})
+	go func() {
+		g.E(master.Exec(bytes.NewBuffer(nil), io.Discard, "sleep", "30"))
+		close(done)
+	}()
+
+	err = master.Signal("UNKNOWN")
+	for errors.Is(err, dehub.ErrNoExec) {
+		time.Sleep(10 * time.Millisecond)
+		err = master.Signal("UNKNOWN")
+	}
+	g.Is(err, dehub.ErrSignalRejected)
+
+	g.E(master.Signal(ssh.SIGTERM))
+	<-done
+}
+
+func TestProfile(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	for _, typ := range []dehub.ProfileType{dehub.ProfileHeap, dehub.ProfileGoroutine, dehub.ProfileCPU} {
+		out := bytes.NewBuffer(nil)
+		g.E(master.Profile(out, typ, 100*time.Millisecond))
+		g.Gt(out.Len(), 0)
+	}
+
+	err = master.Profile(bytes.NewBuffer(nil), "unknown", 0)
+	g.Has(err.Error(), "unknown profile type")
+}
+
+func TestDebugger(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	// A fake headless delve server that echoes the requests.
+	dlv, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = dlv.Close() }()
+
+	go func() {
+		conn, err := dlv.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l.Close() }()
+
+	go func() { g.E(master.ForwardDebugger(l, dehub.DebugMeta{Addr: dlv.Addr().String()})) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	g.E(err)
+
+	req := `{"method":"RPCServer.State","params":[{}],"id":0}`
+	_, err = conn.Write([]byte(req))
+	g.E(err)
+
+	buf := make([]byte, len(req))
+	_, err = io.ReadFull(conn, buf)
+	g.E(err)
+	g.Eq(string(buf), req)
+
+	// The missing dlv executable should fail the connection.
+	l02, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l02.Close() }()
+
+	go func() { g.E(master.ForwardDebugger(l02, dehub.DebugMeta{Dlv: "not-exists-dlv"})) }()
+
+	conn02, err := net.Dial("tcp", l02.Addr().String())
+	g.E(err)
+
+	_, err = conn02.Read(make([]byte, 1))
+	g.Is(err, io.EOF)
+}
+
+func TestLogTap(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	appOut := &syncBuffer{}
+	tap := dehub.NewLogTap(slog.NewTextHandler(appOut, nil))
+	logger := slog.New(tap).With("app", "test")
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.LogTap = tap
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	out := &syncBuffer{}
+	go func() {
+		_ = master.TapLogs(out, dehub.LogTapMeta{
+			Level: slog.LevelDebug,
+			Match: map[string]string{"app": "test", "req.id": "1"},
+			Raise: true,
+		})
+	}()
+
+	for !strings.Contains(out.String(), `"msg":"hit"`) {
+		logger.Debug("miss", slog.Group("req", "id", 2))
+		logger.Debug("hit", slog.Group("req", "id", 1))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g.Has(out.String(), `"req":{"id":1}`)
+	g.False(strings.Contains(out.String(), `"msg":"miss"`))
+
+	// The app log level is raised during the session.
+	g.Has(appOut.String(), "level=DEBUG msg=hit")
+
+	// The app log level is restored after the master disconnects.
+	g.E(masterConn.Close())
+
+	for logger.Enabled(context.Background(), slog.LevelDebug) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// It's published once, the expvar panics if a name is published again, such as with the -count flag.
+var testCount = expvar.NewInt("dehub_test_count")
+
+func TestVars(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	testCount.Set(3)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Expose("dehub_test_state", func() any { return map[string]int{"ok": 1} })
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	out := bytes.NewBuffer(nil)
+	g.E(master.Vars(out, dehub.VarsMeta{Pattern: "dehub_test_*"}))
+	g.Eq(out.String(), `{"dehub_test_count":3,"dehub_test_state":{"ok":1}}`+"\n")
+
+	// Watch
+	r, w := io.Pipe()
+	go func() { _ = master.Vars(w, dehub.VarsMeta{Pattern: "dehub_test_count", Interval: time.Millisecond}) }()
+
+	lines := bufio.NewScanner(r)
+	for range 2 {
+		g.True(lines.Scan())
+		g.Eq(lines.Text(), `{"dehub_test_count":3}`)
+	}
+}
+
+func TestProcess(t *testing.T) {
+	g := got.T(t)
+
+	if runtime.GOOS != "linux" {
+		g.Skip("procfs is only supported on linux")
+	}
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	list, err := master.Processes()
+	g.E(err)
+	g.Gt(len(list), 0)
+
+	d, err := master.Inspect(os.Getpid())
+	g.E(err)
+	g.Eq(d.Cmdline, os.Args)
+	g.Gt(len(d.SocketList), 0)
+
+	_, err = master.Inspect(-1)
+	g.Has(err.Error(), "failed to read stat")
+}
+
+func TestDiagnose(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	rules, err := dehub.NewForwardRules(nil, []string{"169.254.169.254"})
+	g.E(err)
+
+	logs := &syncBuffer{}
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	servant.ForwardRules = rules
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l.Close() }()
+
+	res, err := master.Diagnose(diag.Request{Op: diag.OpTCP, Target: l.Addr().String()})
+	g.E(err)
+	g.Eq(res.Error, "")
+	g.Eq(res.TCP.RemoteAddr, l.Addr().String())
+
+	// The diagnosis can't reach the destinations that the forwarding can't.
+	res, err = master.Diagnose(diag.Request{Op: diag.OpTCP, Target: "169.254.169.254:80"})
+	g.E(err)
+	g.Has(res.Error, "destination is not allowed")
+
+	res, err = master.Diagnose(diag.Request{Op: diag.OpHTTP, Target: "http://169.254.169.254/latest/meta-data/"})
+	g.E(err)
+	g.Has(res.Error, "destination is not allowed")
+
+	for !strings.Contains(logs.String(), "diag connection closed") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fp := ssh.FingerprintSHA256(prvKey(g).PublicKey())
+
+	g.Has(logs.String(), `msg="diag destination denied" master-pubkey=`+fp+` dest=169.254.169.254:80`)
+	g.Has(logs.String(), `msg="diag connection closed" master-pubkey=`+fp+` dest=`+l.Addr().String())
+}
+
 func TestSocks5(t *testing.T) {
 	g := got.T(t)
 
@@ -51,31 +363,1037 @@ func TestSocks5(t *testing.T) {
 
 	servantConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
-	go servant.Serve(servantConn)()
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	proxyServer, err := net.Listen("tcp", ":0")
+	g.E(err)
+
+	go func() { g.E(master.ForwardSocks5(proxyServer)) }()
+
+	res := reqViaProxy(g, proxyServer.Addr().String(), "http://example.com")
+	g.Has(res, "Example Domain")
+}
+
+func TestSocks5Rules(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = target.Close() }()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+
+	port := strconv.Itoa(target.Addr().(*net.TCPAddr).Port)
+
+	rules, err := dehub.NewForwardRules([]string{"localhost"}, []string{"169.254.169.254"})
+	g.E(err)
+
+	logs := &syncBuffer{}
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	servant.ForwardRules = rules
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	proxyServer, err := net.Listen("tcp", ":0")
+	g.E(err)
+
+	go func() { g.E(master.ForwardSocks5(proxyServer)) }()
+
+	dialer, err := proxy.SOCKS5("tcp", proxyServer.Addr().String(), nil, proxy.Direct)
+	g.E(err)
+
+	// The proxy.SOCKS5 sends the domain name to the servant.
+	conn, err := dialer.Dial("tcp", "localhost:"+port)
+	g.E(err)
+	buf := make([]byte, 2)
+	_, err = io.ReadFull(conn, buf)
+	g.E(err)
+	g.Eq(string(buf), "ok")
+	g.E(conn.Close())
+
+	_, err = dialer.Dial("tcp", "169.254.169.254:80")
+	g.Has(err.Error(), "not allowed by ruleset")
+
+	_, err = dialer.Dial("tcp", target.Addr().String())
+	g.Has(err.Error(), "not allowed by ruleset")
+
+	for !strings.Contains(logs.String(), "socks5 connection closed") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	fp := ssh.FingerprintSHA256(prvKey(g).PublicKey())
+
+	g.Has(logs.String(), `msg="socks5 destination denied" master-pubkey=`+fp+` dest=169.254.169.254:80`)
+	g.Has(logs.String(), `msg="socks5 connection closed" master-pubkey=`+fp+` dest=localhost:`+port)
+}
+
+func TestForwardUDP(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = echo.Close() }()
+
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	rules, err := dehub.NewForwardRules(nil, []string{"127.0.0.2"})
+	g.E(err)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.ForwardRules = rules
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	logs := &syncBuffer{}
+	master.Logger = slog.New(slog.NewTextHandler(logs, nil))
+	g.E(master.Connect(masterConn))
+
+	local, err := net.ListenPacket("udp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = local.Close() }()
+
+	go func() { g.E(master.ForwardUDP(local, echo.LocalAddr().String())) }()
+
+	// Each client is a different session.
+	for range 2 {
+		client, err := net.Dial("udp", local.LocalAddr().String())
+		g.E(err)
+
+		for range 3 {
+			txt := g.RandStr(16)
+			_, err = client.Write([]byte(txt))
+			g.E(err)
+
+			buf := make([]byte, 1024)
+			n, err := client.Read(buf)
+			g.E(err)
+			g.Eq(string(buf[:n]), txt)
+		}
+
+		g.E(client.Close())
+	}
+
+	denied, err := net.ListenPacket("udp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = denied.Close() }()
+
+	go func() { g.E(master.ForwardUDP(denied, "127.0.0.2:53")) }()
+
+	client, err := net.Dial("udp", denied.LocalAddr().String())
+	g.E(err)
+	_, err = client.Write([]byte("ping"))
+	g.E(err)
+
+	for !strings.Contains(logs.String(), "failed to open udp channel") {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g.Has(logs.String(), "destination is not allowed: 127.0.0.2:53")
+}
+
+func TestHTTPProxy(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	proxyServer, err := net.Listen("tcp", ":0")
+	g.E(err)
+
+	go func() { g.E(master.ForwardHTTP(proxyServer)) }()
+
+	proxyUrl, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", proxyServer.Addr().(*net.TCPAddr).Port))
+	g.E(err)
+
+	req, err := http.NewRequestWithContext(g.Context(), "", "http://example.com", nil)
+	g.E(err)
+
+	c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	res, err := c.Do(req)
+	g.E(err)
+	defer func() { g.E(res.Body.Close()) }()
+
+	g.Has(g.Read(res.Body).String(), "Example Domain")
+}
+
+func TestHTTPProxyForward(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	conns := atomic.Int32{}
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Eq(r.Header.Get("Proxy-Authorization"), "")
+		_, _ = w.Write([]byte("ok"))
+	}))
+	target.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	target.Start()
+	defer target.Close()
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	proxyServer, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+
+	go func() {
+		g.E(master.ForwardHTTPWithOptions(proxyServer, dehub.HTTPProxyOptions{User: "u", Password: "p"}))
+	}()
+
+	proxyAddr := proxyServer.Addr().String()
+
+	get := func(c *http.Client, u string) (int, string) {
+		res, err := c.Get(u)
+		g.E(err)
+		defer func() { g.E(res.Body.Close()) }()
+
+		return res.StatusCode, g.Read(res.Body).String()
+	}
+
+	client := func(proxyURL string) *http.Client {
+		u, err := url.Parse(proxyURL)
+		g.E(err)
+
+		return &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(u)}}
+	}
+
+	code, _ := get(client("http://"+proxyAddr), target.URL)
+	g.Eq(code, http.StatusProxyAuthRequired)
+
+	// The connection to the target is reused.
+	authed := client("http://u:p@" + proxyAddr)
+	for range 3 {
+		code, body := get(authed, target.URL)
+		g.Eq(code, http.StatusOK)
+		g.Eq(body, "ok")
+	}
+	g.Eq(conns.Load(), 1)
+
+	// Dial failure
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	g.E(closed.Close())
+
+	code, _ = get(authed, "http://"+closed.Addr().String())
+	g.Eq(code, http.StatusBadGateway)
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	g.E(err)
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic dTpw\r\n\r\n",
+		closed.Addr(), closed.Addr())
+	g.E(err)
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	g.E(err)
+	g.Eq(res.StatusCode, http.StatusBadGateway)
+	g.E(conn.Close())
+
+	// PAC
+	code, _ = get(http.DefaultClient, "http://"+proxyAddr+"/proxy.pac")
+	g.Eq(code, http.StatusUnauthorized)
+
+	code, pac := get(http.DefaultClient, "http://u:p@"+proxyAddr+"/proxy.pac")
+	g.Eq(code, http.StatusOK)
+	g.Has(pac, `return "PROXY `+proxyAddr+`";`)
+}
+
+func reqViaProxy(g got.G, proxyHost string, u string) string {
+	dialer, err := proxy.SOCKS5("tcp", proxyHost, nil, proxy.Direct)
+	g.E(err)
+
+	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+
+	req, err := http.NewRequestWithContext(g.Context(), "", u, nil)
+	g.E(err)
+
+	res, err := client.Do(req)
+	g.E(err)
+	defer func() { g.E(res.Body.Close()) }()
+
+	return g.Read(res.Body).String()
+}
+
+func TestMountDir(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	fsSrv, err := net.Listen("tcp", ":0")
+	g.E(err)
+
+	go func() { g.E(master.ServeNFS("fixtures", fsSrv, 0)) }()
+
+	g.Eq(
+		g.Read("fixtures/id_ed25519.pub").String(),
+		nfsReadFile(g, fsSrv.Addr().(*net.TCPAddr), "id_ed25519.pub"),
+	)
+}
+
+func TestMountDirRestricted(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	dir := t.TempDir()
+	g.E(os.Symlink("..", filepath.Join(dir, "escape")))
+	g.E(os.WriteFile(filepath.Join(dir, "a.txt"), []byte("ok"), 0o600))
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.ShareRoots = []string{dir}
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	fsSrv, err := net.Listen("tcp", ":0")
+	g.E(err)
+
+	// The symlink that points outside the roots is rejected.
+	err = master.ServeNFSWithMeta(fsSrv, dehub.MountDirMeta{Path: filepath.Join(dir, "escape")})
+	g.Has(err.Error(), "remote directory is not in the allowed roots")
+
+	go func() { g.E(master.ServeNFSWithMeta(fsSrv, dehub.MountDirMeta{Path: dir, ReadOnly: true})) }()
+
+	c, err := rpc.DialTCP("tcp", fsSrv.Addr().String(), false)
+	g.E(err)
+	defer c.Close()
+
+	var mounter nfs.Mount
+	mounter.Client = c
+	target, err := mounter.Mount("/", rpc.AuthNull)
+	g.E(err)
+	defer func() { _ = mounter.Unmount() }()
+
+	f, err := target.Open("a.txt")
+	g.E(err)
+	g.Eq(g.Read(f).String(), "ok")
+
+	_, err = target.Create("b.txt", 0o600)
+	g.Has(err.Error(), "NFS3ERR_ROFS")
+	g.Has(target.Remove("a.txt").Error(), "NFS3ERR_ROFS")
+}
+
+func TestSyncDirSymlink(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	dir, outside := t.TempDir(), t.TempDir()
+	secret := filepath.Join(outside, "secret")
+	g.E(os.WriteFile(secret, []byte("secret"), 0o600))
+	g.E(os.Symlink(secret, filepath.Join(dir, "x")))
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.ShareRoots = []string{dir}
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	ro, err := master.OpenDir(dehub.SyncMeta{Path: dir, ReadOnly: true})
+	g.E(err)
+	defer func() { _ = ro.Close() }()
+
+	// The content of the file that the symlink points to is never read.
+	sig, err := ro.Signature("x")
+	g.E(err)
+	g.Len(sig.Blocks, 0)
+
+	_, err = ro.Delta("x", &dirsync.Signature{BlockSize: dirsync.DefaultBlockSize})
+	g.Has(err.Error(), dirsync.ErrNotRegular.Error())
+
+	// The failed call doesn't break the channel.
+	_, err = ro.Scan(dirsync.Options{})
+	g.E(err)
+}
+
+func TestSyncDir(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	remote, local := t.TempDir(), t.TempDir()
+	g.E(os.MkdirAll(filepath.Join(remote, "sub"), 0o755))
+	g.E(os.WriteFile(filepath.Join(remote, "sub", "a.txt"), []byte("a"), 0o600))
+	g.E(os.WriteFile(filepath.Join(remote, "b.log"), []byte("b"), 0o600))
+
+	big := make([]byte, 5*dirsync.MaxChunkSize+100)
+	_, _ = rand.Read(big)
+	g.E(os.WriteFile(filepath.Join(remote, "big"), big, 0o600))
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.ShareRoots = []string{remote}
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	_, err = master.OpenDir(dehub.SyncMeta{Path: local})
+	g.Has(err.Error(), "remote directory is not in the allowed roots")
+
+	dir, err := master.OpenDir(dehub.SyncMeta{Path: remote})
+	g.E(err)
+	defer func() { _ = dir.Close() }()
+
+	// Pull
+	changes, err := dirsync.Sync(dir, &dirsync.Local{Root: local}, dirsync.Options{Exclude: []string{"*.log"}})
+	g.E(err)
+	g.Len(changes, 3)
+	g.Eq(g.Read(filepath.Join(local, "sub", "a.txt")).String(), "a")
+	g.Eq(g.Read(filepath.Join(local, "big")).Bytes(), big)
+	g.False(g.PathExists(filepath.Join(local, "b.log")))
+
+	// Push
+	g.E(os.WriteFile(filepath.Join(local, "sub", "a.txt"), []byte("updated"), 0o600))
+	copy(big[len(big)/2:], "changed")
+	g.E(os.WriteFile(filepath.Join(local, "big"), big, 0o600))
+	changes, err = dirsync.Sync(&dirsync.Local{Root: local}, dir, dirsync.Options{Delete: true})
+	g.E(err)
+	g.Len(changes, 3)
+	g.Eq(changes[0].Entry.Path, "big")
+	g.Lt(changes[0].Transferred, dirsync.MaxChunkSize)
+	g.Eq(changes[2].Type, dirsync.ChangeDelete)
+	g.Eq(g.Read(filepath.Join(remote, "sub", "a.txt")).String(), "updated")
+	g.Eq(g.Read(filepath.Join(remote, "big")).Bytes(), big)
+	g.False(g.PathExists(filepath.Join(remote, "b.log")))
+
+	ro, err := master.OpenDir(dehub.SyncMeta{Path: remote, ReadOnly: true})
+	g.E(err)
+	defer func() { _ = ro.Close() }()
+
+	g.E(os.WriteFile(filepath.Join(local, "c.txt"), big, 0o600))
+	_, err = dirsync.Sync(&dirsync.Local{Root: local}, ro, dirsync.Options{})
+	g.Has(err.Error(), dirsync.ErrReadOnly.Error())
+
+	// The rejected delta is drained, the next call still works.
+	_, err = ro.Scan(dirsync.Options{})
+	g.E(err)
+}
+
+func TestMsgTooLarge(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	conn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+
+	_, err = conn.Write(byframe.EncodeHeader(1 << 30))
+	g.E(err)
+
+	g.Has(readFrame(g, conn), dehub.ErrMsgTooLarge.Error())
+}
+
+func TestServantNotFound(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.Eq(master.Connect(masterConn).Error(),
+		"failed to connect to hub: hub response error: failed to get servant location: not found via id prefix: test")
+}
+
+func TestAuthErr(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey02(g), pubKey(g))
+	g.Eq(master.Connect(masterConn).Error(),
+		"failed to create ssh client conn: ssh: handshake failed: ssh: unable to authenticate, "+
+			"attempted methods [none publickey], no supported methods remain")
+}
+
+func TestCluster(t *testing.T) {
+	g := got.T(t)
+
+	client, err := mongo.Connect(
+		context.Background(),
+		options.Client().ApplyURI("mongodb://localhost:27017"),
+	)
+	g.E(err)
+
+	g.Desc("can't connect to mongodb").E(client.Ping(g.Timeout(3*time.Second), nil))
+
+	db := hubdb.NewMongo(client.Database("test"), "test")
+
+	hub01Addr := startHub(g, db)
+	hub02Addr := startHub(g, db)
+
+	startServant := func(name dehub.ServantID, hubAddr string) net.Conn {
+		servantConn, err := net.Dial("tcp", hubAddr)
+		g.E(err)
+
+		servant := dehub.NewServant(name, prvKey(g), pubKey(g))
+
+		go servant.Serve(servantConn)()
+
+		return servantConn
+	}
+
+	servant01 := dehub.ServantID(g.RandStr(8))
+
+	servantConn01 := startServant(servant01, hub01Addr)
+	startServant(dehub.ServantID(g.RandStr(8)), hub02Addr)
+
+	time.Sleep(100 * time.Millisecond)
+
+	testMaster := func(hubAddr string) {
+		masterConn, err := net.Dial("tcp", hubAddr)
+		g.E(err)
+
+		master := dehub.NewMaster(servant01, prvKey(g), pubKey(g))
+		g.E(master.Connect(masterConn))
+
+		txt := g.RandStr(1024)
+
+		out := bytes.NewBuffer(nil)
+		err = master.Exec(bytes.NewBuffer(nil), out, "echo", txt)
+		g.E(err)
+		g.Has(out.String(), txt)
+	}
+
+	testMaster(hub01Addr)
+	testMaster(hub02Addr)
+
+	g.E(db.LoadLocation(servant01.String()))
+	g.E(servantConn01.Close())
+	time.Sleep(100 * time.Millisecond)
+	_, _, err = db.LoadLocation(servant01.String())
+	g.Eq(err.Error(), "not found via id prefix mongo: no documents in result")
+}
+
+func TestHubShutdown(t *testing.T) {
+	g := got.T(t)
+
+	db := hubdb.NewMemory()
+	hub := dehub.NewHub()
+	hub.DB = db
+	hubAddr := serveHub(g, hub)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	wait := servant.Serve(servantConn)
+	reconnect := make(chan struct{})
+	go func() { wait(); close(reconnect) }()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	ctx, cancel := context.WithTimeout(g.Context(), 100*time.Millisecond)
+	defer cancel()
+	g.Is(hub.Shutdown(ctx), context.DeadlineExceeded)
+
+	<-reconnect
+
+	_, _, err = db.LoadLocation("test")
+	g.Is(err, hubdb.ErrNotFound)
+
+	masterConn, err = net.Dial("tcp", hubAddr)
+	g.E(err)
+	g.Eq(dehub.NewMaster("test", prvKey(g), pubKey(g)).Connect(masterConn).Error(),
+		"failed to connect to hub: hub response error: hub is shutting down")
+}
+
+func TestKeepalive(t *testing.T) {
+	g := got.T(t)
+
+	keepalive := dehub.Keepalive{Interval: 50 * time.Millisecond, Timeout: time.Second}
+
+	db := hubdb.NewMemory()
+	hub := dehub.NewHub()
+	hub.DB = db
+	hub.Keepalive = keepalive
+	hubAddr := serveHub(g, hub)
+
+	conn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servantConn := newFrozenConn(conn)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Keepalive = keepalive
+	wait := servant.Serve(servantConn)
+	disconnected := make(chan struct{})
+	go func() { wait(); close(disconnected) }()
+
+	conn, err = net.Dial("tcp", hubAddr)
+	g.E(err)
+	masterConn := newFrozenConn(conn)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	master.Keepalive = keepalive
+	g.E(master.Connect(masterConn))
+
+	// The idle connections are kept alive.
+	time.Sleep(300 * time.Millisecond)
+	g.E(master.Vars(io.Discard, dehub.VarsMeta{}))
+
+	masterConn.frozen.Store(true)
+	g.Is(master.Wait(), dehub.ErrKeepaliveTimeout)
+
+	servantConn.frozen.Store(true)
+	<-disconnected
+
+	// The hub removes the dead servant without waiting for the DB TTL.
+	_, _, err = db.LoadLocation("test")
+	for !errors.Is(err, hubdb.ErrNotFound) {
+		time.Sleep(10 * time.Millisecond)
+		_, _, err = db.LoadLocation("test")
+	}
+}
+
+// frozenConn drops all the traffic once frozen, like a half-open connection.
+// The close of the peer is never seen, the reads block until the conn is closed locally,
+// so only the keepalive of the local side can detect the dead peer.
+type frozenConn struct {
+	net.Conn
+	frozen atomic.Bool
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newFrozenConn(conn net.Conn) *frozenConn {
+	return &frozenConn{Conn: conn, closed: make(chan struct{})}
+}
+
+func (c *frozenConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+func (c *frozenConn) Write(p []byte) (int, error) {
+	if c.frozen.Load() {
+		return len(p), nil
+	}
+
+	return c.Conn.Write(p)
+}
+
+func (c *frozenConn) Read(p []byte) (int, error) {
+	for {
+		n, err := c.Conn.Read(p)
+		if !c.frozen.Load() {
+			return n, err
+		}
+
+		if err != nil {
+			<-c.closed
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	g := got.T(t)
+
+	hub := dehub.NewHub()
+	hub.DB = hubdb.NewMemory()
+	hub.Duplicate = dehub.DuplicateReplace
+	hubAddr := serveHub(g, hub)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = target.Close() }()
+
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			_, _ = conn.Write([]byte("ok"))
+			_ = conn.Close()
+		}
+	}()
+
+	tap := dehub.NewLogTap(slog.NewTextHandler(io.Discard, nil))
+	logger := slog.New(tap)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.LogTap = tap
+	go servant.Serve(servantConn)()
+
+	conns := make(chan net.Conn, 10)
+	dial := func() (io.ReadWriteCloser, error) {
+		conn, err := net.Dial("tcp", hubAddr)
+		if err == nil {
+			conns <- conn
+		}
+		return conn, err
+	}
+
+	masterConn, err := dial()
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	kept := make(chan error, 1)
+	go func() { kept <- master.KeepConnected(g.Context(), dial, 10*time.Millisecond) }()
+
+	proxyServer, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	go func() { g.E(master.ForwardSocks5(proxyServer)) }()
+
+	fsSrv, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	go func() { g.E(master.ServeNFS("fixtures", fsSrv, 0)) }()
+
+	logs := &syncBuffer{}
+	tapped := make(chan error, 1)
+	go func() { tapped <- master.TapLogs(logs, dehub.LogTapMeta{}) }()
+
+	waitLog := func(msg string) {
+		for !strings.Contains(logs.String(), msg) {
+			logger.Info(msg)
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	waitLog("before reconnect")
+
+	socks, err := proxy.SOCKS5("tcp", proxyServer.Addr().String(), nil, proxy.Direct)
+	g.E(err)
+
+	viaSocks := func() error {
+		conn, err := socks.Dial("tcp", target.Addr().String())
+		if err != nil {
+			return err
+		}
+		defer func() { _ = conn.Close() }()
+
+		_, err = io.ReadFull(conn, make([]byte, 2))
+		return err
+	}
+
+	g.E(viaSocks())
+
+	rpcClient, err := rpc.DialTCP("tcp", fsSrv.Addr().String(), false)
+	g.E(err)
+	defer rpcClient.Close()
+
+	mounter := nfs.Mount{Client: rpcClient}
+	nfsTarget, err := mounter.Mount("/", rpc.AuthNull)
+	g.E(err)
+
+	_, _, err = nfsTarget.Lookup("id_ed25519.pub")
+	g.E(err)
+
+	// Drop the connection to the hub, the listeners should resume after the reconnect.
+	g.E((<-conns).Close())
+
+	for viaSocks() != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The log tap is resumed.
+	waitLog("after reconnect")
+
+	// The file handles from before the reconnect are still valid.
+	f, err := nfsTarget.Open("id_ed25519.pub")
+	g.E(err)
+	g.Eq(g.Read(f).String(), g.Read("fixtures/id_ed25519.pub").String())
+
+	// The reconnect only trusts the same servant key.
+	servantConn, err = net.Dial("tcp", hubAddr)
+	g.E(err)
+	go dehub.NewServant("test", prvKey02(g), pubKey(g)).Serve(servantConn)()
+
+	for len(conns) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	g.E((<-conns).Close())
+
+	g.Is(<-kept, dehub.ErrServantKeyChanged)
+
+	// The log tap stops with the reconnect.
+	g.E(<-tapped)
+}
+
+func TestQUIC(t *testing.T) {
+	g := got.T(t)
+
+	db := hubdb.NewMemory()
+	hub := dehub.NewHub()
+	hub.DB = db
+	hub.RelayQUIC = true
+	hubAddr := serveHub(g, hub)
+
+	quicSrv, err := dehub.ListenQUIC("127.0.0.1:0", nil, hub.Keepalive)
+	g.E(err)
+	defer func() { _ = quicSrv.Close() }()
+
+	go func() {
+		for {
+			conn, err := quicSrv.Accept()
+			if err != nil {
+				return
+			}
+
+			go hub.Handle(conn)
+		}
+	}()
+
+	quicAddr := dehub.QUICScheme + quicSrv.Addr().String()
+
+	servantConn, err := dehub.DialQUIC(g.Context(), quicAddr, nil, dehub.DefaultKeepalive)
+	g.E(err)
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
+
+	// Wait for the servant to register.
+	_, _, err = db.LoadLocation("test")
+	for err != nil {
+		time.Sleep(10 * time.Millisecond)
+		_, _, err = db.LoadLocation("test")
+	}
+
+	location, _, err := db.LoadLocation("test")
+	g.E(err)
+	g.True(dehub.IsQUICAddr(location))
+
+	// Each master session is a QUIC stream of the servant connection, the tcp masters still work.
+	for _, addr := range []string{quicAddr, hubAddr} {
+		var masterConn net.Conn
+		if dehub.IsQUICAddr(addr) {
+			masterConn, err = dehub.DialQUIC(g.Context(), addr, nil, dehub.DefaultKeepalive)
+		} else {
+			masterConn, err = net.Dial("tcp", addr)
+		}
+		g.E(err)
+
+		master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+		g.E(master.Connect(masterConn))
+
+		txt := g.RandStr(1024)
+
+		out := bytes.NewBuffer(nil)
+		g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", txt))
+		g.Has(out.String(), txt)
+
+		g.E(master.Close())
+	}
+}
+
+func TestQUICVerify(t *testing.T) {
+	g := got.T(t)
+
+	// Borrow the certificate of 127.0.0.1 from the httptest.
+	tlsSrv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsSrv.Close()
+
+	quicSrv, err := dehub.ListenQUIC("127.0.0.1:0", tlsSrv.TLS, dehub.DefaultKeepalive)
+	g.E(err)
+	defer func() { _ = quicSrv.Close() }()
+
+	go func() {
+		for {
+			conn, err := quicSrv.Accept()
+			if err != nil {
+				return
+			}
+
+			_ = conn.Close()
+		}
+	}()
+
+	quicAddr := dehub.QUICScheme + quicSrv.Addr().String()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(tlsSrv.Certificate())
+
+	conn, err := dehub.DialQUIC(g.Context(), quicAddr, &tls.Config{RootCAs: pool}, dehub.DefaultKeepalive)
+	g.E(err)
+	g.E(conn.Close())
+
+	_, err = dehub.DialQUIC(g.Context(), quicAddr, &tls.Config{RootCAs: x509.NewCertPool()}, dehub.DefaultKeepalive)
+	g.Err(err)
+}
+
+func TestHTTPPoll(t *testing.T) {
+	g := got.T(t)
+
+	hub := dehub.NewHub()
+	hub.DB = hubdb.NewMemory()
+	serveHub(g, hub)
+
+	// Drop the response of the first upload and the second download after they are handled,
+	// the client should resume the session by retrying them.
+	handler := hub.HTTPPollHandler()
+	var uploads, downloads atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("offset") != "" &&
+			(r.Method == http.MethodPost && uploads.Add(1) == 1 || r.Method == http.MethodGet && downloads.Add(1) == 2) {
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	addr := dehub.HTTPPollScheme + strings.TrimPrefix(srv.URL, "http://") + "/poll"
+	g.True(dehub.IsHTTPPollAddr(addr))
+
+	servantConn, err := dehub.DialHTTPPoll(g.Context(), addr)
+	g.E(err)
+	defer func() { _ = servantConn.Close() }()
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
+
+	masterConn, err := dehub.DialHTTPPoll(g.Context(), addr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	txt := g.RandStr(64 * 1024)
+
+	out := bytes.NewBuffer(nil)
+	g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", txt))
+	g.Has(out.String(), txt)
+
+	g.E(master.Close())
+}
+
+func TestServantInfo(t *testing.T) {
+	g := got.T(t)
+
+	hubAddr := startHub(g, nil)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
 
 	masterConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
 	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.Zero(master.ServantInfo())
 	g.E(master.Connect(masterConn))
 
-	proxyServer, err := net.Listen("tcp", ":0")
-	g.E(err)
-
-	go func() { g.E(master.ForwardSocks5(proxyServer)) }()
+	info := master.ServantInfo()
+	g.Eq(info.Version, dehub.ProtocolVersion)
+	g.True(info.Supports(dehub.CommandExec))
+	g.True(info.Supports(dehub.CommandSync))
+	g.False(info.Supports("unknown"))
 
-	res := reqViaProxy(g, proxyServer.Addr().String(), "http://example.com")
-	g.Has(res, "Example Domain")
+	// The keepalive requests are still replied.
+	g.E(master.Vars(io.Discard, dehub.VarsMeta{}))
 }
 
-func TestHTTPProxy(t *testing.T) {
+func TestCustomCommand(t *testing.T) {
 	g := got.T(t)
 
 	hubAddr := startHub(g, nil)
 
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Handle("echo", func(newChan ssh.NewChannel) {
+		ch, reqs, err := newChan.Accept()
+		if err != nil {
+			return
+		}
+
+		go ssh.DiscardRequests(reqs)
+
+		_, _ = ch.Write(newChan.ExtraData())
+		_ = ch.Close()
+	})
+
 	servantConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
 	go servant.Serve(servantConn)()
 
 	masterConn, err := net.Dial("tcp", hubAddr)
@@ -83,80 +1401,132 @@ func TestHTTPProxy(t *testing.T) {
 	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
 	g.E(master.Connect(masterConn))
 
-	proxyServer, err := net.Listen("tcp", ":0")
+	g.True(master.ServantInfo().Supports("echo"))
+
+	ch, err := master.OpenChannel("echo", []byte("ok"))
 	g.E(err)
+	g.Eq(g.Read(ch).String(), "ok")
 
-	go func() { g.E(master.ForwardHTTP(proxyServer)) }()
+	_, err = master.OpenChannel("unknown", nil)
+	g.Is(err, dehub.ErrUnsupportedCommand)
+}
 
-	proxyUrl, err := url.Parse(fmt.Sprintf("http://127.0.0.1:%d", proxyServer.Addr().(*net.TCPAddr).Port))
-	g.E(err)
+func TestLegacyServant(t *testing.T) {
+	g := got.T(t)
 
-	req, err := http.NewRequestWithContext(g.Context(), "", "http://example.com", nil)
-	g.E(err)
+	hubAddr := startHub(g, nil)
 
-	c := http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
-	res, err := c.Do(req)
+	go legacyServant(g, hubAddr)
+
+	masterConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	defer func() { g.E(res.Body.Close()) }()
+	master := dehub.NewMaster("legacy", prvKey(g), pubKey(g))
 
-	g.Has(g.Read(res.Body).String(), "Example Domain")
+	err = master.Connect(masterConn)
+	for err != nil { // Wait for the servant to connect.
+		time.Sleep(10 * time.Millisecond)
+		masterConn, err = net.Dial("tcp", hubAddr)
+		g.E(err)
+		err = master.Connect(masterConn)
+	}
+
+	g.Eq(master.ServantInfo().Version, 0)
+
+	out := bytes.NewBuffer(nil)
+	g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", "ok"))
+	g.Eq(out.String(), "legacy")
+
+	g.Is(master.Vars(io.Discard, dehub.VarsMeta{}), dehub.ErrUnsupportedCommand)
 }
 
-func reqViaProxy(g got.G, proxyHost string, u string) string {
-	dialer, err := proxy.SOCKS5("tcp", proxyHost, nil, proxy.Direct)
-	g.E(err)
+func TestLegacyHub(t *testing.T) {
+	g := got.T(t)
 
-	client := &http.Client{Transport: &http.Transport{Dial: dialer.Dial}}
+	hubAddr, _ := legacyHub(g)
 
-	req, err := http.NewRequestWithContext(g.Context(), "", u, nil)
+	servantConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
 
-	res, err := client.Do(req)
+	masterConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	defer func() { g.E(res.Body.Close()) }()
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
 
-	return g.Read(res.Body).String()
+	g.Eq(master.ServantInfo().Version, dehub.ProtocolVersion)
+
+	out := bytes.NewBuffer(nil)
+	g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", "ok"))
+	g.Has(out.String(), "ok")
 }
 
-func TestMountDir(t *testing.T) {
+func TestLegacyRelay(t *testing.T) {
 	g := got.T(t)
 
-	hubAddr := startHub(g, nil)
+	// The new hub relays to the old hub node.
+	hubAddr, relayAddr := legacyHub(g)
 
 	servantConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
-	go servant.Serve(servantConn)()
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
 
-	masterConn, err := net.Dial("tcp", hubAddr)
+	db := hubdb.NewMemory()
+	newHubAddr := startHub(g, db)
+
+	// The old hub node stores the location without the version.
+	g.E(db.StoreLocation("test", relayAddr))
+
+	masterConn, err := net.Dial("tcp", newHubAddr)
 	g.E(err)
 	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
 	g.E(master.Connect(masterConn))
 
-	fsSrv, err := net.Listen("tcp", ":0")
+	out := bytes.NewBuffer(nil)
+	g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", "ok"))
+	g.Has(out.String(), "ok")
+
+	// The old hub node relays to the new hub.
+	servantConn, err = net.Dial("tcp", newHubAddr)
 	g.E(err)
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn)()
 
-	go func() { g.E(master.ServeNFS("fixtures", fsSrv, 0)) }()
+	_, _, version, err := db.LoadVersionedLocation("test")
+	for err != nil || version == 0 {
+		time.Sleep(10 * time.Millisecond)
+		_, _, version, err = db.LoadVersionedLocation("test")
+	}
 
-	g.Eq(
-		g.Read("fixtures/id_ed25519.pub").String(),
-		nfsReadFile(g, fsSrv.Addr().(*net.TCPAddr), "id_ed25519.pub"),
-	)
-}
+	g.Eq(version, dehub.ProtocolVersion)
 
-func TestServantNotFound(t *testing.T) {
-	g := got.T(t)
+	addr, _, err := db.LoadLocation("test")
+	g.E(err)
 
-	hubAddr := startHub(g, nil)
+	conn, err := net.Dial("tcp", addr)
+	g.E(err)
 
-	masterConn, err := net.Dial("tcp", hubAddr)
+	_, err = conn.Write(byframe.Encode([]byte(`"test"`)))
 	g.E(err)
-	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
-	g.Eq(master.Connect(masterConn).Error(),
-		"failed to connect to hub: hub response error: failed to get servant location: not found via id prefix: test")
+	g.Eq(readFrame(g, conn), `""`)
+
+	session, err := yamux.Client(conn, nil)
+	g.E(err)
+
+	tunnel, err := session.Open()
+	g.E(err)
+
+	sshConn, _, _, err := ssh.NewClientConn(tunnel, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(prvKey(g))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint: gosec
+	})
+	g.E(err)
+
+	ch, _, err := sshConn.OpenChannel(string(dehub.CommandVars), []byte("{}"))
+	g.E(err)
+	g.Has(g.Read(ch).String(), "{")
 }
 
-func TestAuthErr(t *testing.T) {
+func TestLegacyMaster(t *testing.T) {
 	g := got.T(t)
 
 	hubAddr := startHub(g, nil)
@@ -164,73 +1534,339 @@ func TestAuthErr(t *testing.T) {
 	servantConn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
 	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Keepalive = dehub.Keepalive{Interval: 10 * time.Millisecond, Timeout: 50 * time.Millisecond}
 	go servant.Serve(servantConn)()
 
-	masterConn, err := net.Dial("tcp", hubAddr)
+	// The master before the versioning never reads the global requests.
+	conn, err := net.Dial("tcp", hubAddr)
 	g.E(err)
-	master := dehub.NewMaster("test", prvKey02(g), pubKey(g))
-	g.Eq(master.Connect(masterConn).Error(),
-		"failed to create ssh client conn: ssh: handshake failed: ssh: unable to authenticate, "+
-			"attempted methods [none publickey], no supported methods remain")
+
+	_, err = conn.Write(byframe.Encode([]byte(`{"Type":1,"ID":"test"}`)))
+	g.E(err)
+	g.Eq(readFrame(g, conn), `""`)
+
+	session, err := yamux.Client(conn, nil)
+	g.E(err)
+
+	tunnel, err := session.Open()
+	g.E(err)
+
+	sshConn, _, _, err := ssh.NewClientConn(tunnel, "", &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(prvKey(g))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(), //nolint: gosec
+	})
+	g.E(err)
+
+	// The servant doesn't treat the master as dead.
+	time.Sleep(200 * time.Millisecond)
+
+	ch, _, err := sshConn.OpenChannel(string(dehub.CommandVars), []byte("{}"))
+	g.E(err)
+	g.Has(g.Read(ch).String(), "{")
 }
 
-func TestCluster(t *testing.T) {
-	g := got.T(t)
+// legacyServant speaks the protocol before the versioning,
+// it never reads the global requests, and only handles the exec channels.
+func legacyServant(g got.G, hubAddr string) {
+	conn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
 
-	client, err := mongo.Connect(
-		context.Background(),
-		options.Client().ApplyURI("mongodb://localhost:27017"),
-	)
+	_, err = conn.Write(byframe.Encode([]byte(`{"Type":0,"ID":"legacy"}`)))
 	g.E(err)
+	g.Eq(readFrame(g, conn), `""`)
 
-	g.Desc("can't connect to mongodb").E(client.Ping(g.Timeout(3*time.Second), nil))
+	server, err := yamux.Server(conn, nil)
+	g.E(err)
 
-	db := hubdb.NewMongo(client.Database("test"), "test")
+	conf := &ssh.ServerConfig{NoClientAuth: true}
+	conf.AddHostKey(prvKey(g))
 
-	hub01Addr := startHub(g, db)
-	hub02Addr := startHub(g, db)
+	for {
+		stream, err := server.Accept()
+		if err != nil {
+			return
+		}
 
-	startServant := func(name dehub.ServantID, hubAddr string) net.Conn {
-		servantConn, err := net.Dial("tcp", hubAddr)
-		g.E(err)
+		go func() {
+			session, err := yamux.Server(stream, nil)
+			g.E(err)
 
-		servant := dehub.NewServant(name, prvKey(g), pubKey(g))
+			tunnel, err := session.Accept()
+			g.E(err)
 
-		go servant.Serve(servantConn)()
+			_, channels, _, err := ssh.NewServerConn(tunnel, conf)
+			g.E(err)
 
-		return servantConn
+			for newChan := range channels {
+				if newChan.ChannelType() != "exec" {
+					continue
+				}
+
+				ch, _, err := newChan.Accept()
+				g.E(err)
+				_, _ = ch.Write([]byte("legacy"))
+				_ = ch.Close()
+			}
+		}()
 	}
+}
 
-	servant01 := dehub.ServantID(g.RandStr(8))
+// legacyHub speaks the protocol before the versioning, it serves one servant and one master,
+// the master can connect to it directly or via its relay.
+func legacyHub(g got.G) (string, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	g.Cleanup(func() { _ = l.Close() })
 
-	servantConn01 := startServant(servant01, hub01Addr)
-	startServant(dehub.ServantID(g.RandStr(8)), hub02Addr)
+	relay, err := net.Listen("tcp", "127.0.0.1:0")
+	g.E(err)
+	g.Cleanup(func() { _ = relay.Close() })
 
-	time.Sleep(100 * time.Millisecond)
+	servant := make(chan *yamux.Session, 1)
 
-	testMaster := func(hubAddr string) {
-		masterConn, err := net.Dial("tcp", hubAddr)
+	go func() {
+		conn, err := relay.Accept()
+		if err != nil {
+			return
+		}
+
+		// The relay only reads the bare servant id.
+		g.Eq(readFrame(g, conn), `"test"`)
+
+		_, err = conn.Write(byframe.Encode([]byte(`""`)))
 		g.E(err)
 
-		master := dehub.NewMaster(servant01, prvKey(g), pubKey(g))
-		g.E(master.Connect(masterConn))
+		stream, err := (<-servant).Open()
+		g.E(err)
 
-		txt := g.RandStr(1024)
+		go func() { _, _ = io.Copy(stream, conn) }()
+		go func() { _, _ = io.Copy(conn, stream) }()
+	}()
 
-		out := bytes.NewBuffer(nil)
-		err = master.Exec(bytes.NewBuffer(nil), out, "echo", txt)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			var header dehub.HubHeader
+			g.E(json.Unmarshal([]byte(readFrame(g, conn)), &header))
+
+			_, err = conn.Write(byframe.Encode([]byte(`""`)))
+			g.E(err)
+
+			if header.Type == dehub.ClientTypeServant {
+				session, err := yamux.Client(conn, nil)
+				g.E(err)
+				servant <- session
+
+				continue
+			}
+
+			stream, err := (<-servant).Open()
+			g.E(err)
+
+			go func() { _, _ = io.Copy(stream, conn) }()
+			go func() { _, _ = io.Copy(conn, stream) }()
+		}
+	}()
+
+	return l.Addr().String(), relay.Addr().String()
+}
+
+func readFrame(g got.G, conn io.Reader) string {
+	header := []byte{}
+	b := make([]byte, 1)
+
+	for {
+		_, err := io.ReadFull(conn, b)
 		g.E(err)
-		g.Has(out.String(), txt)
+
+		header = append(header, b[0])
+
+		size, _, sufficient := byframe.DecodeHeader(header)
+		if sufficient {
+			frame := make([]byte, size)
+			_, err = io.ReadFull(conn, frame)
+			g.E(err)
+
+			return string(frame)
+		}
 	}
+}
 
-	testMaster(hub01Addr)
-	testMaster(hub02Addr)
+func TestDuplicateServant(t *testing.T) {
+	g := got.T(t)
 
-	g.E(db.LoadLocation(servant01.String()))
-	g.E(servantConn01.Close())
+	setup := func(g got.G, policy dehub.DuplicatePolicy) (*hubdb.Memory, func() (*syncBuffer, chan error)) {
+		db := hubdb.NewMemory()
+		hub := dehub.NewHub()
+		hub.DB = db
+		hub.Duplicate = policy
+		hubAddr := serveHub(g, hub)
+
+		return db, func() (*syncBuffer, chan error) {
+			conn, err := net.Dial("tcp", hubAddr)
+			g.E(err)
+
+			log := &syncBuffer{}
+			servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+			servant.Logger = slog.New(slog.NewTextHandler(log, nil))
+
+			done := make(chan error, 1)
+			go func() { done <- servant.Run(conn) }()
+
+			// Wait until the servant is connected or rejected.
+			for g.Context().Err() == nil && len(done) == 0 && !strings.Contains(log.String(), "servant connected to hub") {
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			return log, done
+		}
+	}
+
+	g.Run("reject", func(g got.G) {
+		_, startServant := setup(g, dehub.DuplicateReject)
+
+		startServant()
+		_, done := startServant()
+		g.Has((<-done).Error(), "servant id is already connected: test")
+	})
+
+	g.Run("replace", func(g got.G) {
+		db, startServant := setup(g, dehub.DuplicateReplace)
+
+		_, replaced := startServant()
+		startServant()
+		g.Is(<-replaced, dehub.ErrServantReplaced)
+		time.Sleep(100 * time.Millisecond)
+
+		// The cleanup of the replaced servant should not delete the location of the new one.
+		g.E(db.LoadLocation("test"))
+	})
+
+	g.Run("suffix", func(g got.G) {
+		db, startServant := setup(g, dehub.DuplicateSuffix)
+
+		startServant()
+		log, _ := startServant()
+
+		_, id, err := db.LoadLocation("test-")
+		g.E(err)
+
+		for g.Context().Err() == nil && !strings.Contains(log.String(), id) {
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		g.Has(log.String(), "registered the servant with a new id")
+	})
+}
+
+func TestTracing(t *testing.T) {
+	g := got.T(t)
+
+	recorder := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)).Tracer(dehub.TracerName)
+
+	hub := dehub.NewHub()
+	hub.Tracer = tracer
+	hubAddr := serveHub(g, hub)
+
+	servantConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	servant := dehub.NewServant("test", prvKey(g), pubKey(g))
+	servant.Tracer = tracer
+	go servant.Serve(servantConn)()
+
+	masterConn, err := net.Dial("tcp", hubAddr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	master.Tracer = tracer
+	g.E(master.Connect(masterConn))
+	g.E(master.Exec(bytes.NewBuffer(nil), bytes.NewBuffer(nil), "echo", "ok"))
+	g.E(masterConn.Close())
+
+	names := func() map[string]sdktrace.ReadOnlySpan {
+		list := map[string]sdktrace.ReadOnlySpan{}
+		for _, s := range recorder.Ended() {
+			list[s.Name()] = s
+		}
+		return list
+	}
+
+	for g.Context().Err() == nil {
+		if _, has := names()["Servant.serve"]; has {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	spans := names()
+	traceID := spans["Master.Connect"].SpanContext().TraceID()
+
+	for _, name := range []string{
+		"connectHub", "Master.sshHandshake", "Hub.handleMaster", "DB.LoadLocation",
+		"Hub.dialRelay", "Hub.handleRelay", "Servant.serve", "Servant.exec",
+	} {
+		g.Desc(name).Eq(spans[name].SpanContext().TraceID(), traceID)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	g.E(otlpfile.New(buf).ExportSpans(g.Context(), recorder.Ended()))
+	g.Has(buf.String(), `"traceId":"`+traceID.String()+`"`)
+	g.Has(buf.String(), `"name":"Hub.dialRelay"`)
+}
+
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestClusterRedis(t *testing.T) {
+	g := got.T(t)
+
+	mr := miniredis.RunT(t)
+	db := hubdb.NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "dehub:")
+
+	hub01Addr := startHub(g, db)
+	hub02Addr := startHub(g, db)
+
+	servantConn01, err := net.Dial("tcp", hub01Addr)
+	g.E(err)
+	wait := dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn01)
+	moved := make(chan struct{})
+	go func() { wait(); close(moved) }()
+
+	// The servant reconnects to another hub node, the hub01 should close the stale session.
+	servantConn02, err := net.Dial("tcp", hub02Addr)
+	g.E(err)
+	go dehub.NewServant("test", prvKey(g), pubKey(g)).Serve(servantConn02)()
+
+	<-moved
 	time.Sleep(100 * time.Millisecond)
-	_, _, err = db.LoadLocation(servant01.String())
-	g.Eq(err.Error(), "not found via id prefix mongo: no documents in result")
+
+	masterConn, err := net.Dial("tcp", hub01Addr)
+	g.E(err)
+	master := dehub.NewMaster("test", prvKey(g), pubKey(g))
+	g.E(master.Connect(masterConn))
+
+	out := bytes.NewBuffer(nil)
+	g.E(master.Exec(bytes.NewBuffer(nil), out, "echo", "ok"))
+	g.Has(out.String(), "ok")
 }
 
 func nfsReadFile(g got.G, addr *net.TCPAddr, path string) string {
@@ -271,9 +1907,6 @@ func pubKey(g got.G) func(ssh.PublicKey) bool {
 }
 
 func startHub(g got.G, db dehub.DB) string {
-	hubSrv, err := net.Listen("tcp", ":0")
-	g.E(err)
-
 	if db == nil {
 		db = hubdb.NewMemory()
 	}
@@ -281,6 +1914,13 @@ func startHub(g got.G, db dehub.DB) string {
 	hub := dehub.NewHub()
 	hub.DB = db
 
+	return serveHub(g, hub)
+}
+
+func serveHub(g got.G, hub *dehub.Hub) string {
+	hubSrv, err := net.Listen("tcp", ":0")
+	g.E(err)
+
 	go hub.MustStartRelay()()
 
 	go func() {
@@ -0,0 +1,176 @@
+package hubdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var locationsBucket = []byte("locations")
+
+// File is an embedded file based DB, it's suitable for a single hub node that needs to persist the locations.
+type File struct {
+	db   *bolt.DB
+	now  func() time.Time
+	stop chan struct{}
+}
+
+type fileLocation struct {
+	Addr      string    `json:"addr"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	// Version is dropped when a hub node before the versioning stores the location.
+	Version int `json:"version,omitempty"`
+}
+
+// NewFile opens or creates the db file at the path.
+// The locations that are not updated within [LocationExpiration] are ignored and purged periodically.
+func NewFile(path string) (*File, error) {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second}) //nolint: mnd
+	if err != nil {
+		return nil, fmt.Errorf("failed to open db file: %w", err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(locationsBucket)
+		return err
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create locations bucket: %w", err)
+	}
+
+	f := &File{db: db, now: time.Now, stop: make(chan struct{})}
+
+	go f.purge()
+
+	return f, nil
+}
+
+func (f *File) StoreLocation(id string, netAddr string) error {
+	return f.StoreVersionedLocation(id, netAddr, 0)
+}
+
+func (f *File) StoreVersionedLocation(id string, netAddr string, version int) error {
+	b, err := json.Marshal(fileLocation{Addr: netAddr, UpdatedAt: f.now(), Version: version})
+	if err != nil {
+		return fmt.Errorf("failed to marshal hub location: %w", err)
+	}
+
+	err = f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(locationsBucket).Put([]byte(id), b)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store hub location: %w", err)
+	}
+
+	return nil
+}
+
+// LoadLocation returns the latest updated location that matches the idPrefix.
+func (f *File) LoadLocation(idPrefix string) (string, string, error) {
+	addr, id, _, err := f.LoadVersionedLocation(idPrefix)
+
+	return addr, id, err
+}
+
+// LoadVersionedLocation is similar to [File.LoadLocation], it also returns the version stored with the location.
+func (f *File) LoadVersionedLocation(idPrefix string) (string, string, int, error) {
+	var locID string
+
+	var loc fileLocation
+
+	err := f.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(locationsBucket).Cursor()
+		prefix := []byte(idPrefix)
+
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var l fileLocation
+
+			err := json.Unmarshal(v, &l)
+			if err != nil {
+				return err
+			}
+
+			if f.expired(l) || l.UpdatedAt.Before(loc.UpdatedAt) {
+				continue
+			}
+
+			locID = string(k)
+			loc = l
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", "", 0, fmt.Errorf("failed to load hub location: %w", err)
+	}
+
+	if locID == "" {
+		return "", "", 0, fmt.Errorf("%w via id prefix: %s", ErrNotFound, idPrefix)
+	}
+
+	return loc.Addr, locID, loc.Version, nil
+}
+
+func (f *File) DeleteLocation(id string) error {
+	err := f.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(locationsBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete hub location: %w", err)
+	}
+
+	return nil
+}
+
+// Close stops the purging and closes the db file.
+func (f *File) Close() error {
+	close(f.stop)
+	return f.db.Close()
+}
+
+func (f *File) expired(l fileLocation) bool {
+	return f.now().Sub(l.UpdatedAt) > LocationExpiration
+}
+
+func (f *File) purge() {
+	for {
+		select {
+		case <-f.stop:
+			return
+		case <-time.After(LocationExpiration):
+		}
+
+		_ = f.db.Update(func(tx *bolt.Tx) error {
+			bucket := tx.Bucket(locationsBucket)
+			expired := [][]byte{}
+
+			err := bucket.ForEach(func(k, v []byte) error {
+				var l fileLocation
+
+				err := json.Unmarshal(v, &l)
+				if err != nil || f.expired(l) {
+					expired = append(expired, k)
+				}
+
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, k := range expired {
+				err = bucket.Delete(k)
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+}
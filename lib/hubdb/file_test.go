@@ -0,0 +1,64 @@
+package hubdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ysmood/got"
+)
+
+func TestFile(t *testing.T) {
+	g := got.T(t)
+
+	path := filepath.Join(t.TempDir(), "dehub.db")
+
+	db, err := NewFile(path)
+	g.E(err)
+
+	now := time.Now()
+	db.now = func() time.Time { return now }
+
+	g.E(db.StoreLocation("abc01", "a:1"))
+	now = now.Add(time.Second)
+	g.E(db.StoreLocation("abc02", "b:2"))
+
+	addr, id, err := db.LoadLocation("abc")
+	g.E(err)
+	g.Eq(addr, "b:2")
+	g.Eq(id, "abc02")
+
+	g.E(db.DeleteLocation("abc02"))
+
+	_, id, err = db.LoadLocation("abc")
+	g.E(err)
+	g.Eq(id, "abc01")
+
+	// The location should survive the restart.
+	g.E(db.Close())
+	db, err = NewFile(path)
+	g.E(err)
+	db.now = func() time.Time { return now }
+
+	_, id, err = db.LoadLocation("abc")
+	g.E(err)
+	g.Eq(id, "abc01")
+
+	// The location stored without the version drops the old version.
+	g.E(db.StoreVersionedLocation("abc01", "a:1", 1))
+	_, _, version, err := db.LoadVersionedLocation("abc")
+	g.E(err)
+	g.Eq(version, 1)
+
+	g.E(db.StoreLocation("abc01", "a:1"))
+	_, _, version, err = db.LoadVersionedLocation("abc")
+	g.E(err)
+	g.Eq(version, 0)
+
+	now = now.Add(LocationExpiration + time.Second)
+
+	_, _, err = db.LoadLocation("abc")
+	g.Is(err, ErrNotFound)
+
+	g.E(db.Close())
+}
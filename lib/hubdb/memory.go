@@ -8,38 +8,56 @@ import (
 )
 
 type Memory struct {
-	list xsync.Map[string, string]
+	list xsync.Map[string, memoryLocation]
+}
+
+type memoryLocation struct {
+	addr    string
+	version int
 }
 
 func NewMemory() *Memory {
 	return &Memory{
-		list: xsync.Map[string, string]{},
+		list: xsync.Map[string, memoryLocation]{},
 	}
 }
 
 func (db *Memory) StoreLocation(id string, addr string) error {
-	db.list.Store(id, addr)
+	return db.StoreVersionedLocation(id, addr, 0)
+}
+
+func (db *Memory) StoreVersionedLocation(id string, addr string, version int) error {
+	db.list.Store(id, memoryLocation{addr: addr, version: version})
 
 	return nil
 }
 
 func (db *Memory) LoadLocation(idPrefix string) (string, string, error) {
-	var addr, locID string
-	db.list.Range(func(id, value string) bool {
+	addr, id, _, err := db.LoadVersionedLocation(idPrefix)
+
+	return addr, id, err
+}
+
+func (db *Memory) LoadVersionedLocation(idPrefix string) (string, string, int, error) {
+	var loc memoryLocation
+
+	var locID string
+
+	db.list.Range(func(id string, value memoryLocation) bool {
 		if strings.HasPrefix(id, idPrefix) {
 			locID = id
-			addr = value
+			loc = value
 			return false
 		}
 
 		return true
 	})
 
-	if addr == "" {
-		return "", "", fmt.Errorf("%w via id prefix: %s", ErrNotFound, idPrefix)
+	if loc.addr == "" {
+		return "", "", 0, fmt.Errorf("%w via id prefix: %s", ErrNotFound, idPrefix)
 	}
 
-	return addr, locID, nil
+	return loc.addr, locID, loc.version, nil
 }
 
 func (db *Memory) DeleteLocation(id string) error {
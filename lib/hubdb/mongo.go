@@ -31,12 +31,22 @@ func NewMongo(db *mongo.Database, collectionName string) *Mongo {
 }
 
 func (db *Mongo) StoreLocation(id string, netAddr string) error {
+	return db.StoreVersionedLocation(id, netAddr, 0)
+}
+
+// StoreVersionedLocation stores the version with the same time as the createdAt,
+// the hub nodes before the versioning only update the createdAt, so their locations are loaded as version 0.
+func (db *Mongo) StoreVersionedLocation(id string, netAddr string, version int) error {
+	now := time.Now()
+
 	_, err := db.c.UpdateOne(context.Background(), bson.M{
 		"_id": id,
 	}, bson.M{"$set": bson.M{
 		"_id":       id,
 		"addr":      netAddr,
-		"createdAt": time.Now(),
+		"createdAt": now,
+		"version":   version,
+		"versionAt": now,
 	}}, options.Update().SetUpsert(true))
 	if err != nil {
 		return fmt.Errorf("failed to store hub location: %w", err)
@@ -46,25 +56,38 @@ func (db *Mongo) StoreLocation(id string, netAddr string) error {
 }
 
 func (db *Mongo) LoadLocation(idPrefix string) (string, string, error) {
+	addr, id, _, err := db.LoadVersionedLocation(idPrefix)
+
+	return addr, id, err
+}
+
+func (db *Mongo) LoadVersionedLocation(idPrefix string) (string, string, int, error) {
 	res := db.c.FindOne(context.Background(),
 		bson.M{"_id": bson.M{"$regex": "^" + regexp.QuoteMeta(idPrefix)}},
 		options.FindOne().SetSort(bson.M{"createdAt": -1}))
 
 	var data struct {
-		ID   string `bson:"_id"`
-		Addr string `bson:"addr"`
+		ID        string    `bson:"_id"`
+		Addr      string    `bson:"addr"`
+		CreatedAt time.Time `bson:"createdAt"`
+		Version   int       `bson:"version"`
+		VersionAt time.Time `bson:"versionAt"`
 	}
 
 	err := res.Decode(&data)
 	if err != nil {
 		if errors.Is(err, mongo.ErrNoDocuments) {
-			return "", "", fmt.Errorf("%w via id prefix %w", ErrNotFound, err)
+			return "", "", 0, fmt.Errorf("%w via id prefix %w", ErrNotFound, err)
 		}
 
-		return "", "", fmt.Errorf("failed to load hub location: %w", err)
+		return "", "", 0, fmt.Errorf("failed to load hub location: %w", err)
+	}
+
+	if !data.VersionAt.Equal(data.CreatedAt) {
+		data.Version = 0
 	}
 
-	return data.Addr, data.ID, nil
+	return data.Addr, data.ID, data.Version, nil
 }
 
 func (db *Mongo) DeleteLocation(id string) error {
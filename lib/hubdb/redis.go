@@ -0,0 +1,171 @@
+package hubdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis stores each location as a key that expires after [LocationExpiration],
+// the heartbeat of the hub node keeps refreshing the expiration.
+// The key only holds the address, it doesn't store the version of the hub node with the location,
+// so the hub nodes relay to each other with the handshake before the versioning, which doesn't carry the trace.
+type Redis struct {
+	c      redis.UniversalClient
+	prefix string
+}
+
+// NewRedis creates a Redis db, all the keys and the pub/sub channel it uses start with the keyPrefix.
+func NewRedis(c redis.UniversalClient, keyPrefix string) *Redis {
+	return &Redis{c: c, prefix: keyPrefix}
+}
+
+func (db *Redis) StoreLocation(id string, netAddr string) error {
+	ctx := context.Background()
+
+	old, err := db.c.SetArgs(ctx, db.key(id), netAddr, redis.SetArgs{
+		TTL: LocationExpiration,
+		Get: true,
+	}).Result()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to store hub location: %w", err)
+	}
+
+	if old == "" || old == netAddr {
+		return nil
+	}
+
+	b, err := json.Marshal(Move{ID: id, From: old, To: netAddr})
+	if err != nil {
+		return fmt.Errorf("failed to marshal move event: %w", err)
+	}
+
+	err = db.c.Publish(ctx, db.movesChannel(), b).Err()
+	if err != nil {
+		return fmt.Errorf("failed to publish move event: %w", err)
+	}
+
+	return nil
+}
+
+// LoadLocation scans the keys that match the idPrefix, it returns the latest stored one.
+func (db *Redis) LoadLocation(idPrefix string) (string, string, error) {
+	ctx := context.Background()
+
+	keys := []string{}
+
+	iter := db.c.Scan(ctx, 0, db.key(escapeGlob(idPrefix))+"*", 100).Iterator() //nolint: mnd
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	err := iter.Err()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to scan hub locations: %w", err)
+	}
+
+	var latest string
+
+	var ttl int64 = -1
+
+	for _, key := range keys {
+		d, err := db.c.PTTL(ctx, key).Result()
+		if err != nil {
+			return "", "", fmt.Errorf("failed to get ttl of hub location: %w", err)
+		}
+
+		// The longer the ttl, the later the location is stored.
+		if d.Milliseconds() > ttl {
+			latest = key
+			ttl = d.Milliseconds()
+		}
+	}
+
+	if latest == "" {
+		return "", "", fmt.Errorf("%w via id prefix: %s", ErrNotFound, idPrefix)
+	}
+
+	addr, err := db.c.Get(ctx, latest).Result()
+	if err != nil {
+		if errors.Is(err, redis.Nil) {
+			return "", "", fmt.Errorf("%w via id prefix: %s", ErrNotFound, idPrefix)
+		}
+
+		return "", "", fmt.Errorf("failed to load hub location: %w", err)
+	}
+
+	return addr, strings.TrimPrefix(latest, db.prefix), nil
+}
+
+func (db *Redis) DeleteLocation(id string) error {
+	err := db.c.Del(context.Background(), db.key(id)).Err()
+	if err != nil {
+		return fmt.Errorf("failed to delete hub location: %w", err)
+	}
+
+	return nil
+}
+
+// WatchMoves implements the MoveWatcher interface of the hub.
+// The returned channel is closed when the ctx is done.
+func (db *Redis) WatchMoves(ctx context.Context) (<-chan Move, error) {
+	sub := db.c.Subscribe(ctx, db.movesChannel())
+
+	// Make sure the subscription is established before returning.
+	_, err := sub.Receive(ctx)
+	if err != nil {
+		_ = sub.Close()
+		return nil, fmt.Errorf("failed to subscribe move events: %w", err)
+	}
+
+	moves := make(chan Move)
+
+	go func() {
+		defer close(moves)
+		defer func() { _ = sub.Close() }()
+
+		ch := sub.Channel()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-ch:
+				if !ok {
+					return
+				}
+
+				var m Move
+
+				if json.Unmarshal([]byte(msg.Payload), &m) != nil {
+					continue
+				}
+
+				select {
+				case moves <- m:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return moves, nil
+}
+
+func (db *Redis) key(id string) string {
+	return db.prefix + id
+}
+
+// The channel name doesn't collide with the location keys, because keys and channels are different namespaces.
+func (db *Redis) movesChannel() string {
+	return db.prefix + "moves"
+}
+
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
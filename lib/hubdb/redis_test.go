@@ -0,0 +1,54 @@
+package hubdb_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/ysmood/dehub/lib/hubdb"
+	"github.com/ysmood/got"
+)
+
+func TestRedis(t *testing.T) {
+	g := got.T(t)
+
+	mr := miniredis.RunT(t)
+	db := hubdb.NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "dehub:")
+
+	g.E(db.StoreLocation("abc01", "a:1"))
+	g.Eq(mr.TTL("dehub:abc01"), hubdb.LocationExpiration)
+
+	addr, id, err := db.LoadLocation("abc")
+	g.E(err)
+	g.Eq(addr, "a:1")
+	g.Eq(id, "abc01")
+
+	// The glob chars in the prefix should be matched literally.
+	_, _, err = db.LoadLocation("ab*")
+	g.Is(err, hubdb.ErrNotFound)
+
+	g.E(db.DeleteLocation("abc01"))
+	_, _, err = db.LoadLocation("abc")
+	g.Is(err, hubdb.ErrNotFound)
+
+	g.E(db.StoreLocation("abc02", "a:1"))
+	mr.FastForward(hubdb.LocationExpiration)
+	_, _, err = db.LoadLocation("abc")
+	g.Is(err, hubdb.ErrNotFound)
+}
+
+func TestRedisWatchMoves(t *testing.T) {
+	g := got.T(t)
+
+	mr := miniredis.RunT(t)
+	db := hubdb.NewRedis(redis.NewClient(&redis.Options{Addr: mr.Addr()}), "dehub:")
+
+	moves, err := db.WatchMoves(g.Context())
+	g.E(err)
+
+	g.E(db.StoreLocation("abc", "a:1"))
+	g.E(db.StoreLocation("abc", "a:1")) // heartbeat
+	g.E(db.StoreLocation("abc", "b:2"))
+
+	g.Eq(<-moves, hubdb.Move{ID: "abc", From: "a:1", To: "b:2"})
+}
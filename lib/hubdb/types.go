@@ -11,3 +11,10 @@ var ErrNotFound = errors.New("not found")
 const HeartbeatInterval = 30 * time.Second
 
 const LocationExpiration = 2 * HeartbeatInterval
+
+// Move is the event that a servant is stored with a location of another hub node.
+type Move struct {
+	ID   string
+	From string // The net address of the previous hub node.
+	To   string // The net address of the current hub node.
+}
@@ -0,0 +1,120 @@
+package dehub
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"golang.org/x/crypto/ssh"
+)
+
+// Keepalive detects the dead peers, so that the half-open connections through the NATs and load balancers
+// are closed instead of hanging forever.
+// It's used by the yamux sessions between the servant, hub and master,
+// and the ssh connection between the master and servant.
+type Keepalive struct {
+	// Interval between the pings, zero disables the keepalive.
+	Interval time.Duration
+
+	// Timeout to wait for the reply of each ping, the peer is considered dead once it's exceeded.
+	Timeout time.Duration
+}
+
+// DefaultKeepalive is the default [Keepalive] of the [Hub], [Servant], and [Master].
+var DefaultKeepalive = Keepalive{Interval: 15 * time.Second, Timeout: 10 * time.Second} //nolint: mnd
+
+// ErrKeepaliveTimeout is returned when the peer stopped responding to the keepalive.
+var ErrKeepaliveTimeout = errors.New("peer stopped responding to keepalive")
+
+// The same request name as OpenSSH, any reply of it means the peer is alive.
+const keepaliveRequest = "keepalive@openssh.com"
+
+func (k Keepalive) timeout() time.Duration {
+	if k.Timeout <= 0 {
+		return DefaultKeepalive.Timeout
+	}
+
+	return k.Timeout
+}
+
+// yamuxConfig of the keepalive, the yamux logs are sent to the logger.
+// The builtin keepalive of yamux is disabled, use [Keepalive.watchYamux] instead to know when the peer is dead.
+func (k Keepalive) yamuxConfig(logger *slog.Logger) *yamux.Config {
+	conf := yamux.DefaultConfig()
+	conf.LogOutput = nil
+	conf.Logger = slog.NewLogLogger(logger.Handler(), slog.LevelWarn)
+	conf.EnableKeepAlive = false
+	conf.ConnectionWriteTimeout = k.timeout()
+
+	return conf
+}
+
+// watchYamux pings the peer of the session until the session is closed.
+// If the peer doesn't reply in time, the onDead is called before the session is closed.
+func (k Keepalive) watchYamux(session *yamux.Session, onDead func()) {
+	if k.Interval <= 0 {
+		return
+	}
+
+	for {
+		select {
+		case <-session.CloseChan():
+			return
+		case <-time.After(k.Interval):
+		}
+
+		// The ping times out after the ConnectionWriteTimeout of the session.
+		_, err := session.Ping()
+		if err != nil {
+			if !errors.Is(err, yamux.ErrSessionShutdown) {
+				onDead()
+				_ = session.Close()
+			}
+
+			return
+		}
+	}
+}
+
+// watchSSH pings the peer of the conn until the conn is closed.
+// If the peer doesn't reply in time, the onDead is called before the conn is closed.
+func (k Keepalive) watchSSH(conn ssh.Conn, onDead func()) {
+	if k.Interval <= 0 {
+		return
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		_ = conn.Wait()
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-time.After(k.Interval):
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(keepaliveRequest, true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err != nil {
+				return
+			}
+		case <-closed:
+			return
+		case <-time.After(k.timeout()):
+			onDead()
+			_ = conn.Close()
+
+			return
+		}
+	}
+}
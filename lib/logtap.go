@@ -0,0 +1,282 @@
+package dehub
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// LogTap is a [slog.Handler] wrapper that the host process installs,
+// so that the masters can subscribe to the live log records via the servant.
+// Set it to [Servant.LogTap] to enable the log channel.
+//
+//	tap := dehub.NewLogTap(slog.Default().Handler())
+//	slog.SetDefault(slog.New(tap))
+//	servant.LogTap = tap
+type LogTap struct {
+	*logTapState
+	inner slog.Handler
+
+	// The WithAttrs and WithGroup calls to replay on the handlers of the subscribers.
+	withs []func(slog.Handler) slog.Handler
+}
+
+type logTapState struct {
+	lock   sync.Mutex
+	subs   map[*logTapSub]struct{}
+	raised *slog.Level // The lowest level raised by the subscribers.
+}
+
+type logTapSub struct {
+	meta LogTapMeta
+	out  chan []byte
+}
+
+// The max number of records buffered for a subscriber, the records beyond it are dropped,
+// so that a slow master will never block the host process.
+const logTapBuffer = 1024
+
+func NewLogTap(inner slog.Handler) *LogTap {
+	return &LogTap{
+		logTapState: &logTapState{subs: map[*logTapSub]struct{}{}},
+		inner:       inner,
+	}
+}
+
+func (t *LogTap) Enabled(ctx context.Context, level slog.Level) bool {
+	if t.inner.Enabled(ctx, level) {
+		return true
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for sub := range t.subs {
+		if level >= sub.meta.Level {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (t *LogTap) Handle(ctx context.Context, r slog.Record) error {
+	t.lock.Lock()
+	raised := t.raised != nil && r.Level >= *t.raised
+
+	subs := make([]*logTapSub, 0, len(t.subs))
+	for sub := range t.subs {
+		if r.Level >= sub.meta.Level {
+			subs = append(subs, sub)
+		}
+	}
+	t.lock.Unlock()
+
+	if len(subs) > 0 {
+		t.publish(ctx, r, subs)
+	}
+
+	if raised || t.inner.Enabled(ctx, r.Level) {
+		return t.inner.Handle(ctx, r)
+	}
+
+	return nil
+}
+
+func (t *LogTap) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return t.with(t.inner.WithAttrs(attrs), func(h slog.Handler) slog.Handler { return h.WithAttrs(attrs) })
+}
+
+func (t *LogTap) WithGroup(name string) slog.Handler {
+	return t.with(t.inner.WithGroup(name), func(h slog.Handler) slog.Handler { return h.WithGroup(name) })
+}
+
+func (t *LogTap) with(inner slog.Handler, fn func(slog.Handler) slog.Handler) *LogTap {
+	withs := append(t.withs[:len(t.withs):len(t.withs)], fn)
+	return &LogTap{logTapState: t.logTapState, inner: inner, withs: withs}
+}
+
+func (t *LogTap) publish(ctx context.Context, r slog.Record, subs []*logTapSub) {
+	buf := bytes.NewBuffer(nil)
+
+	var h slog.Handler = slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug - 1000}) //nolint: mnd
+	for _, fn := range t.withs {
+		h = fn(h)
+	}
+
+	if h.Handle(ctx, r.Clone()) != nil {
+		return
+	}
+
+	line := buf.Bytes()
+
+	var fields map[string]any
+
+	if json.Unmarshal(line, &fields) != nil {
+		return
+	}
+
+	flat := map[string]string{}
+	flattenAttrs(flat, "", fields)
+
+	for _, sub := range subs {
+		if !matchAttrs(flat, sub.meta.Match) {
+			continue
+		}
+
+		select {
+		case sub.out <- line:
+		default:
+		}
+	}
+}
+
+func (t *LogTap) subscribe(meta LogTapMeta) *logTapSub {
+	sub := &logTapSub{meta: meta, out: make(chan []byte, logTapBuffer)}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.subs[sub] = struct{}{}
+	t.updateRaised()
+
+	return sub
+}
+
+func (t *LogTap) unsubscribe(sub *logTapSub) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.subs, sub)
+	t.updateRaised()
+}
+
+func (t *logTapState) updateRaised() {
+	t.raised = nil
+
+	for sub := range t.subs {
+		if sub.meta.Raise && (t.raised == nil || sub.meta.Level < *t.raised) {
+			level := sub.meta.Level
+			t.raised = &level
+		}
+	}
+}
+
+// The nested groups are joined with dot, such as "req.id".
+func flattenAttrs(flat map[string]string, prefix string, fields map[string]any) {
+	for k, v := range fields {
+		if m, ok := v.(map[string]any); ok {
+			flattenAttrs(flat, prefix+k+".", m)
+			continue
+		}
+
+		flat[prefix+k] = fmt.Sprint(v)
+	}
+}
+
+func matchAttrs(flat map[string]string, match map[string]string) bool {
+	for k, v := range match {
+		if flat[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TapLogs streams the log records of the servant host process to the out as JSON lines,
+// until the connection is closed. If the [Master.KeepConnected] is running, the tap is resumed
+// once the master reconnected.
+func (m *Master) TapLogs(out io.Writer, meta LogTapMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal LogTapMeta: %w", err)
+	}
+
+	for {
+		c := m.conn()
+
+		err := m.tapLogs(out, b)
+		if err != nil || !m.reconnecting.Load() {
+			return err
+		}
+
+		// The servant only closes the tap when the connection is lost, wait for the reconnect.
+		<-c.next
+
+		if m.closed.Load() || m.conn() == c {
+			return nil
+		}
+	}
+}
+
+func (m *Master) tapLogs(out io.Writer, meta []byte) error {
+	ch, err := m.OpenChannel(CommandLogTap, meta)
+	if err != nil {
+		return fmt.Errorf("failed to open log tap channel: %w", err)
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	_, err = io.Copy(out, ch)
+	if err != nil {
+		return fmt.Errorf("failed to read logs: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Servant) logTap(newChan ssh.NewChannel) {
+	var meta LogTapMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	if s.LogTap == nil {
+		_ = newChan.Reject(NoLogTap, "the log tap is not installed by the servant host process")
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept log tap channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	sub := s.LogTap.subscribe(meta)
+	defer s.LogTap.unsubscribe(sub)
+
+	// The master never writes to the channel, the read returns when the master disconnects.
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, ch)
+		close(closed)
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case line := <-sub.out:
+			_, err := ch.Write(line)
+			if err != nil {
+				if !errors.Is(err, io.EOF) {
+					s.Logger.Error("failed to write log record", "err", err)
+				}
+
+				return
+			}
+		}
+	}
+}
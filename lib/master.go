@@ -1,21 +1,22 @@
 package dehub
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"net/http"
-	"net/http/httputil"
 	"os"
 
 	"github.com/creack/pty"
 	"github.com/hashicorp/yamux"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/net/proxy"
 	"golang.org/x/term"
 )
 
@@ -35,11 +36,31 @@ func NewMaster(id ServantID, prvKey ssh.Signer, check func(ssh.PublicKey) bool)
 		authMethods = append(authMethods, ssh.PublicKeys(prvKey))
 	}
 
-	sshConf := &ssh.ClientConfig{
-		User: "user",
-		Auth: authMethods,
+	m := &Master{
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Tracer:    defaultTracer(),
+		Keepalive: DefaultKeepalive,
+		servantID: id,
+	}
+
+	m.sshConf = &ssh.ClientConfig{
+		ClientVersion: sshVersion(),
+		User:          "user",
+		Auth:          authMethods,
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			// The reconnects only trust the same key, so the check won't be asked again.
+			if pinned := m.servantKey.Load(); pinned != nil {
+				if bytes.Equal(*pinned, key.Marshal()) {
+					return nil
+				}
+
+				return fmt.Errorf("%w: %s", ErrServantKeyChanged, ssh.FingerprintSHA256(key))
+			}
+
 			if check(key) {
+				b := key.Marshal()
+				m.servantKey.Store(&b)
+
 				return nil
 			}
 
@@ -47,23 +68,23 @@ func NewMaster(id ServantID, prvKey ssh.Signer, check func(ssh.PublicKey) bool)
 		},
 	}
 
-	return &Master{
-		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
-		servantID: id,
-		sshConf:   sshConf,
-	}
+	return m
 }
 
 // Connect to hub server.
-func (m *Master) Connect(conn io.ReadWriteCloser) error {
-	err := connectHub(conn, ClientTypeMaster, m.servantID)
+func (m *Master) Connect(conn io.ReadWriteCloser) (err error) {
+	ctx, span := m.Tracer.Start(context.Background(), "Master.Connect", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("servant.id", m.servantID.String())))
+	defer func() { endSpan(span, err) }()
+
+	_, err = connectHub(ctx, m.Tracer, conn, ClientTypeMaster, m.servantID)
 	if err != nil {
 		return fmt.Errorf("failed to connect to hub: %w", err)
 	}
 
 	// This extra tunnel wrapping is for better control of the connection.
 	// Such as timeout.
-	session, err := yamux.Client(conn, nil)
+	session, err := yamux.Client(conn, m.yamuxConfig())
 	if err != nil {
 		return fmt.Errorf("failed to create master yamux session: %w", err)
 	}
@@ -73,20 +94,77 @@ func (m *Master) Connect(conn io.ReadWriteCloser) error {
 		return fmt.Errorf("failed to open master yamux tunnel: %w", err)
 	}
 
-	sshConn, _, _, err := ssh.NewClientConn(tunnel, "", m.sshConf)
+	c := &masterConn{next: make(chan struct{})}
+
+	onDead := func() {
+		if !c.dead.Swap(true) {
+			m.Logger.Warn("servant stopped responding", slog.String("servantId", m.servantID.String()))
+		}
+	}
+
+	go m.Keepalive.watchYamux(session, onDead)
+
+	_, handshake := m.Tracer.Start(ctx, "Master.sshHandshake")
+
+	sshConn, _, reqs, err := ssh.NewClientConn(tunnel, "", m.sshConf)
+	endSpan(handshake, err)
+
 	if err != nil {
 		return fmt.Errorf("failed to create ssh client conn: %w", err)
 	}
 
-	m.sshConn = sshConn
+	go ssh.DiscardRequests(reqs)
+
+	c.Conn = sshConn
+
+	c.info, err = m.requestInfo(sshConn)
+	if err != nil {
+		_ = sshConn.Close()
+		return err
+	}
+
+	// The servants before the versioning never reply the keepalive requests.
+	if c.info.Version > 0 {
+		go m.Keepalive.watchSSH(sshConn, onDead)
+	}
+
+	if old := m.sshConn.Swap(c); old != nil {
+		old.end()
+	}
 
 	return nil
 }
 
+// Wait until the current connection to the servant is closed.
+// It returns [ErrKeepaliveTimeout] if the servant stopped responding.
+func (m *Master) Wait() error {
+	c := m.conn()
+	err := c.Wait()
+
+	if c.dead.Load() {
+		return ErrKeepaliveTimeout
+	}
+
+	return fmt.Errorf("connection to servant closed: %w", err)
+}
+
+func (m *Master) conn() *masterConn {
+	return m.sshConn.Load()
+}
+
+func (c *masterConn) end() {
+	c.nextOnce.Do(func() { close(c.next) })
+}
+
+func (m *Master) yamuxConfig() *yamux.Config {
+	return m.Keepalive.yamuxConfig(m.Logger)
+}
+
 func (m *Master) Exec(in io.Reader, out io.Writer, cmd string, args ...string) error {
 	size := &pty.Winsize{Rows: 24, Cols: 80} //nolint: mnd
 
-	if stdin, ok := in.(*os.File); ok && term.IsTerminal(int(stdin.Fd())) {
+	// The in can be a wrapper of the [os.Stdin] that exposes the file descriptor.
+	if stdin, ok := in.(interface{ Fd() uintptr }); ok && term.IsTerminal(int(stdin.Fd())) {
 		var err error
 		size, err = pty.GetsizeFull(os.Stdin)
 		if err != nil {
@@ -110,13 +188,16 @@ func (m *Master) Exec(in io.Reader, out io.Writer, cmd string, args ...string) e
 		return fmt.Errorf("failed to marshal ExecMeta: %w", err)
 	}
 
-	ch, _, err := m.sshConn.OpenChannel(CommandExec.String(), meta)
+	ch, err := m.OpenChannel(CommandExec, meta)
 	if err != nil {
 		return fmt.Errorf("failed to open exec channel: %w", err)
 	}
 
 	defer func() { _ = ch.Close() }()
 
+	m.execs.Store(ch, struct{}{})
+	defer m.execs.Delete(ch)
+
 	defer m.sendWindowSizeChangeEvent(ch)()
 
 	go func() { _, _ = io.Copy(ch, in) }()
@@ -126,19 +207,58 @@ func (m *Master) Exec(in io.Reader, out io.Writer, cmd string, args ...string) e
 	return nil
 }
 
-func (m *Master) ForwardSocks5(listenTo net.Listener) error {
-	ch, _, err := m.sshConn.OpenChannel(CommandForwardSocks5.String(), nil)
+// Signal sends the sig to the processes of all the running [Master.Exec].
+// Use [ssh.SIGKILL] to kill a process that doesn't respond.
+func (m *Master) Signal(sig ssh.Signal) error {
+	b, err := json.Marshal(sig)
 	if err != nil {
-		return fmt.Errorf("failed to open socks5 channel: %w", err)
+		return fmt.Errorf("failed to marshal signal: %w", err)
 	}
 
-	defer func() { _ = ch.Close() }()
+	sent := false
+
+	var errs []error
+
+	m.execs.Range(func(ch ssh.Channel, _ struct{}) bool {
+		sent = true
 
-	tunnel, err := yamux.Client(ch, nil)
+		ok, err := ch.SendRequest(ExecSignalRequest, true, b)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to send signal request: %w", err))
+		} else if !ok {
+			errs = append(errs, fmt.Errorf("%w: %s", ErrSignalRejected, sig))
+		}
+
+		return true
+	})
+
+	if !sent {
+		return ErrNoExec
+	}
+
+	return errors.Join(errs...)
+}
+
+// Close the connection to the servant, the running [Master.Exec] and forwarding will end.
+func (m *Master) Close() error {
+	m.closed.Store(true)
+
+	err := m.conn().Close()
 	if err != nil {
-		return fmt.Errorf("failed to create socks5 yamux tunnel: %w", err)
+		return fmt.Errorf("failed to close master connection: %w", err)
 	}
 
+	return nil
+}
+
+func (m *Master) ForwardSocks5(listenTo net.Listener) error {
+	tunnel, err := m.openTunnel(CommandForwardSocks5, nil)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = tunnel.Close() }()
+
 	for {
 		src, err := listenTo.Accept()
 		if err != nil {
@@ -154,11 +274,9 @@ func (m *Master) ForwardSocks5(listenTo net.Listener) error {
 		go func() {
 			stream, err := tunnel.Open()
 			if err != nil {
-				if errors.Is(err, yamux.ErrSessionShutdown) {
-					return
-				}
-
 				m.Logger.Error("failed to open yamux tunnel", "err", err.Error())
+				_ = src.Close()
+
 				return
 			}
 
@@ -179,135 +297,85 @@ func (m *Master) ForwardSocks5(listenTo net.Listener) error {
 	}
 }
 
-func (m *Master) ForwardHTTP(listenTo net.Listener) error {
-	ch, _, err := m.sshConn.OpenChannel(CommandForwardSocks5.String(), nil)
-	if err != nil {
-		return fmt.Errorf("failed to open http proxy channel: %w", err)
-	}
-
-	defer func() { _ = ch.Close() }()
-
-	tunnel, err := yamux.Client(ch, nil)
-	if err != nil {
-		return fmt.Errorf("failed to create http proxy yamux tunnel: %w", err)
-	}
-
-	dialer, _ := proxy.SOCKS5("tcp", "", nil, &tunnelDialer{tunnel})
-
-	return http.Serve(listenTo, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		m.Logger.Info("http proxy connection")
-
-		if r.Method == http.MethodConnect {
-			m.forwardHTTPConnect(dialer, w, r)
-			return
-		}
-
-		proxy := httputil.NewSingleHostReverseProxy(r.URL)
-		proxy.Transport = &http.Transport{Dial: dialer.Dial}
-		proxy.ServeHTTP(w, r)
-	}))
-}
-
-func (m *Master) forwardHTTPConnect(dialer proxy.Dialer, w http.ResponseWriter, r *http.Request) {
-	src, _, err := w.(http.Hijacker).Hijack()
-	if err != nil {
-		m.Logger.Error("failed to hijack http proxy connection", "err", err)
-		return
-	}
-
-	_, err = fmt.Fprintf(src, "%s 200 OK\r\n\r\n", r.Proto)
-	if err != nil {
-		m.Logger.Error("failed to write http proxy response", "err", err)
-		return
-	}
-
-	dst, err := dialer.Dial("tcp", r.URL.Host)
-	if err != nil {
-		m.Logger.Error("failed to dial http proxy", "err", err)
-		return
-	}
-
-	go func() {
-		_, err = io.Copy(dst, src)
-		if err != nil {
-			m.Logger.Error("failed to copy http proxy connection", "err", err)
-		}
-		_ = dst.Close()
-	}()
-
-	_, err = io.Copy(src, dst)
-	if err != nil {
-		m.Logger.Error("failed to copy http proxy connection", "err", err)
-	}
-	_ = src.Close()
+// ServeNFS serves the remoteDir of the servant side as a nfs server on the fsSrv.
+// It returns once the tunnel to the servant is closed, unless the [Master.KeepConnected] is running,
+// then it keeps serving until the fsSrv is closed.
+func (m *Master) ServeNFS(remoteDir string, fsSrv net.Listener, cacheLimit int) error {
+	return m.ServeNFSWithMeta(fsSrv, MountDirMeta{Path: remoteDir, CacheLimit: cacheLimit})
 }
 
-func (m *Master) ServeNFS(remoteDir string, fsSrv net.Listener, cacheLimit int) error {
-	if cacheLimit <= 0 {
-		cacheLimit = 2048
+// ServeNFSWithMeta is similar to [Master.ServeNFS], the meta.Path is the remote directory to serve.
+func (m *Master) ServeNFSWithMeta(fsSrv net.Listener, meta MountDirMeta) error {
+	if meta.CacheLimit <= 0 {
+		meta.CacheLimit = DefaultNFSCacheLimit
 	}
 
-	meta, err := json.Marshal(MountDirMeta{
-		Path:       remoteDir,
-		CacheLimit: cacheLimit,
-	})
+	b, err := json.Marshal(meta)
 	if err != nil {
 		return fmt.Errorf("failed to marshal MountDirMeta: %w", err)
 	}
 
-	ch, _, err := m.sshConn.OpenChannel(CommandShareDir.String(), meta)
+	tunnel, err := m.openTunnel(CommandShareDir, b)
 	if err != nil {
-		return fmt.Errorf("failed to open ShareDir channel: %w", err)
+		return err
 	}
 
-	defer func() { _ = ch.Close() }()
+	defer func() { _ = tunnel.Close() }()
 
-	tunnel, err := yamux.Client(ch, nil)
+	session, err := tunnel.get()
 	if err != nil {
-		return fmt.Errorf("failed to create nfs yamux session: %w", err)
+		return err
 	}
 
-	m.serveNFS(tunnel, fsSrv)
+	done := make(chan struct{})
+	go func() {
+		m.serveNFS(tunnel, fsSrv)
+		close(done)
+	}()
 
-	<-tunnel.CloseChan()
+	select {
+	case <-done:
+	case <-session.CloseChan():
+		if m.reconnecting.Load() {
+			<-done
+		}
+	}
 
 	return nil
 }
 
-func (m *Master) serveNFS(tunnel *yamux.Session, fServer net.Listener) {
-	go func() {
-		for {
-			fConn, err := fServer.Accept()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					return
-				}
-
-				m.Logger.Error("failed to accept nfs connection", slog.Any("err", err))
+// serveNFS serves until the fServer is closed.
+// The servant reuses the same nfs handler for the reconnected tunnels, so the file handles are still valid.
+func (m *Master) serveNFS(tunnel *channelTunnel, fServer net.Listener) {
+	for {
+		fConn, err := fServer.Accept()
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				return
 			}
 
-			nfs, err := tunnel.Open()
-			if err != nil {
-				if errors.Is(err, yamux.ErrSessionShutdown) {
-					return
-				}
+			m.Logger.Error("failed to accept nfs connection", slog.Any("err", err))
+			return
+		}
 
-				m.Logger.Error("failed to open nfs yamux stream", slog.Any("err", err))
-				return
-			}
+		nfs, err := tunnel.Open()
+		if err != nil {
+			m.Logger.Error("failed to open nfs yamux stream", slog.Any("err", err))
+			_ = fConn.Close()
 
-			go func() {
-				go func() {
-					_, _ = io.Copy(nfs, fConn)
-					_ = nfs.Close()
-				}()
+			continue
+		}
 
-				_, _ = io.Copy(fConn, nfs)
-				_ = fConn.Close()
+		go func() {
+			go func() {
+				_, _ = io.Copy(nfs, fConn)
+				_ = nfs.Close()
 			}()
-		}
-	}()
+
+			_, _ = io.Copy(fConn, nfs)
+			_ = fConn.Close()
+		}()
+	}
 }
 
 type tunnelDialer struct {
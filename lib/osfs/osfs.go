@@ -2,8 +2,10 @@ package osfs
 
 import (
 	"os"
+	"path/filepath"
 	"time"
 
+	securejoin "github.com/cyphar/filepath-securejoin"
 	"github.com/go-git/go-billy/v5"
 )
 
@@ -13,26 +15,66 @@ func New(fs billy.Filesystem) billy.Filesystem {
 }
 
 // COS or OSFS + Change wraps a billy.FS to not fail the `Change` interface.
+// The paths are resolved as if the root of the fs is the "/",
+// so that a symlink inside the fs can't make the change escape the root.
 type COS struct {
 	billy.Filesystem
 }
 
 // Chmod changes mode.
 func (fs COS) Chmod(name string, mode os.FileMode) error {
-	return os.Chmod(fs.Join(fs.Root(), name), mode)
+	p, err := fs.abs(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(p, mode)
 }
 
 // Lchown changes ownership.
 func (fs COS) Lchown(name string, uid, gid int) error {
-	return os.Lchown(fs.Join(fs.Root(), name), uid, gid)
+	p, err := fs.absNoFollow(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Lchown(p, uid, gid)
 }
 
 // Chown changes ownership.
 func (fs COS) Chown(name string, uid, gid int) error {
-	return os.Chown(fs.Join(fs.Root(), name), uid, gid)
+	p, err := fs.abs(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chown(p, uid, gid)
 }
 
 // Chtimes changes access time.
 func (fs COS) Chtimes(name string, atime time.Time, mtime time.Time) error {
-	return os.Chtimes(fs.Join(fs.Root(), name), atime, mtime)
+	p, err := fs.abs(name)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(p, atime, mtime)
+}
+
+// abs returns the real path of the name, all the symlinks in it are resolved within the root.
+func (fs COS) abs(name string) (string, error) {
+	return securejoin.SecureJoin(fs.Root(), name)
+}
+
+// absNoFollow is like abs, but it doesn't follow the last element of the name,
+// it's for the operations that work on the symlink itself or create a new file.
+func (fs COS) absNoFollow(name string) (string, error) {
+	name = filepath.Clean(string(filepath.Separator) + name)
+
+	dir, err := fs.abs(filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, filepath.Base(name)), nil
 }
@@ -0,0 +1,65 @@
+package osfs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	osfsx "github.com/ysmood/dehub/lib/osfs"
+	"github.com/ysmood/got"
+)
+
+func TestSymlinkEscape(t *testing.T) {
+	g := got.T(t)
+
+	dir := t.TempDir()
+	root := filepath.Join(dir, "root")
+	outside := filepath.Join(dir, "outside")
+
+	g.E(os.Mkdir(root, 0o755))
+	g.E(os.WriteFile(outside, nil, 0o600))
+	g.E(os.WriteFile(filepath.Join(root, "inside"), nil, 0o600))
+	g.E(os.Symlink(outside, filepath.Join(root, "escape")))
+
+	fs := osfsx.New(osfs.New(root, osfs.WithBoundOS())).(osfsx.COS)
+
+	g.E(fs.Chmod("inside", 0o640))
+	// The symlink is resolved within the root.
+	g.Is(fs.Chmod("escape", 0o644), os.ErrNotExist)
+	g.Is(fs.Chmod("../outside", 0o644), os.ErrNotExist)
+
+	info, err := os.Stat(outside)
+	g.E(err)
+	g.Eq(info.Mode().Perm(), os.FileMode(0o600))
+}
+
+func TestReadOnly(t *testing.T) {
+	g := got.T(t)
+
+	root := t.TempDir()
+	g.E(os.WriteFile(filepath.Join(root, "a"), []byte("ok"), 0o600))
+
+	fs := osfsx.ReadOnly(osfsx.New(osfs.New(root, osfs.WithBoundOS())))
+
+	f, err := fs.Open("a")
+	g.E(err)
+	g.Eq(g.Read(f).String(), "ok")
+	g.E(f.Close())
+
+	_, err = fs.OpenFile("a", os.O_RDWR, 0)
+	g.Is(err, os.ErrPermission)
+
+	_, err = fs.Create("b")
+	g.Is(err, os.ErrPermission)
+
+	g.Is(fs.Remove("a"), os.ErrPermission)
+
+	sub, err := fs.Chroot(".")
+	g.E(err)
+	_, err = sub.Create("b")
+	g.Is(err, os.ErrPermission)
+
+	_, isChange := fs.(interface{ Chmod(string, os.FileMode) error })
+	g.False(isChange)
+}
@@ -7,22 +7,47 @@ import (
 )
 
 func (fs COS) Mknod(path string, mode uint32, major uint32, minor uint32) error {
+	p, err := fs.absNoFollow(path)
+	if err != nil {
+		return err
+	}
+
 	dev := unix.Mkdev(major, minor)
-	return unix.Mknod(fs.Join(fs.Root(), path), mode, int(dev))
+	return unix.Mknod(p, mode, int(dev))
 }
 
 func (fs COS) Mkfifo(path string, mode uint32) error {
-	return unix.Mkfifo(fs.Join(fs.Root(), path), mode)
+	p, err := fs.absNoFollow(path)
+	if err != nil {
+		return err
+	}
+
+	return unix.Mkfifo(p, mode)
 }
 
 func (fs COS) Link(path string, link string) error {
-	return unix.Link(fs.Join(fs.Root(), path), link)
+	target, err := fs.abs(path)
+	if err != nil {
+		return err
+	}
+
+	p, err := fs.absNoFollow(link)
+	if err != nil {
+		return err
+	}
+
+	return unix.Link(target, p)
 }
 
 func (fs COS) Socket(path string) error {
+	p, err := fs.absNoFollow(path)
+	if err != nil {
+		return err
+	}
+
 	fd, err := unix.Socket(unix.AF_UNIX, unix.SOCK_STREAM, 0)
 	if err != nil {
 		return err
 	}
-	return unix.Bind(fd, &unix.SockaddrUnix{Name: fs.Join(fs.Root(), path)})
+	return unix.Bind(fd, &unix.SockaddrUnix{Name: p})
 }
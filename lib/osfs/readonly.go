@@ -0,0 +1,64 @@
+package osfs
+
+import (
+	"os"
+
+	"github.com/go-git/go-billy/v5"
+)
+
+// ReadOnly wraps the fs to reject all the changes with [os.ErrPermission].
+// It also hides the `Change` interface of the fs, so the nfs server reports the fs as read-only.
+func ReadOnly(fs billy.Filesystem) billy.Filesystem {
+	return ROFS{fs}
+}
+
+// ROFS is a read-only billy.FS.
+type ROFS struct {
+	billy.Filesystem
+}
+
+// Capabilities implements the billy.Capable interface.
+func (ROFS) Capabilities() billy.Capability {
+	return billy.ReadCapability | billy.SeekCapability
+}
+
+func (ROFS) Create(string) (billy.File, error) {
+	return nil, os.ErrPermission
+}
+
+func (fs ROFS) OpenFile(name string, flag int, perm os.FileMode) (billy.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		return nil, os.ErrPermission
+	}
+
+	return fs.Filesystem.OpenFile(name, flag, perm)
+}
+
+func (ROFS) Rename(string, string) error {
+	return os.ErrPermission
+}
+
+func (ROFS) Remove(string) error {
+	return os.ErrPermission
+}
+
+func (ROFS) MkdirAll(string, os.FileMode) error {
+	return os.ErrPermission
+}
+
+func (ROFS) Symlink(string, string) error {
+	return os.ErrPermission
+}
+
+func (ROFS) TempFile(string, string) (billy.File, error) {
+	return nil, os.ErrPermission
+}
+
+func (fs ROFS) Chroot(path string) (billy.Filesystem, error) {
+	sub, err := fs.Filesystem.Chroot(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ROFS{sub}, nil
+}
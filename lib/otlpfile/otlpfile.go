@@ -0,0 +1,259 @@
+// Package otlpfile exports spans as OTLP/JSON lines, such as to a file or stdout.
+// It works offline, the output can be loaded later by tools like the otlpjsonfile receiver of the otel collector.
+package otlpfile
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Exporter writes each batch of spans as one line of OTLP/JSON.
+type Exporter struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+var _ sdktrace.SpanExporter = (*Exporter)(nil)
+
+func New(w io.Writer) *Exporter {
+	return &Exporter{w: w}
+}
+
+// ExportSpans implements [sdktrace.SpanExporter].
+func (e *Exporter) ExportSpans(_ context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	b, err := json.Marshal(encode(spans))
+	if err != nil {
+		return fmt.Errorf("failed to marshal spans: %w", err)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	_, err = e.w.Write(append(b, '\n'))
+	if err != nil {
+		return fmt.Errorf("failed to write spans: %w", err)
+	}
+
+	return nil
+}
+
+// Shutdown implements [sdktrace.SpanExporter].
+// It closes the writer if it's a [io.Closer].
+func (e *Exporter) Shutdown(context.Context) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	if c, ok := e.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+type traceData struct {
+	ResourceSpans []*resourceSpans `json:"resourceSpans"`
+}
+
+type resourceSpans struct {
+	Resource   resourceData  `json:"resource"`
+	ScopeSpans []*scopeSpans `json:"scopeSpans"`
+	SchemaURL  string        `json:"schemaUrl,omitempty"`
+}
+
+type resourceData struct {
+	Attributes []keyValue `json:"attributes,omitempty"`
+}
+
+type scopeSpans struct {
+	Scope     scopeData `json:"scope"`
+	Spans     []span    `json:"spans"`
+	SchemaURL string    `json:"schemaUrl,omitempty"`
+}
+
+type scopeData struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type span struct {
+	TraceID           string     `json:"traceId"`
+	SpanID            string     `json:"spanId"`
+	ParentSpanID      string     `json:"parentSpanId,omitempty"`
+	Name              string     `json:"name"`
+	Kind              int        `json:"kind"`
+	StartTimeUnixNano string     `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string     `json:"endTimeUnixNano"`
+	Attributes        []keyValue `json:"attributes,omitempty"`
+	Events            []event    `json:"events,omitempty"`
+	Status            status     `json:"status"`
+}
+
+type event struct {
+	TimeUnixNano string     `json:"timeUnixNano"`
+	Name         string     `json:"name"`
+	Attributes   []keyValue `json:"attributes,omitempty"`
+}
+
+type status struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type keyValue struct {
+	Key   string   `json:"key"`
+	Value anyValue `json:"value"`
+}
+
+type anyValue struct {
+	StringValue *string     `json:"stringValue,omitempty"`
+	BoolValue   *bool       `json:"boolValue,omitempty"`
+	IntValue    *string     `json:"intValue,omitempty"`
+	DoubleValue *float64    `json:"doubleValue,omitempty"`
+	ArrayValue  *arrayValue `json:"arrayValue,omitempty"`
+}
+
+type arrayValue struct {
+	Values []anyValue `json:"values"`
+}
+
+// OTLP status codes, they are different from the ones of [codes.Code].
+const (
+	statusUnset = 0
+	statusOk    = 1
+	statusError = 2
+)
+
+func encode(spans []sdktrace.ReadOnlySpan) *traceData {
+	data := &traceData{}
+	resources := map[*resource.Resource]*resourceSpans{}
+	scopes := map[*resourceSpans]map[instrumentation.Scope]*scopeSpans{}
+
+	for _, s := range spans {
+		rs, has := resources[s.Resource()]
+		if !has {
+			rs = &resourceSpans{
+				Resource:  resourceData{Attributes: encodeAttrs(s.Resource().Attributes())},
+				SchemaURL: s.Resource().SchemaURL(),
+			}
+			resources[s.Resource()] = rs
+			scopes[rs] = map[instrumentation.Scope]*scopeSpans{}
+			data.ResourceSpans = append(data.ResourceSpans, rs)
+		}
+
+		ss, has := scopes[rs][s.InstrumentationScope()]
+		if !has {
+			scope := s.InstrumentationScope()
+			ss = &scopeSpans{
+				Scope:     scopeData{Name: scope.Name, Version: scope.Version},
+				SchemaURL: scope.SchemaURL,
+			}
+			scopes[rs][scope] = ss
+			rs.ScopeSpans = append(rs.ScopeSpans, ss)
+		}
+
+		ss.Spans = append(ss.Spans, encodeSpan(s))
+	}
+
+	return data
+}
+
+func encodeSpan(s sdktrace.ReadOnlySpan) span {
+	sp := span{
+		TraceID:           s.SpanContext().TraceID().String(),
+		SpanID:            s.SpanContext().SpanID().String(),
+		Name:              s.Name(),
+		Kind:              int(s.SpanKind()),
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime().UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime().UnixNano(), 10),
+		Attributes:        encodeAttrs(s.Attributes()),
+		Status:            status{Code: statusUnset, Message: s.Status().Description},
+	}
+
+	if s.Parent().HasSpanID() {
+		sp.ParentSpanID = s.Parent().SpanID().String()
+	}
+
+	switch s.Status().Code {
+	case codes.Ok:
+		sp.Status.Code = statusOk
+	case codes.Error:
+		sp.Status.Code = statusError
+	case codes.Unset:
+	}
+
+	for _, e := range s.Events() {
+		sp.Events = append(sp.Events, event{
+			TimeUnixNano: strconv.FormatInt(e.Time.UnixNano(), 10),
+			Name:         e.Name,
+			Attributes:   encodeAttrs(e.Attributes),
+		})
+	}
+
+	return sp
+}
+
+func encodeAttrs(attrs []attribute.KeyValue) []keyValue {
+	list := make([]keyValue, 0, len(attrs))
+
+	for _, kv := range attrs {
+		list = append(list, keyValue{Key: string(kv.Key), Value: encodeValue(kv.Value)})
+	}
+
+	return list
+}
+
+func encodeValue(v attribute.Value) anyValue { //nolint: cyclop
+	str := func(s string) anyValue { return anyValue{StringValue: &s} }
+	integer := func(i int64) anyValue {
+		s := strconv.FormatInt(i, 10)
+		return anyValue{IntValue: &s}
+	}
+	boolean := func(b bool) anyValue { return anyValue{BoolValue: &b} }
+	double := func(f float64) anyValue { return anyValue{DoubleValue: &f} }
+	array := func(list []anyValue) anyValue { return anyValue{ArrayValue: &arrayValue{Values: list}} }
+
+	switch v.Type() {
+	case attribute.BOOL:
+		return boolean(v.AsBool())
+	case attribute.INT64:
+		return integer(v.AsInt64())
+	case attribute.FLOAT64:
+		return double(v.AsFloat64())
+	case attribute.STRING:
+		return str(v.AsString())
+	case attribute.BOOLSLICE:
+		return array(mapList(v.AsBoolSlice(), boolean))
+	case attribute.INT64SLICE:
+		return array(mapList(v.AsInt64Slice(), integer))
+	case attribute.FLOAT64SLICE:
+		return array(mapList(v.AsFloat64Slice(), double))
+	case attribute.STRINGSLICE:
+		return array(mapList(v.AsStringSlice(), str))
+	case attribute.INVALID:
+	}
+
+	return str(v.Emit())
+}
+
+func mapList[T any](list []T, fn func(T) anyValue) []anyValue {
+	out := make([]anyValue, 0, len(list))
+	for _, v := range list {
+		out = append(out, fn(v))
+	}
+
+	return out
+}
@@ -0,0 +1,94 @@
+package dehub
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ysmood/dehub/lib/procfs"
+	"golang.org/x/crypto/ssh"
+)
+
+// Processes lists the processes on the servant side, it only works when the servant runs on linux.
+func (m *Master) Processes() ([]procfs.Process, error) {
+	var list []procfs.Process
+
+	err := m.readProcess(ProcessMeta{}, &list)
+
+	return list, err
+}
+
+// Inspect the process of the pid on the servant side, it only works when the servant runs on linux.
+func (m *Master) Inspect(pid int) (*procfs.Detail, error) {
+	var d procfs.Detail
+
+	err := m.readProcess(ProcessMeta{PID: pid}, &d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+func (m *Master) readProcess(meta ProcessMeta, v any) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal ProcessMeta: %w", err)
+	}
+
+	ch, err := m.OpenChannel(CommandProcess, b)
+	if err != nil {
+		return fmt.Errorf("failed to open process channel: %w", err)
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	b, err = io.ReadAll(ch)
+	if err != nil {
+		return fmt.Errorf("failed to read process info: %w", err)
+	}
+
+	err = json.Unmarshal(b, v)
+	if err != nil {
+		return fmt.Errorf("failed to unmarshal process info: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Servant) process(newChan ssh.NewChannel) {
+	var meta ProcessMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	var info any
+
+	if meta.PID == 0 {
+		info, err = procfs.List()
+	} else {
+		info, err = procfs.Inspect(meta.PID)
+	}
+
+	if err != nil {
+		_ = newChan.Reject(FailedReadProcess, err.Error())
+		return
+	}
+
+	b, err := json.Marshal(info)
+	if err != nil {
+		_ = newChan.Reject(FailedReadProcess, err.Error())
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept process channel", "err", err)
+		return
+	}
+
+	_, _ = ch.Write(b)
+	_ = ch.Close()
+}
@@ -0,0 +1,78 @@
+// Package procfs reads the process table straight from /proc,
+// so that it works in the minimal images that have no ps or ls.
+package procfs
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrUnsupported is returned on the platforms that have no /proc.
+var ErrUnsupported = errors.New("procfs is only supported on linux")
+
+type Process struct {
+	PID     int
+	PPID    int
+	Name    string
+	State   string
+	Cmdline []string
+
+	// CPU is the total user and system time the process has used.
+	CPU time.Duration
+
+	// RSS is the resident set size in bytes.
+	RSS int64
+
+	// FDs is the number of open file descriptors, -1 if not permitted to read.
+	FDs int
+
+	// Sockets is the number of open sockets, -1 if not permitted to read.
+	Sockets int
+
+	Threads int
+}
+
+// Detail of a process, the fields that are not permitted to read are left empty.
+type Detail struct {
+	Process
+
+	Exe string
+	Cwd string
+
+	// Status is the key-value pairs of /proc/<pid>/status.
+	Status map[string]string
+
+	FDList     []FD
+	SocketList []Socket
+	ThreadList []Thread
+}
+
+type FD struct {
+	Num    int
+	Target string
+}
+
+type Socket struct {
+	FD     int
+	Proto  string // tcp, tcp6, udp, udp6, or unix
+	Local  string
+	Remote string
+	State  string
+}
+
+type Thread struct {
+	TID   int
+	Name  string
+	State string
+	CPU   time.Duration
+}
+
+// Listener is a listening tcp socket or a bound udp socket.
+type Listener struct {
+	Proto string // tcp, tcp6, udp, or udp6
+	Local string
+
+	// PID of the process that owns the socket, 0 if not permitted to read.
+	PID  int
+	Name string
+}
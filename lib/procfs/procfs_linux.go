@@ -0,0 +1,450 @@
+//go:build linux
+
+package procfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const root = "/proc"
+
+// The USER_HZ of linux, it's 100 on all the mainstream architectures.
+const clockTicks = 100
+
+// List the processes sorted by pid, the processes that exit during the listing are skipped.
+func List() ([]Process, error) {
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", root, err)
+	}
+
+	list := []Process{}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		p, err := readProcess(pid)
+		if err != nil {
+			continue
+		}
+
+		list = append(list, *p)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].PID < list[j].PID })
+
+	return list, nil
+}
+
+func Inspect(pid int) (*Detail, error) {
+	p, err := readProcess(pid)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Detail{Process: *p}
+
+	d.Exe, _ = os.Readlink(procPath(pid, "exe"))
+	d.Cwd, _ = os.Readlink(procPath(pid, "cwd"))
+	d.Status = readStatus(procPath(pid, "status"))
+	d.FDList = readFDs(pid)
+	d.SocketList = readSockets(pid, d.FDList)
+	d.ThreadList = readThreads(pid)
+
+	return d, nil
+}
+
+func procPath(pid int, elem ...string) string {
+	return filepath.Join(append([]string{root, strconv.Itoa(pid)}, elem...)...)
+}
+
+func readProcess(pid int) (*Process, error) {
+	stat, err := readStat(procPath(pid, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Process{
+		PID:     pid,
+		PPID:    stat.ppid,
+		Name:    stat.comm,
+		State:   stat.state,
+		CPU:     stat.cpu,
+		RSS:     stat.rss * int64(os.Getpagesize()),
+		Threads: stat.threads,
+		FDs:     -1,
+		Sockets: -1,
+	}
+
+	b, _ := os.ReadFile(procPath(pid, "cmdline"))
+	if s := strings.TrimRight(string(b), "\x00"); s != "" {
+		p.Cmdline = strings.Split(s, "\x00")
+	}
+
+	fds, err := os.ReadDir(procPath(pid, "fd"))
+	if err == nil {
+		p.FDs = len(fds)
+		p.Sockets = 0
+
+		for _, fd := range fds {
+			target, _ := os.Readlink(procPath(pid, "fd", fd.Name()))
+			if strings.HasPrefix(target, "socket:") {
+				p.Sockets++
+			}
+		}
+	}
+
+	return p, nil
+}
+
+type stat struct {
+	comm    string
+	state   string
+	ppid    int
+	cpu     time.Duration
+	threads int
+	rss     int64
+}
+
+var errMalformedStat = errors.New("malformed stat")
+
+// The format is described in "man 5 proc".
+func readStat(path string) (*stat, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stat: %w", err)
+	}
+
+	s := string(b)
+
+	// The comm is wrapped by parentheses, it may contain spaces and parentheses.
+	start := strings.IndexByte(s, '(')
+	end := strings.LastIndexByte(s, ')')
+
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("%w: %s", errMalformedStat, path)
+	}
+
+	// The fields start from the 3rd field "state".
+	fields := strings.Fields(s[end+1:])
+	if len(fields) < 22 { //nolint: mnd
+		return nil, fmt.Errorf("%w: %s", errMalformedStat, path)
+	}
+
+	num := func(i int) int64 {
+		n, _ := strconv.ParseInt(fields[i-3], 10, 64)
+		return n
+	}
+
+	return &stat{
+		comm:    s[start+1 : end],
+		state:   fields[0],
+		ppid:    int(num(4)),                                               //nolint: mnd
+		cpu:     time.Duration(num(14)+num(15)) * time.Second / clockTicks, //nolint: mnd
+		threads: int(num(20)),                                              //nolint: mnd
+		rss:     num(24),                                                   //nolint: mnd
+	}, nil
+}
+
+func readStatus(path string) map[string]string {
+	status := map[string]string{}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return status
+	}
+
+	for _, line := range strings.Split(string(b), "\n") {
+		k, v, found := strings.Cut(line, ":")
+		if found {
+			status[k] = strings.TrimSpace(v)
+		}
+	}
+
+	return status
+}
+
+func readFDs(pid int) []FD {
+	entries, err := os.ReadDir(procPath(pid, "fd"))
+	if err != nil {
+		return nil
+	}
+
+	list := []FD{}
+
+	for _, entry := range entries {
+		num, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		target, _ := os.Readlink(procPath(pid, "fd", entry.Name()))
+
+		list = append(list, FD{Num: num, Target: target})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Num < list[j].Num })
+
+	return list
+}
+
+func readThreads(pid int) []Thread {
+	entries, err := os.ReadDir(procPath(pid, "task"))
+	if err != nil {
+		return nil
+	}
+
+	list := []Thread{}
+
+	for _, entry := range entries {
+		tid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		stat, err := readStat(procPath(pid, "task", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		list = append(list, Thread{TID: tid, Name: stat.comm, State: stat.state, CPU: stat.cpu})
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].TID < list[j].TID })
+
+	return list
+}
+
+// The socket tables are read from the net dir of the process, so that the network namespace of the process is used.
+func readSockets(pid int, fds []FD) []Socket {
+	inodes := map[string]int{}
+
+	for _, fd := range fds {
+		if strings.HasPrefix(fd.Target, "socket:[") {
+			inodes[strings.TrimSuffix(strings.TrimPrefix(fd.Target, "socket:["), "]")] = fd.Num
+		}
+	}
+
+	if len(inodes) == 0 {
+		return nil
+	}
+
+	list := []Socket{}
+
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		list = append(list, readInetSockets(procPath(pid, "net", proto), proto, inodes)...)
+	}
+
+	list = append(list, readUnixSockets(procPath(pid, "net", "unix"), inodes)...)
+
+	sort.Slice(list, func(i, j int) bool { return list[i].FD < list[j].FD })
+
+	return list
+}
+
+// Listening lists the listening sockets in the network namespace of the current process.
+func Listening() ([]Listener, error) {
+	owners := socketOwners()
+
+	list := []Listener{}
+
+	for _, proto := range []string{"tcp", "tcp6", "udp", "udp6"} {
+		path := filepath.Join(root, "net", proto)
+
+		_, err := os.Stat(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+
+			return nil, fmt.Errorf("failed to read socket table: %w", err)
+		}
+
+		eachLine(path, func(fields []string) {
+			if len(fields) < 10 { //nolint: mnd
+				return
+			}
+
+			// For udp, the unconnected sockets have the "CLOSE" state.
+			if (proto[:3] == "tcp" && fields[3] != "0A") || (proto[:3] == "udp" && fields[3] != "07") {
+				return
+			}
+
+			l := Listener{Proto: proto, Local: parseAddr(fields[1])}
+
+			if p, ok := owners[fields[9]]; ok {
+				l.PID = p.PID
+				l.Name = p.Name
+			}
+
+			list = append(list, l)
+		})
+	}
+
+	return list, nil
+}
+
+// socketOwners maps the socket inodes to the processes that have them open.
+func socketOwners() map[string]*Process {
+	owners := map[string]*Process{}
+
+	entries, _ := os.ReadDir(root)
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		fds, err := os.ReadDir(procPath(pid, "fd"))
+		if err != nil {
+			continue
+		}
+
+		var p *Process
+
+		for _, fd := range fds {
+			target, _ := os.Readlink(procPath(pid, "fd", fd.Name()))
+			if !strings.HasPrefix(target, "socket:[") {
+				continue
+			}
+
+			if p == nil {
+				p = &Process{PID: pid}
+				if stat, err := readStat(procPath(pid, "stat")); err == nil {
+					p.Name = stat.comm
+				}
+			}
+
+			owners[strings.TrimSuffix(strings.TrimPrefix(target, "socket:["), "]")] = p
+		}
+	}
+
+	return owners
+}
+
+// The states in include/net/tcp_states.h .
+var tcpStates = map[string]string{
+	"01": "ESTABLISHED",
+	"02": "SYN_SENT",
+	"03": "SYN_RECV",
+	"04": "FIN_WAIT1",
+	"05": "FIN_WAIT2",
+	"06": "TIME_WAIT",
+	"07": "CLOSE",
+	"08": "CLOSE_WAIT",
+	"09": "LAST_ACK",
+	"0A": "LISTEN",
+	"0B": "CLOSING",
+}
+
+func readInetSockets(path, proto string, inodes map[string]int) []Socket {
+	list := []Socket{}
+
+	eachLine(path, func(fields []string) {
+		if len(fields) < 10 { //nolint: mnd
+			return
+		}
+
+		fd, ok := inodes[fields[9]]
+		if !ok {
+			return
+		}
+
+		state := tcpStates[fields[3]]
+		if strings.HasPrefix(proto, "udp") {
+			state = ""
+		}
+
+		list = append(list, Socket{
+			FD:     fd,
+			Proto:  proto,
+			Local:  parseAddr(fields[1]),
+			Remote: parseAddr(fields[2]),
+			State:  state,
+		})
+	})
+
+	return list
+}
+
+func readUnixSockets(path string, inodes map[string]int) []Socket {
+	list := []Socket{}
+
+	eachLine(path, func(fields []string) {
+		if len(fields) < 7 { //nolint: mnd
+			return
+		}
+
+		fd, ok := inodes[fields[6]]
+		if !ok {
+			return
+		}
+
+		s := Socket{FD: fd, Proto: "unix"}
+		if len(fields) > 7 { //nolint: mnd
+			s.Local = fields[7]
+		}
+
+		list = append(list, s)
+	})
+
+	return list
+}
+
+// eachLine calls fn with the fields of each line, the header line is skipped.
+func eachLine(path string, fn func(fields []string)) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+
+	defer func() { _ = f.Close() }()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+
+	for scanner.Scan() {
+		fn(strings.Fields(scanner.Text()))
+	}
+}
+
+// parseAddr parses the address like "0100007F:1F90",
+// the ip is the hex of 32-bit words in host byte order, the port is in network byte order.
+func parseAddr(s string) string {
+	ipHex, portHex, found := strings.Cut(s, ":")
+	if !found {
+		return s
+	}
+
+	b, err := hex.DecodeString(ipHex)
+	if err != nil || len(b)%4 != 0 {
+		return s
+	}
+
+	ip := make(net.IP, len(b))
+	for i := 0; i < len(b); i += 4 {
+		binary.BigEndian.PutUint32(ip[i:], binary.NativeEndian.Uint32(b[i:]))
+	}
+
+	port, err := strconv.ParseUint(portHex, 16, 16)
+	if err != nil {
+		return s
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.FormatUint(port, 10))
+}
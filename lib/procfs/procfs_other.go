@@ -0,0 +1,15 @@
+//go:build !linux
+
+package procfs
+
+func List() ([]Process, error) {
+	return nil, ErrUnsupported
+}
+
+func Inspect(_ int) (*Detail, error) {
+	return nil, ErrUnsupported
+}
+
+func Listening() ([]Listener, error) {
+	return nil, ErrUnsupported
+}
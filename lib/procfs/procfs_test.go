@@ -0,0 +1,86 @@
+//go:build linux
+
+package procfs_test
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/ysmood/dehub/lib/procfs"
+	"github.com/ysmood/got"
+)
+
+func TestList(t *testing.T) {
+	g := got.T(t)
+
+	list, err := procfs.List()
+	g.E(err)
+
+	for _, p := range list {
+		if p.PID == os.Getpid() {
+			g.Eq(p.PPID, os.Getppid())
+			g.Eq(p.Cmdline, os.Args)
+			g.Gt(p.RSS, 0)
+			g.Gt(p.Threads, 0)
+			g.Gt(p.FDs, 0)
+			return
+		}
+	}
+
+	g.Fail()
+}
+
+func TestInspect(t *testing.T) {
+	g := got.T(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l.Close() }()
+
+	d, err := procfs.Inspect(os.Getpid())
+	g.E(err)
+
+	exe, err := os.Executable()
+	g.E(err)
+	g.Eq(d.Exe, exe)
+	g.Eq(d.Status["Pid"], d.Status["Tgid"])
+	// The threads count and list are read at different moments, the runtime may start threads in between.
+	g.Gt(len(d.ThreadList), 0)
+
+	var listener *procfs.Socket
+
+	for _, s := range d.SocketList {
+		if s.Local == l.Addr().String() {
+			listener = &s
+		}
+	}
+
+	g.Eq(listener.Proto, "tcp")
+	g.Eq(listener.State, "LISTEN")
+	g.Eq(listener.Remote, "0.0.0.0:0")
+
+	_, err = procfs.Inspect(-1)
+	g.Err(err)
+}
+
+func TestListening(t *testing.T) {
+	g := got.T(t)
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	g.E(err)
+	defer func() { _ = l.Close() }()
+
+	list, err := procfs.Listening()
+	g.E(err)
+
+	for _, item := range list {
+		if item.Local == l.Addr().String() {
+			g.Eq(item.Proto, "tcp")
+			g.Eq(item.PID, os.Getpid())
+			return
+		}
+	}
+
+	g.Fail()
+}
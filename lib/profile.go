@@ -0,0 +1,127 @@
+package dehub
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Profile captures the runtime profile of the servant process and writes it to the out,
+// the output can be used by "go tool pprof", or "go tool trace" for the [ProfileTrace].
+// It blocks for the duration if the profile type needs to collect samples.
+func (m *Master) Profile(out io.Writer, typ ProfileType, duration time.Duration) error {
+	meta, err := json.Marshal(ProfileMeta{
+		Type:     typ,
+		Duration: duration,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal ProfileMeta: %w", err)
+	}
+
+	ch, err := m.OpenChannel(CommandProfile, meta)
+	if err != nil {
+		return fmt.Errorf("failed to open profile channel: %w", err)
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	_, err = io.Copy(out, ch)
+	if err != nil {
+		return fmt.Errorf("failed to read profile: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Servant) profile(newChan ssh.NewChannel) {
+	var meta ProfileMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	// The profile is buffered so that the failure can be reported via the rejection.
+	buf := bytes.NewBuffer(nil)
+
+	err = writeProfile(buf, meta)
+	if err != nil {
+		_ = newChan.Reject(FailedProfile, err.Error())
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept profile channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	_, err = io.Copy(ch, buf)
+	if err != nil {
+		s.Logger.Error("failed to send profile", "err", err)
+	}
+}
+
+func writeProfile(w io.Writer, meta ProfileMeta) error {
+	switch meta.Type {
+	case ProfileCPU:
+		err := pprof.StartCPUProfile(w)
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(meta.Duration)
+		pprof.StopCPUProfile()
+
+		return nil
+
+	case ProfileTrace:
+		err := trace.Start(w)
+		if err != nil {
+			return err
+		}
+
+		time.Sleep(meta.Duration)
+		trace.Stop()
+
+		return nil
+
+	case ProfileMutex:
+		if meta.Duration > 0 {
+			prev := runtime.SetMutexProfileFraction(1)
+			time.Sleep(meta.Duration)
+			runtime.SetMutexProfileFraction(prev)
+		}
+
+	case ProfileBlock:
+		// The block profile rate can't be read, so it's turned off after the sampling.
+		if meta.Duration > 0 {
+			runtime.SetBlockProfileRate(1)
+			time.Sleep(meta.Duration)
+			runtime.SetBlockProfileRate(0)
+		}
+
+	case ProfileHeap:
+		// Get up-to-date statistics, the same as the "gc" param of net/http/pprof.
+		runtime.GC()
+
+	case ProfileAllocs, ProfileGoroutine:
+	}
+
+	p := pprof.Lookup(string(meta.Type))
+	if p == nil {
+		return errors.New("unknown profile type: " + string(meta.Type))
+	}
+
+	return p.WriteTo(w, 0)
+}
@@ -0,0 +1,319 @@
+package dehub
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
+)
+
+// QUICScheme is the address prefix to connect via QUIC, such as "quic://dehub.ysmood.org:8813".
+const QUICScheme = "quic://"
+
+// The ALPN protocol of dehub over QUIC.
+const quicProtocol = "dehub"
+
+// The max number of the concurrent streams of a QUIC connection, each master session of a servant takes one.
+const quicMaxStreams = 1 << 16
+
+// QUICDialTimeout is the timeout of the QUIC handshake,
+// the udp may be silently dropped, so it's short to fall back to tcp quickly.
+const QUICDialTimeout = 5 * time.Second
+
+// The default idle timeout of QUIC, used when the keepalive is disabled.
+const quicIdleTimeout = 30 * time.Second
+
+// IsQUICAddr returns true if the addr has the [QUICScheme] prefix.
+func IsQUICAddr(addr string) bool {
+	return strings.HasPrefix(addr, QUICScheme)
+}
+
+// DialQUIC connects to the hub via QUIC, the addr can have the [QUICScheme] prefix.
+// The returned conn works with [Servant.Serve] and [Master.Connect].
+// When the servant uses it, the hub opens a QUIC stream for each master session instead of a yamux stream,
+// so that a lost packet of one session won't block the others.
+// If the tlsConf is nil, the hub certificate isn't verified, the same as the TCP transport,
+// the master and servant still authenticate each other with their ssh keys end-to-end.
+// Closing the conn closes the whole QUIC connection.
+func DialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, keepalive Keepalive) (net.Conn, error) {
+	conn, err := dialQUIC(ctx, addr, tlsConf, keepalive)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		_ = conn.CloseWithError(0, "")
+		return nil, fmt.Errorf("failed to open quic stream: %w", err)
+	}
+
+	return &quicStream{Stream: stream, conn: conn, owner: true}, nil
+}
+
+func dialQUIC(ctx context.Context, addr string, tlsConf *tls.Config, keepalive Keepalive) (quic.Connection, error) {
+	if tlsConf == nil {
+		tlsConf = &tls.Config{InsecureSkipVerify: true} //nolint: gosec
+	}
+
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{quicProtocol}
+
+	conn, err := quic.DialAddr(ctx, strings.TrimPrefix(addr, QUICScheme), tlsConf, keepalive.quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial quic: %w", err)
+	}
+
+	return conn, nil
+}
+
+// QUICListener accepts the streams of the QUIC connections, each stream is returned as a [net.Conn],
+// so it can be used the same way as a TCP listener, such as passing the conns to [Hub.Handle].
+type QUICListener struct {
+	listener *quic.Listener
+	streams  chan net.Conn
+	closed   chan struct{}
+}
+
+var _ net.Listener = (*QUICListener)(nil)
+
+// ListenQUIC listens the udp addr for QUIC.
+// If the tlsConf is nil, a self-signed certificate is generated, see [DialQUIC] for why it's fine.
+func ListenQUIC(addr string, tlsConf *tls.Config, keepalive Keepalive) (*QUICListener, error) {
+	if tlsConf == nil {
+		var err error
+
+		tlsConf, err = selfSignedTLS()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tlsConf = tlsConf.Clone()
+	tlsConf.NextProtos = []string{quicProtocol}
+
+	l, err := quic.ListenAddr(strings.TrimPrefix(addr, QUICScheme), tlsConf, keepalive.quicConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen quic: %w", err)
+	}
+
+	ql := &QUICListener{listener: l, streams: make(chan net.Conn), closed: make(chan struct{})}
+
+	go ql.acceptConns()
+
+	return ql, nil
+}
+
+func (l *QUICListener) acceptConns() {
+	defer close(l.closed)
+
+	for {
+		conn, err := l.listener.Accept(context.Background())
+		if err != nil {
+			return
+		}
+
+		go l.acceptStreams(conn)
+	}
+}
+
+func (l *QUICListener) acceptStreams(conn quic.Connection) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		select {
+		case l.streams <- &quicStream{Stream: stream, conn: conn}:
+		case <-l.closed:
+			stream.CancelRead(0)
+			stream.CancelWrite(0)
+
+			return
+		}
+	}
+}
+
+// Accept waits for the next stream.
+func (l *QUICListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.streams:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening, the accepted connections are closed too.
+func (l *QUICListener) Close() error {
+	return l.listener.Close()
+}
+
+func (l *QUICListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+// quicStream is a QUIC stream that works like a TCP conn.
+type quicStream struct {
+	quic.Stream
+	conn quic.Connection
+
+	// The owner closes the whole connection when closed.
+	owner bool
+}
+
+var _ net.Conn = (*quicStream)(nil)
+
+func (s *quicStream) LocalAddr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+func (s *quicStream) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+// Close both directions of the stream, the [quic.Stream.Close] only closes the write direction.
+func (s *quicStream) Close() error {
+	s.Stream.CancelRead(0)
+	err := s.Stream.Close()
+
+	if s.owner {
+		return s.conn.CloseWithError(0, "")
+	}
+
+	return err
+}
+
+// muxSession multiplexes the streams over a connection to the hub,
+// it's a yamux session for TCP and websocket, or the QUIC connection itself.
+type muxSession interface {
+	Open() (net.Conn, error)
+	Accept() (net.Conn, error)
+	Close() error
+	CloseChan() <-chan struct{}
+}
+
+// newMuxSession uses the QUIC streams if the conn is a QUIC stream, or creates a yamux session over the conn.
+func (k Keepalive) newMuxSession(conn io.ReadWriteCloser, client bool, logger *slog.Logger) (muxSession, error) {
+	if s, ok := conn.(*quicStream); ok {
+		return &quicSession{conn: s.conn}, nil
+	}
+
+	if client {
+		return yamux.Client(conn, k.yamuxConfig(logger))
+	}
+
+	return yamux.Server(conn, k.yamuxConfig(logger))
+}
+
+// watch the peer of the session, see [Keepalive.watchYamux] and [Keepalive.watchQUIC].
+func (k Keepalive) watch(session muxSession, onDead func()) {
+	switch s := session.(type) {
+	case *yamux.Session:
+		k.watchYamux(s, onDead)
+	case *quicSession:
+		k.watchQUIC(s.conn, onDead)
+	}
+}
+
+// watchQUIC waits until the conn is closed, the onDead is called if it's closed by the idle timeout.
+// The pings are sent by QUIC itself, see [Keepalive.quicConfig].
+func (k Keepalive) watchQUIC(conn quic.Connection, onDead func()) {
+	<-conn.Context().Done()
+
+	var idle *quic.IdleTimeoutError
+	if errors.As(context.Cause(conn.Context()), &idle) {
+		onDead()
+	}
+}
+
+func (k Keepalive) quicConfig() *quic.Config {
+	conf := &quic.Config{
+		MaxIncomingStreams: quicMaxStreams,
+		MaxIdleTimeout:     quicIdleTimeout,
+	}
+
+	if k.Interval > 0 {
+		conf.KeepAlivePeriod = k.Interval
+		conf.MaxIdleTimeout = k.Interval + k.timeout()
+	}
+
+	return conf
+}
+
+type quicSession struct {
+	conn quic.Connection
+}
+
+func (s *quicSession) Open() (net.Conn, error) {
+	stream, err := s.conn.OpenStreamSync(s.conn.Context())
+	if err != nil {
+		return nil, s.closedErr(err)
+	}
+
+	return &quicStream{Stream: stream, conn: s.conn}, nil
+}
+
+func (s *quicSession) Accept() (net.Conn, error) {
+	stream, err := s.conn.AcceptStream(s.conn.Context())
+	if err != nil {
+		return nil, s.closedErr(err)
+	}
+
+	return &quicStream{Stream: stream, conn: s.conn}, nil
+}
+
+func (s *quicSession) Close() error {
+	return s.conn.CloseWithError(0, "")
+}
+
+func (s *quicSession) CloseChan() <-chan struct{} {
+	return s.conn.Context().Done()
+}
+
+// closedErr makes the error of a closed connection the same as a closed yamux session.
+func (s *quicSession) closedErr(err error) error {
+	if s.conn.Context().Err() != nil {
+		return fmt.Errorf("%w: %w", yamux.ErrSessionShutdown, err)
+	}
+
+	return err
+}
+
+func selfSignedTLS() (*tls.Config, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate tls key: %w", err)
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: quicProtocol},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0), //nolint: mnd
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create tls certificate: %w", err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS13,
+	}, nil
+}
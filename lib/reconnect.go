@@ -0,0 +1,154 @@
+package dehub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/yamux"
+)
+
+// ErrServantKeyChanged is returned when the servant presents a different key from the one trusted at the first connect.
+var ErrServantKeyChanged = errors.New("servant public key changed")
+
+// KeepConnected re-dials the hub via the dial once the connection to the servant is lost,
+// and re-establishes the ssh session with the same trusted servant key.
+// The forwarding listeners, such as [Master.ForwardSocks5], [Master.ForwardHTTP], [Master.ForwardUDP],
+// and [Master.ServeNFS], stay open and resume serving the new connections once reconnected,
+// the [Master.TapLogs] is resumed too.
+// It blocks until the ctx is done, the [Master.Close] is called, or the servant key changed.
+func (m *Master) KeepConnected(ctx context.Context, dial func() (io.ReadWriteCloser, error), retryInterval time.Duration,
+) error {
+	m.reconnecting.Store(true)
+	defer func() {
+		m.reconnecting.Store(false)
+		m.conn().end()
+	}()
+
+	for {
+		closed := make(chan struct{})
+		go func() {
+			_ = m.conn().Wait()
+			close(closed)
+		}()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-closed:
+		}
+
+		if m.closed.Load() {
+			return nil
+		}
+
+		m.Logger.Warn("connection to servant lost, reconnecting", slog.String("servantId", m.servantID.String()))
+
+		err := m.reconnect(ctx, dial, retryInterval)
+		if err != nil {
+			return err
+		}
+
+		m.Logger.Info("reconnected to servant", slog.String("servantId", m.servantID.String()))
+	}
+}
+
+func (m *Master) reconnect(ctx context.Context, dial func() (io.ReadWriteCloser, error), retryInterval time.Duration,
+) error {
+	for {
+		conn, err := dial()
+		if err == nil {
+			err = m.Connect(conn)
+			if err == nil {
+				return nil
+			}
+
+			_ = conn.Close()
+
+			if errors.Is(err, ErrServantKeyChanged) {
+				return err
+			}
+		}
+
+		m.Logger.Warn("failed to reconnect", slog.Any("err", err), slog.String("wait", retryInterval.String()))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryInterval):
+		}
+	}
+}
+
+// channelTunnel is a yamux session over a ssh channel, the session is reopened on demand
+// if it was closed, such as after the master reconnected.
+type channelTunnel struct {
+	m    *Master
+	cmd  Command
+	meta []byte
+
+	lock    sync.Mutex
+	session *yamux.Session
+}
+
+// openTunnel opens the tunnel eagerly, so that the rejection of the servant is returned early.
+func (m *Master) openTunnel(cmd Command, meta []byte) (*channelTunnel, error) {
+	t := &channelTunnel{m: m, cmd: cmd, meta: meta}
+
+	_, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *channelTunnel) get() (*yamux.Session, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.session != nil && !t.session.IsClosed() {
+		return t.session, nil
+	}
+
+	ch, err := t.m.OpenChannel(t.cmd, t.meta)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s channel: %w", t.cmd, err)
+	}
+
+	session, err := yamux.Client(ch, t.m.yamuxConfig())
+	if err != nil {
+		_ = ch.Close()
+		return nil, fmt.Errorf("failed to create %s yamux tunnel: %w", t.cmd, err)
+	}
+
+	t.session = session
+
+	return session, nil
+}
+
+// Open a stream of the tunnel.
+func (t *channelTunnel) Open() (net.Conn, error) {
+	session, err := t.get()
+	if err != nil {
+		return nil, err
+	}
+
+	return session.Open()
+}
+
+func (t *channelTunnel) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.session == nil {
+		return nil
+	}
+
+	return t.session.Close()
+}
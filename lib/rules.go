@@ -0,0 +1,282 @@
+package dehub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+)
+
+// ForwardRules restricts the destinations that the masters can reach via the forwarding of the servant.
+// Each rule is one of the formats below, it can be suffixed with a port or a port range:
+//
+//	10.0.0.0/8
+//	169.254.169.254:80
+//	example.com:443
+//	*.svc.cluster.local:8000-9000
+//	*:22
+//
+// The hostname rules match the domain name that the master requested with [path.Match],
+// the CIDR rules match the resolved ip, so a domain name can't bypass the CIDR rules.
+type ForwardRules struct {
+	allow []rule
+	deny  []rule
+}
+
+type rule struct {
+	cidr *net.IPNet
+	host string // glob pattern
+
+	portFrom int
+	portTo   int
+}
+
+// NewForwardRules creates the rules, the deny rules take precedence over the allow rules.
+// If the allow is empty, all the destinations that are not denied are allowed.
+func NewForwardRules(allow, deny []string) (*ForwardRules, error) {
+	r := &ForwardRules{}
+
+	for _, s := range allow {
+		item, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		r.allow = append(r.allow, item)
+	}
+
+	for _, s := range deny {
+		item, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+
+		r.deny = append(r.deny, item)
+	}
+
+	return r, nil
+}
+
+// Allowed reports whether the destination is allowed.
+// The host is the domain name that the master requested, it's empty if the master requested an ip.
+func (r *ForwardRules) Allowed(host string, ip net.IP, port int) bool {
+	if r == nil {
+		return true
+	}
+
+	for _, item := range r.deny {
+		if item.match(host, ip, port) {
+			return false
+		}
+	}
+
+	if len(r.allow) == 0 {
+		return true
+	}
+
+	for _, item := range r.allow {
+		if item.match(host, ip, port) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseRule(s string) (rule, error) {
+	r := rule{portFrom: 0, portTo: 65535}
+
+	target := s
+
+	if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+		if host, port, found := cutPort(s); found {
+			target = host
+
+			from, to, _ := strings.Cut(port, "-")
+			if to == "" {
+				to = from
+			}
+
+			var err error
+
+			r.portFrom, err = strconv.Atoi(from)
+			if err != nil {
+				return r, fmt.Errorf("invalid port of forward rule %q: %w", s, err)
+			}
+
+			r.portTo, err = strconv.Atoi(to)
+			if err != nil {
+				return r, fmt.Errorf("invalid port of forward rule %q: %w", s, err)
+			}
+		}
+	}
+
+	target = strings.Trim(target, "[]")
+
+	if _, cidr, err := net.ParseCIDR(target); err == nil {
+		r.cidr = cidr
+		return r, nil
+	}
+
+	if ip := net.ParseIP(target); ip != nil {
+		bits := 8 * len(ip.To16()) //nolint: mnd
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 32
+		}
+
+		r.cidr = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+
+		return r, nil
+	}
+
+	_, err := path.Match(target, "")
+	if err != nil || target == "" {
+		return r, fmt.Errorf("invalid host of forward rule: %q", s)
+	}
+
+	r.host = strings.ToLower(target)
+
+	return r, nil
+}
+
+// cutPort splits the port from the rule, the ipv6 must be wrapped with brackets if it has a port.
+func cutPort(s string) (string, string, bool) {
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 || strings.HasSuffix(s[:i], ":") || (strings.Contains(s[:i], ":") && !strings.HasSuffix(s[:i], "]")) {
+		return s, "", false
+	}
+
+	return s[:i], s[i+1:], true
+}
+
+func (r rule) match(host string, ip net.IP, port int) bool {
+	if port < r.portFrom || port > r.portTo {
+		return false
+	}
+
+	if r.cidr != nil {
+		return ip != nil && r.cidr.Contains(ip)
+	}
+
+	if r.host == "*" {
+		return true
+	}
+
+	if host == "" {
+		return false
+	}
+
+	ok, _ := path.Match(r.host, strings.ToLower(strings.TrimSuffix(host, ".")))
+
+	return ok
+}
+
+// resolver adapts the [net.Resolver] for the socks5 server.
+type resolver struct {
+	r *net.Resolver
+}
+
+func (r resolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	addrs, err := r.r.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("failed to resolve %s: %w", name, err)
+	}
+
+	if len(addrs) == 0 {
+		return ctx, nil, fmt.Errorf("no address for %s", name)
+	}
+
+	return ctx, addrs[0].IP, nil
+}
+
+// socks5Rules applies the [ForwardRules] to the socks5 server.
+type socks5Rules struct {
+	logger *slog.Logger
+	rules  *ForwardRules
+}
+
+func (r *socks5Rules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	dest := req.DestAddr
+
+	if r.rules.Allowed(dest.FQDN, dest.IP, dest.Port) {
+		return ctx, true
+	}
+
+	r.logger.Warn("socks5 destination denied", "dest", destAddr(req), "ip", dest.IP.String())
+
+	return ctx, false
+}
+
+// destAddr returns the destination that the master requested, the domain name is preferred over the resolved ip.
+func destAddr(req *socks5.Request) string {
+	if req.RawDestAddr.FQDN != "" {
+		return net.JoinHostPort(req.RawDestAddr.FQDN, strconv.Itoa(req.RawDestAddr.Port))
+	}
+
+	return req.RawDestAddr.String()
+}
+
+// auditConn reports the bytes and duration of the connection when it's closed.
+type auditConn struct {
+	net.Conn
+
+	start    time.Time
+	sent     atomic.Int64
+	received atomic.Int64
+	closed   atomic.Bool
+	report   func(sent, received int64, duration time.Duration)
+}
+
+func newAuditConn(conn net.Conn, report func(sent, received int64, duration time.Duration)) *auditConn {
+	return &auditConn{Conn: conn, start: time.Now(), report: report}
+}
+
+func (c *auditConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.received.Add(int64(n))
+
+	return n, err
+}
+
+func (c *auditConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.sent.Add(int64(n))
+
+	return n, err
+}
+
+// CloseWrite keeps the half-close of the socks5 proxying working.
+func (c *auditConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+
+	return nil
+}
+
+func (c *auditConn) Close() error {
+	if c.closed.CompareAndSwap(false, true) {
+		c.report(c.sent.Load(), c.received.Load(), time.Since(c.start))
+	}
+
+	return c.Conn.Close()
+}
+
+// The ssh permission extension that records the fingerprint of the master public key.
+const masterPubKeyExtension = "master-pubkey"
+
+type masterPubKeyCtxKey struct{}
+
+// masterPubKey returns the fingerprint of the master public key of the ssh connection that the ctx belongs to.
+func masterPubKey(ctx context.Context) string {
+	fp, _ := ctx.Value(masterPubKeyCtxKey{}).(string)
+	return fp
+}
@@ -0,0 +1,40 @@
+package dehub_test
+
+import (
+	"net"
+	"testing"
+
+	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/got"
+)
+
+func TestForwardRules(t *testing.T) {
+	g := got.T(t)
+
+	rules, err := dehub.NewForwardRules(
+		[]string{"10.0.0.0/8", "*.example.com:443", "[::1]:8000-9000", "*:22"},
+		[]string{"10.0.0.1", "admin.example.com"},
+	)
+	g.E(err)
+
+	ip := net.ParseIP
+
+	g.True(rules.Allowed("", ip("10.1.2.3"), 80))
+	g.False(rules.Allowed("", ip("10.0.0.1"), 80))
+	g.True(rules.Allowed("a.example.com", ip("1.1.1.1"), 443))
+	g.False(rules.Allowed("a.example.com", ip("1.1.1.1"), 80))
+	g.False(rules.Allowed("admin.example.com", ip("1.1.1.1"), 443))
+	g.True(rules.Allowed("", ip("::1"), 8080))
+	g.False(rules.Allowed("", ip("::1"), 80))
+	g.True(rules.Allowed("", ip("1.1.1.1"), 22))
+	g.False(rules.Allowed("other.com", ip("1.1.1.1"), 443))
+
+	// A domain name can't bypass the CIDR rules.
+	g.False(rules.Allowed("evil.com", ip("10.0.0.1"), 22))
+
+	var nilRules *dehub.ForwardRules
+	g.True(nilRules.Allowed("", ip("10.0.0.1"), 80))
+
+	_, err = dehub.NewForwardRules([]string{"a.com:x"}, nil)
+	g.Has(err.Error(), "invalid port of forward rule")
+}
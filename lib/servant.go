@@ -1,14 +1,19 @@
 package dehub
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
-	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/creack/pty"
@@ -18,6 +23,8 @@ import (
 	"github.com/willscott/go-nfs"
 	nfshelper "github.com/willscott/go-nfs/helpers"
 	osfsx "github.com/ysmood/dehub/lib/osfs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -29,18 +36,23 @@ func (n ServantID) String() string {
 
 func NewServant(id ServantID, prvKey ssh.Signer, check func(ssh.PublicKey) bool) *Servant {
 	s := &Servant{
-		Logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
-		id:     id,
+		Logger:    slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Tracer:    defaultTracer(),
+		Keepalive: DefaultKeepalive,
+		id:        id,
 	}
 
 	s.sshConf = &ssh.ServerConfig{
+		ServerVersion: sshVersion(),
 		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
 			if check(key) {
 				s.Logger.Info("authorized master public key",
 					slog.String("session-id", hex.EncodeToString(conn.SessionID())),
 					slog.String("master-pubkey", ssh.FingerprintSHA256(key)))
 
-				return nil, nil //nolint: nilnil
+				return &ssh.Permissions{Extensions: map[string]string{
+					masterPubKeyExtension: ssh.FingerprintSHA256(key),
+				}}, nil
 			}
 
 			return nil, errors.New("not a authorized master public key")
@@ -49,77 +61,214 @@ func NewServant(id ServantID, prvKey ssh.Signer, check func(ssh.PublicKey) bool)
 
 	s.sshConf.AddHostKey(prvKey)
 
+	s.handle(CommandExec, withoutCtx(s.exec))
+	s.handle(CommandForwardSocks5, s.forwardSocks5)
+	s.handle(CommandShareDir, s.shareDir)
+	s.handle(CommandProfile, withoutCtx(s.profile))
+	s.handle(CommandDebug, withoutCtx(s.debug))
+	s.handle(CommandLogTap, withoutCtx(s.logTap))
+	s.handle(CommandVars, withoutCtx(s.vars))
+	s.handle(CommandProcess, withoutCtx(s.process))
+	s.handle(CommandDiag, s.diagnose)
+	s.handle(CommandForwardUDP, s.forwardUDP)
+	s.handle(CommandSync, withoutCtx(s.syncDir))
+
 	return s
 }
 
+// Handle registers the handler for the channels of the cmd, it replaces the existing handler of the cmd,
+// including the built-in ones. The handler must accept or reject the channel.
+// The master can open the channel with [Master.OpenChannel].
+// Register the handlers before the servant serves, so that the masters can discover them via [Master.ServantInfo].
+func (s *Servant) Handle(cmd Command, handler func(ssh.NewChannel)) {
+	s.handle(cmd, withoutCtx(handler))
+}
+
+func (s *Servant) handle(cmd Command, handler func(context.Context, ssh.NewChannel)) {
+	s.handlers.Store(cmd, handler)
+}
+
+func withoutCtx(handler func(ssh.NewChannel)) func(context.Context, ssh.NewChannel) {
+	return func(_ context.Context, newChan ssh.NewChannel) { handler(newChan) }
+}
+
 func (s *Servant) Serve(conn io.ReadWriteCloser) func() {
-	err := connectHub(conn, ClientTypeServant, s.id)
+	wait, err := s.connect(conn)
 	if err != nil {
 		s.Logger.Error("Failed to connect to hub", slog.Any("err", err))
 		return func() {}
 	}
 
-	server, err := yamux.Server(conn, nil)
+	return func() { _ = wait() }
+}
+
+// Run is similar to [Servant.Serve], but it waits until the servant disconnects from the hub.
+// It returns [ErrServantReplaced] if another servant with the same id has taken its place,
+// the caller should stop reconnecting, or the two servants will keep replacing each other.
+func (s *Servant) Run(conn io.ReadWriteCloser) error {
+	wait, err := s.connect(conn)
 	if err != nil {
-		s.Logger.Error("Failed to create yamux server", slog.Any("err", err))
-		return func() {}
+		return err
+	}
+
+	return wait()
+}
+
+func (s *Servant) connect(conn io.ReadWriteCloser) (func() error, error) {
+	hubVersion, err := connectHub(context.Background(), s.Tracer, conn, ClientTypeServant, s.id)
+	if err != nil {
+		return nil, err
+	}
+
+	server, err := s.Keepalive.newMuxSession(conn, false, s.Logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create yamux server: %w", err)
 	}
 
 	s.Logger.Info("servant connected to hub", slog.String("servantId", s.id.String()))
 
-	return func() {
-		for {
-			conn, err := server.Accept()
-			if err != nil {
-				if errors.Is(err, io.EOF) {
+	go s.Keepalive.watch(server, func() {
+		s.Logger.Warn("hub stopped responding", slog.String("servantId", s.id.String()))
+	})
+
+	// The returned function also returns when the hub asks the servant to reconnect,
+	// the in-flight sessions will keep running until the hub closes them.
+	return func() error {
+		reconnect := make(chan struct{})
+		once := sync.Once{}
+		replaced := atomic.Bool{}
+
+		go func() {
+			for {
+				conn, err := server.Accept()
+				if err != nil {
+					if errors.Is(err, io.EOF) || errors.Is(err, yamux.ErrSessionShutdown) {
+						return
+					}
+
+					s.Logger.Error("Failed to accept connection", slog.Any("err", err))
 					return
 				}
 
-				s.Logger.Error("Failed to accept connection", slog.Any("err", err))
-				return
+				go s.serve(conn, hubVersion, func(n *Notice) {
+					switch n.Type {
+					case NoticeReconnect:
+						once.Do(func() { close(reconnect) })
+					case NoticeReplaced:
+						s.Logger.Warn("servant is replaced by another servant with the same id",
+							slog.String("servantId", s.id.String()))
+						replaced.Store(true)
+						_ = server.Close()
+					case NoticeRenamed:
+						s.Logger.Warn("servant id is taken, the hub registered the servant with a new id",
+							slog.String("servantId", n.ID.String()))
+					}
+				})
 			}
+		}()
 
-			go s.serve(conn)
+		select {
+		case <-server.CloseChan():
+			if replaced.Load() {
+				return ErrServantReplaced
+			}
+		case <-reconnect:
+			s.Logger.Info("hub asks the servant to reconnect", slog.String("servantId", s.id.String()))
 		}
-	}
+
+		return nil
+	}, nil
 }
 
-func (s *Servant) serve(conn net.Conn) {
+func (s *Servant) yamuxConfig() *yamux.Config {
+	return s.Keepalive.yamuxConfig(s.Logger)
+}
+
+func (s *Servant) serve(conn net.Conn, hubVersion int, onNotice func(*Notice)) {
 	defer func() { _ = conn.Close() }()
 
-	session, err := yamux.Server(conn, nil)
+	header := &StreamHeader{}
+
+	// The hub nodes before the versioning don't send the stream header.
+	if hubVersion > 0 {
+		var err error
+
+		header, err = readMsg[StreamHeader](conn)
+		if err != nil {
+			s.Logger.Error("failed to read stream header", slog.Any("err", err))
+			return
+		}
+
+		if header.Notice != nil {
+			_ = conn.Close()
+			onNotice(header.Notice)
+			return
+		}
+
+		startTunnel(conn, hubVersion)
+	}
+
+	ctx, span := s.Tracer.Start(extractTrace(header.Trace), "Servant.serve", trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("servant.id", s.id.String())))
+	defer span.End()
+
+	session, err := yamux.Server(conn, s.yamuxConfig())
 	if err != nil {
 		s.Logger.Error("failed to create yamux session", slog.Any("err", err))
 		return
 	}
 
+	go s.Keepalive.watchYamux(session, func() {
+		s.Logger.Warn("master stopped responding")
+	})
+
 	tunnel, err := session.Accept()
 	if err != nil {
 		s.Logger.Error("failed to accept tunnel", slog.Any("err", err))
 		return
 	}
 
-	sshConn, channels, _, err := ssh.NewServerConn(tunnel, s.sshConf)
+	sshConn, channels, reqs, err := ssh.NewServerConn(tunnel, s.sshConf)
 	if err != nil {
 		s.Logger.Error("failed to handshake", "err", err)
 		return
 	}
 
+	go s.handleRequests(reqs)
+
+	// The masters before the versioning never reply the keepalive requests.
+	if peerVersion(sshConn.ClientVersion()) > 0 {
+		go s.Keepalive.watchSSH(sshConn, func() {
+			s.Logger.Warn("master stopped responding", slog.String("session-id", hex.EncodeToString(sshConn.SessionID())))
+		})
+	}
+
 	go func() {
 		<-session.CloseChan()
 		s.Logger.Info("master disconnected", slog.String("session-id", hex.EncodeToString(sshConn.SessionID())))
 	}()
 
+	ctx = context.WithValue(ctx, masterPubKeyCtxKey{}, sshConn.Permissions.Extensions[masterPubKeyExtension])
+
 	for newChan := range channels {
-		switch Command(newChan.ChannelType()) {
-		case CommandExec:
-			go s.exec(newChan)
-		case CommandForwardSocks5:
-			go s.forwardSocks5(newChan)
-		case CommandShareDir:
-			go s.shareDir(newChan)
-		}
+		go s.handleChannel(ctx, newChan)
+	}
+}
+
+func (s *Servant) handleChannel(ctx context.Context, newChan ssh.NewChannel) {
+	ctx, span := s.Tracer.Start(ctx, "Servant."+newChan.ChannelType(),
+		trace.WithAttributes(attribute.String("channel.type", newChan.ChannelType())))
+	defer span.End()
+
+	handler, ok := s.handlers.Load(Command(newChan.ChannelType()))
+	if !ok {
+		s.Logger.Warn("reject unknown channel type", slog.String("type", newChan.ChannelType()))
+		_ = newChan.Reject(ssh.UnknownChannelType, "unknown channel type: "+newChan.ChannelType())
+
+		return
 	}
+
+	handler(ctx, newChan)
 }
 
 func (s *Servant) exec(newChan ssh.NewChannel) {
@@ -149,7 +298,8 @@ func (s *Servant) exec(newChan ssh.NewChannel) {
 
 	go func() {
 		for req := range reqs {
-			if req.Type == ExecResizeRequest {
+			switch req.Type {
+			case ExecResizeRequest:
 				var size pty.Winsize
 				err := json.Unmarshal(req.Payload, &size)
 				if err != nil {
@@ -162,8 +312,21 @@ func (s *Servant) exec(newChan ssh.NewChannel) {
 					s.Logger.Error("failed to set terminal size", "err", err)
 					return
 				}
-			} else {
+			case ExecSignalRequest:
+				var sig ssh.Signal
+				err := json.Unmarshal(req.Payload, &sig)
+				if err == nil {
+					err = signalProcess(c.Process, sig)
+				}
+
+				if err != nil {
+					s.Logger.Error("failed to signal process", "signal", sig, "err", err)
+				}
+
+				_ = req.Reply(err == nil, nil)
+			default:
 				s.Logger.Error("unknown exec request type", "req", req.Type)
+				_ = req.Reply(false, nil)
 			}
 		}
 	}()
@@ -175,20 +338,42 @@ func (s *Servant) exec(newChan ssh.NewChannel) {
 	_ = ch.Close()
 }
 
-func (s *Servant) forwardSocks5(newChan ssh.NewChannel) {
+func (s *Servant) forwardSocks5(ctx context.Context, newChan ssh.NewChannel) {
 	ch, _, err := newChan.Accept()
 	if err != nil {
 		s.Logger.Error("failed to accept socks5 channel", "err", err)
 		return
 	}
 
-	tunnel, err := yamux.Server(ch, nil)
+	tunnel, err := yamux.Server(ch, s.yamuxConfig())
 	if err != nil {
 		s.Logger.Error("failed to create yamux session", slog.Any("err", err))
 		return
 	}
 
-	proxy := socks5.NewServer()
+	logger := s.Logger.With(slog.String("master-pubkey", masterPubKey(ctx)))
+
+	proxy := socks5.NewServer(
+		socks5.WithResolver(resolver{s.resolver()}),
+		socks5.WithRule(&socks5Rules{logger, s.ForwardRules}),
+		socks5.WithDialAndRequest(func(ctx context.Context, network, addr string, req *socks5.Request) (net.Conn, error) {
+			conn, err := (&net.Dialer{Resolver: s.resolver()}).DialContext(ctx, network, addr)
+			if err != nil {
+				logger.Warn("socks5 failed to dial", "dest", destAddr(req), "addr", addr, "err", err)
+				return nil, err
+			}
+
+			return newAuditConn(conn, func(sent, received int64, duration time.Duration) {
+				logger.Info("socks5 connection closed",
+					"dest", destAddr(req),
+					"addr", addr,
+					"sent", sent,
+					"received", received,
+					"duration", duration.String(),
+				)
+			}), nil
+		}),
+	)
 
 	for {
 		stream, err := tunnel.AcceptStream()
@@ -207,7 +392,113 @@ func (s *Servant) forwardSocks5(newChan ssh.NewChannel) {
 	}
 }
 
-func (s *Servant) shareDir(newChan ssh.NewChannel) {
+func (s *Servant) resolver() *net.Resolver {
+	if s.Resolver != nil {
+		return s.Resolver
+	}
+
+	return net.DefaultResolver
+}
+
+// shareRoot resolves the real path of the dir and checks it with the [Servant.ShareRoots].
+func (s *Servant) shareRoot(dir string) (string, error) {
+	p, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path: %w", err)
+	}
+
+	p, err = filepath.EvalSymlinks(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve remote directory: %w", err)
+	}
+
+	if len(s.ShareRoots) == 0 {
+		return p, nil
+	}
+
+	for _, root := range s.ShareRoots {
+		root, err := filepath.Abs(root)
+		if err != nil {
+			continue
+		}
+
+		root, err = filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return p, nil
+		}
+	}
+
+	return "", fmt.Errorf("remote directory is not in the allowed roots: %s", dir)
+}
+
+// The time to keep the nfs handler after its last channel is closed,
+// so that the master can still use the file handles after it reconnects.
+const nfsHandlerTTL = 5 * time.Minute
+
+type sharedNFSHandler struct {
+	nfs.Handler
+	refs   int         // The number of the channels that use the handler.
+	expire *time.Timer // Removes the handler once there's no channel using it.
+}
+
+// nfsHandler returns the same handler for the same master and dir, so that the file handles
+// are still valid after the master reconnects. The returned release should be called when the channel is closed,
+// the handler is removed after the [nfsHandlerTTL] if no other channel uses it.
+func (s *Servant) nfsHandler(ctx context.Context, root string, readOnly bool, cacheLimit int) (nfs.Handler, func()) {
+	key := fmt.Sprintf("%s %t %d %s", masterPubKey(ctx), readOnly, cacheLimit, root)
+
+	s.nfsLock.Lock()
+	defer s.nfsLock.Unlock()
+
+	h, has := s.nfsHandlers[key]
+	if !has {
+		bfs := osfsx.New(osfs.New(root, osfs.WithBoundOS()))
+		if readOnly {
+			bfs = osfsx.ReadOnly(bfs)
+		}
+
+		h = &sharedNFSHandler{Handler: nfshelper.NewCachingHandler(nfshelper.NewNullAuthHandler(bfs), cacheLimit)}
+
+		if s.nfsHandlers == nil {
+			s.nfsHandlers = map[string]*sharedNFSHandler{}
+		}
+
+		s.nfsHandlers[key] = h
+	}
+
+	if h.expire != nil {
+		h.expire.Stop()
+		h.expire = nil
+	}
+
+	h.refs++
+
+	return h.Handler, func() {
+		s.nfsLock.Lock()
+		defer s.nfsLock.Unlock()
+
+		h.refs--
+		if h.refs > 0 {
+			return
+		}
+
+		h.expire = time.AfterFunc(nfsHandlerTTL, func() {
+			s.nfsLock.Lock()
+			defer s.nfsLock.Unlock()
+
+			if h.refs == 0 && s.nfsHandlers[key] == h {
+				delete(s.nfsHandlers, key)
+			}
+		})
+	}
+}
+
+func (s *Servant) shareDir(ctx context.Context, newChan ssh.NewChannel) {
 	var meta MountDirMeta
 	err := json.Unmarshal(newChan.ExtraData(), &meta)
 	if err != nil {
@@ -215,29 +506,33 @@ func (s *Servant) shareDir(newChan ssh.NewChannel) {
 		return
 	}
 
+	root, err := s.shareRoot(meta.Path)
+	if err != nil {
+		_ = newChan.Reject(ShareDirDenied, err.Error())
+		return
+	}
+
 	ch, _, err := newChan.Accept()
 	if err != nil {
 		s.Logger.Error("failed to accept ShareDir channel", "err", err)
 		return
 	}
 
-	tunnel, err := yamux.Server(ch, nil)
+	tunnel, err := yamux.Server(ch, s.yamuxConfig())
 	if err != nil {
 		s.Logger.Error("failed to create yamux session", "err", err)
+		return
 	}
 
-	if _, err := os.Stat(meta.Path); os.IsNotExist(err) {
-		s.Logger.Error("remote directory does not exist", "path", meta.Path, "err", err)
-	}
+	readOnly := meta.ReadOnly || s.ShareReadOnly
 
-	bfs := osfs.New(meta.Path, osfs.WithBoundOS())
-	bfsPlusChange := osfsx.New(bfs)
+	s.Logger.Info("share dir", "path", root, "read-only", readOnly)
 
-	handler := nfshelper.NewNullAuthHandler(bfsPlusChange)
-	cacheHelper := nfshelper.NewCachingHandler(handler, meta.CacheLimit)
+	handler, release := s.nfsHandler(ctx, root, readOnly, meta.CacheLimit)
+	defer release()
 
 	nfs.Log.SetLevel(-1) // disable log
-	err = nfs.Serve(tunnel, cacheHelper)
+	err = nfs.Serve(tunnel, handler)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
 			return
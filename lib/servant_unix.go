@@ -0,0 +1,43 @@
+//go:build !windows
+
+package dehub
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var signals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT,
+	ssh.SIGALRM: syscall.SIGALRM,
+	ssh.SIGFPE:  syscall.SIGFPE,
+	ssh.SIGHUP:  syscall.SIGHUP,
+	ssh.SIGILL:  syscall.SIGILL,
+	ssh.SIGINT:  syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL,
+	ssh.SIGPIPE: syscall.SIGPIPE,
+	ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV,
+	ssh.SIGTERM: syscall.SIGTERM,
+	ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// The process started by pty is a session leader,
+// like a terminal, the signal is sent to its whole process group.
+func signalProcess(p *os.Process, sig ssh.Signal) error {
+	s, ok := signals[sig]
+	if !ok {
+		return fmt.Errorf("unknown signal: %s", sig)
+	}
+
+	err := syscall.Kill(-p.Pid, s)
+	if err != nil {
+		return fmt.Errorf("failed to send signal: %w", err)
+	}
+
+	return nil
+}
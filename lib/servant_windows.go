@@ -0,0 +1,24 @@
+//go:build windows
+
+package dehub
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Windows has no signals for processes, only the kill is supported.
+func signalProcess(p *os.Process, sig ssh.Signal) error {
+	if sig != ssh.SIGKILL {
+		return fmt.Errorf("unsupported signal on windows: %s", sig)
+	}
+
+	err := p.Kill()
+	if err != nil {
+		return fmt.Errorf("failed to kill process: %w", err)
+	}
+
+	return nil
+}
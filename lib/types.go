@@ -1,12 +1,21 @@
 package dehub
 
 import (
+	"context"
 	"crypto/md5"
+	"errors"
 	"log/slog"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/creack/pty"
-	"github.com/hashicorp/yamux"
+	"github.com/quic-go/quic-go"
+	"github.com/ysmood/dehub/lib/hubdb"
 	"github.com/ysmood/dehub/lib/xsync"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -14,13 +23,76 @@ type ServantID string
 
 type Hub struct {
 	Logger *slog.Logger
-	list   xsync.Map[ServantID, *yamux.Session]
+	Tracer trace.Tracer
+	list   xsync.Map[ServantID, *servantSession]
 	DB     DB
 	addr   string // The net address of the hub node relay.
+	relay  net.Listener
+
+	// RelayQUIC makes the relay also listen the udp port of the same number for QUIC,
+	// the other hub nodes will relay the master sessions as the streams of a shared QUIC connection.
+	// All the hub nodes of the cluster should be upgraded before it's enabled.
+	RelayQUIC bool
+
+	relayQUIC      net.Listener
+	relayConnsLock sync.Mutex
+	relayConns     map[string]quic.Connection
+
+	// Duplicate is the policy when a servant connects with an id that is already connected to the hub node.
+	Duplicate DuplicatePolicy
 
 	GetIP func() (string, error)
+
+	// Keepalive of the connections to the servants, a dead servant is removed from the DB once detected.
+	Keepalive Keepalive
+
+	lock     sync.Mutex
+	sessions sync.WaitGroup // The in-flight master sessions.
+	closing  chan struct{}  // Closed when the hub starts to shut down.
+	kill     chan struct{}  // Closed when the in-flight master sessions should be closed forcibly.
+}
+
+// ErrHubShutdown is returned when the hub node is shutting down.
+var ErrHubShutdown = errors.New("hub is shutting down")
+
+// ErrDuplicateServant is returned when the servant id is taken and the [DuplicateReject] policy is used.
+var ErrDuplicateServant = errors.New("servant id is already connected")
+
+// ErrServantReplaced is returned by [Servant.Run] when the servant is replaced by another servant with the same id.
+var ErrServantReplaced = errors.New("servant is replaced by another servant with the same id")
+
+// ErrNoExec is returned when there's no running exec to signal.
+var ErrNoExec = errors.New("no running exec")
+
+// ErrSignalRejected is returned when the servant failed to signal the process.
+var ErrSignalRejected = errors.New("servant failed to signal the process")
+
+// The max time to wait for the servant to handle a notice before its tunnel is closed.
+const noticeTimeout = 3 * time.Second
+
+type servantSession struct {
+	token   string // Unique for each servant connection.
+	tunnel  muxSession
+	version int         // The [ProtocolVersion] of the servant.
+	moved   atomic.Bool // The servant has moved to another hub node.
 }
 
+type DuplicatePolicy string
+
+const (
+	// DuplicateReject rejects the new servant.
+	DuplicateReject DuplicatePolicy = "reject"
+
+	// DuplicateReplace closes the old servant after notifying it, the new servant takes its place.
+	// The old servant gets [ErrServantReplaced] from [Servant.Run] and should stop reconnecting,
+	// otherwise two live servants with the same id will keep replacing each other.
+	DuplicateReplace DuplicatePolicy = "replace"
+
+	// DuplicateSuffix registers the new servant with a random suffix appended to its id,
+	// the servant will be notified with the new id.
+	DuplicateSuffix DuplicatePolicy = "suffix"
+)
+
 type ClientType int
 
 const (
@@ -29,7 +101,59 @@ const (
 )
 
 type HubHeader struct {
-	Type ClientType
+	Type  ClientType
+	ID    ServantID
+	Trace propagation.MapCarrier
+
+	// Version is the [ProtocolVersion] of the client, it's 0 for the clients before the versioning.
+	Version int
+}
+
+// RelayHeader is sent from the hub node that the master connected to,
+// to the relay of the hub node that the servant connected to.
+// The relays before the versioning only read the bare [ServantID], see [VersionedLocator].
+type RelayHeader struct {
+	ID    ServantID
+	Trace propagation.MapCarrier
+
+	// Version is the [ProtocolVersion] of the hub node that dials the relay.
+	Version int
+}
+
+// Ack is the reply to the [HubHeader], [RelayHeader], and [StreamHeader].
+// It's sent as an empty string to the peers before the versioning, and a non-empty string is an error message.
+type Ack struct {
+	// Version is the [ProtocolVersion] of the replier.
+	Version int
+
+	Error string
+}
+
+// StreamHeader is sent from the hub to the servant at the start of each master stream,
+// if both of them have a [ProtocolVersion] greater than 0.
+type StreamHeader struct {
+	Trace propagation.MapCarrier
+
+	// Notice is set when the stream is only used to notify the servant, no master session follows.
+	Notice *Notice
+}
+
+type NoticeType int
+
+const (
+	// NoticeReconnect tells the servant that the hub node is shutting down,
+	// the servant should reconnect to another hub node.
+	NoticeReconnect NoticeType = iota
+
+	// NoticeReplaced tells the servant that another servant with the same id has taken its place.
+	NoticeReplaced
+
+	// NoticeRenamed tells the servant the id that the hub registered it as.
+	NoticeRenamed
+)
+
+type Notice struct {
+	Type NoticeType
 	ID   ServantID
 }
 
@@ -40,15 +164,76 @@ type DB interface {
 	DeleteLocation(id string) error
 }
 
+// VersionedLocator is an optional interface of [DB].
+// If the DB implements it, a hub node stores its [ProtocolVersion] with the locations of its servants,
+// so that the other hub nodes only send the [RelayHeader] to the relays that understand it.
+// The locations stored by the hub nodes before the versioning should be loaded as version 0.
+type VersionedLocator interface {
+	StoreVersionedLocation(id string, netAddr string, version int) error
+	LoadVersionedLocation(idPrefix string) (netAddr string, id string, version int, err error)
+}
+
+// MoveWatcher is an optional interface of [DB].
+// If the DB implements it, a hub node closes its stale session of a servant
+// once the servant is stored with the location of another hub node.
+type MoveWatcher interface {
+	WatchMoves(ctx context.Context) (<-chan hubdb.Move, error)
+}
+
 type Master struct {
-	Logger    *slog.Logger
-	servantID ServantID
-	sshConf   *ssh.ClientConfig
-	sshConn   ssh.Conn
+	Logger *slog.Logger
+	Tracer trace.Tracer
+
+	// Keepalive of the connection to the servant.
+	Keepalive Keepalive
+
+	servantID    ServantID
+	servantKey   atomic.Pointer[[]byte] // The servant key trusted at the first connect, it's pinned for the reconnects.
+	sshConf      *ssh.ClientConfig
+	sshConn      atomic.Pointer[masterConn]
+	execs        xsync.Map[ssh.Channel, struct{}] // The running exec channels.
+	reconnecting atomic.Bool                      // The [Master.KeepConnected] is running.
+	closed       atomic.Bool                      // The [Master.Close] is called.
+}
+
+type masterConn struct {
+	ssh.Conn
+	info ServantInfo
+	dead atomic.Bool // The servant stopped responding to the keepalive.
+
+	// next is closed once the connection is replaced by a reconnect, or the [Master.KeepConnected] stopped.
+	next     chan struct{}
+	nextOnce sync.Once
 }
 
 type Servant struct {
-	Logger  *slog.Logger
+	Logger *slog.Logger
+	Tracer trace.Tracer
+
+	// LogTap enables the masters to subscribe to the logs of the host process.
+	LogTap *LogTap
+
+	// ForwardRules restricts the destinations of the forwarding, nil allows all.
+	ForwardRules *ForwardRules
+
+	// Resolver resolves the domain names for the forwarding, defaults to [net.DefaultResolver].
+	Resolver *net.Resolver
+
+	// ShareRoots limits the directories that the masters can share, empty allows all.
+	// A directory is allowed if it's one of the roots or inside one of them after the symlinks are resolved.
+	ShareRoots []string
+
+	// ShareReadOnly makes all the shared directories read-only, no matter what the masters request.
+	ShareReadOnly bool
+
+	// Keepalive of the connections to the hub and masters.
+	Keepalive Keepalive
+
+	exposed     xsync.Map[string, func() any]
+	nfsLock     sync.Mutex
+	nfsHandlers map[string]*sharedNFSHandler
+	handlers    xsync.Map[Command, func(context.Context, ssh.NewChannel)] // The channel handlers of the commands.
+
 	id      ServantID
 	sshConf *ssh.ServerConfig
 }
@@ -68,9 +253,88 @@ type ExecMeta struct {
 	Args []string
 }
 
+// DefaultNFSCacheLimit is the default [MountDirMeta.CacheLimit].
+const DefaultNFSCacheLimit = 2048
+
 type MountDirMeta struct {
-	Path       string
+	Path string
+
+	// CacheLimit is the number of the file handles that the servant caches for the nfs server,
+	// the nfs client gets stale handle errors for the files that are evicted from the cache.
 	CacheLimit int
+
+	// ReadOnly rejects all the changes to the directory.
+	ReadOnly bool
+}
+
+// ProfileType is the name of a runtime profile, such as the ones from [runtime/pprof.Lookup], plus cpu and trace.
+type ProfileType string
+
+const (
+	ProfileCPU       ProfileType = "cpu"
+	ProfileHeap      ProfileType = "heap"
+	ProfileAllocs    ProfileType = "allocs"
+	ProfileGoroutine ProfileType = "goroutine"
+	ProfileMutex     ProfileType = "mutex"
+	ProfileBlock     ProfileType = "block"
+	ProfileTrace     ProfileType = "trace" // The execution trace for "go tool trace".
+)
+
+type ProfileMeta struct {
+	Type ProfileType
+
+	// Duration to collect the cpu profile, execution trace, or the samples of mutex and block profiles.
+	Duration time.Duration
+}
+
+// DebugMeta selects the Delve debugger server on the servant side.
+type DebugMeta struct {
+	// Addr of an already-running headless Delve server, such as "127.0.0.1:2345".
+	// If set, the other fields are ignored.
+	Addr string
+
+	// PID of the process to attach, 0 means the servant process itself.
+	PID int
+
+	// Dlv is the path of the dlv executable, defaults to the one in PATH.
+	Dlv string
+}
+
+type LogTapMeta struct {
+	// Level is the min level of the records to receive.
+	Level slog.Level
+
+	// Match filters the records by the attributes, the nested groups are joined with dot, such as "req.id".
+	Match map[string]string
+
+	// Raise lowers the log level of the host process to the Level until the master disconnects.
+	Raise bool
+}
+
+type VarsMeta struct {
+	// Pattern filters the variables by name, the syntax is the same as [path.Match], defaults to all.
+	Pattern string
+
+	// Interval to watch the variables, zero means only once.
+	Interval time.Duration
+}
+
+type ProcessMeta struct {
+	// PID of the process to inspect, 0 means to list all the processes.
+	PID int
+}
+
+type ForwardUDPMeta struct {
+	// Addr of the remote udp endpoint on the servant side, such as "10.0.0.10:53".
+	Addr string
+}
+
+type SyncMeta struct {
+	// Path of the directory on the servant side.
+	Path string
+
+	// ReadOnly rejects all the changes to the directory.
+	ReadOnly bool
 }
 
 type Command string
@@ -79,10 +343,21 @@ const (
 	CommandExec          Command = "exec"
 	CommandForwardSocks5 Command = "forward-socks5"
 	CommandShareDir      Command = "share-dir"
+	CommandProfile       Command = "profile"
+	CommandDebug         Command = "debug"
+	CommandLogTap        Command = "log-tap"
+	CommandVars          Command = "vars"
+	CommandProcess       Command = "process"
+	CommandDiag          Command = "diag"
+	CommandForwardUDP    Command = "forward-udp"
+	CommandSync          Command = "sync"
 )
 
 const ExecResizeRequest = "resize"
 
+// ExecSignalRequest sends a signal to the process of the exec channel, the payload is the JSON of a [ssh.Signal].
+const ExecSignalRequest = "signal"
+
 type Logger interface {
 	Info(string, ...slog.Attr)
 	Warn(string, ...slog.Attr)
@@ -92,4 +367,11 @@ type Logger interface {
 const (
 	UnmarshalMetaFailed ssh.RejectionReason = iota + ssh.ResourceShortage + 1000
 	FailedStartPTY
+	FailedProfile
+	FailedStartDebugger
+	NoLogTap
+	FailedReadProcess
+	ForwardDenied
+	FailedDialRemote
+	ShareDirDenied
 )
@@ -0,0 +1,252 @@
+package dehub
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// UDPIdleTimeout is the duration that a udp session can be idle before it's closed.
+const UDPIdleTimeout = 2 * time.Minute
+
+// The max size of a udp datagram.
+const maxDatagramSize = 65535
+
+// ForwardUDP relays the datagrams received on the conn to the remote address on the servant side,
+// such as "10.0.0.10:53". Each local peer gets its own session on the servant side,
+// so that the replies are sent back to the right peer.
+// A session is closed after it's idle for [UDPIdleTimeout].
+func (m *Master) ForwardUDP(conn net.PacketConn, remote string) error {
+	meta, err := json.Marshal(ForwardUDPMeta{Addr: remote})
+	if err != nil {
+		return fmt.Errorf("failed to marshal ForwardUDPMeta: %w", err)
+	}
+
+	lock := sync.Mutex{}
+	sessions := map[string]*udpSession{}
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read udp datagram: %w", err)
+		}
+
+		lock.Lock()
+		session, has := sessions[addr.String()]
+		lock.Unlock()
+
+		if !has {
+			ch, err := m.OpenChannel(CommandForwardUDP, meta)
+			if err != nil {
+				m.Logger.Error("failed to open udp channel", "err", err)
+				continue
+			}
+
+			m.Logger.Info("udp session", "peer", addr.String())
+
+			session = newUDPSession(ch)
+
+			lock.Lock()
+			sessions[addr.String()] = session
+			lock.Unlock()
+
+			go func() {
+				session.copyTo(conn, addr)
+
+				lock.Lock()
+				delete(sessions, addr.String())
+				lock.Unlock()
+			}()
+		}
+
+		err = session.write(buf[:n])
+		if err != nil {
+			m.Logger.Error("failed to write udp datagram", "err", err)
+		}
+	}
+}
+
+type udpSession struct {
+	ch   ssh.Channel
+	idle *time.Timer
+}
+
+func newUDPSession(ch ssh.Channel) *udpSession {
+	return &udpSession{
+		ch:   ch,
+		idle: time.AfterFunc(UDPIdleTimeout, func() { _ = ch.Close() }),
+	}
+}
+
+func (s *udpSession) write(b []byte) error {
+	s.idle.Reset(UDPIdleTimeout)
+	return writeDatagram(s.ch, b)
+}
+
+// copyTo sends the replies from the servant to the peer until the session is closed.
+func (s *udpSession) copyTo(conn net.PacketConn, addr net.Addr) {
+	defer func() { _ = s.ch.Close() }()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, err := readDatagram(s.ch, buf)
+		if err != nil {
+			return
+		}
+
+		s.idle.Reset(UDPIdleTimeout)
+
+		_, err = conn.WriteTo(buf[:n], addr)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *Servant) forwardUDP(ctx context.Context, newChan ssh.NewChannel) {
+	var meta ForwardUDPMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	logger := s.Logger.With(slog.String("master-pubkey", masterPubKey(ctx)))
+
+	addr, err := s.checkForward(ctx, meta.Addr)
+	if err != nil {
+		logger.Warn("udp destination denied", "dest", meta.Addr, "err", err)
+		_ = newChan.Reject(ForwardDenied, err.Error())
+		return
+	}
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		_ = newChan.Reject(FailedDialRemote, err.Error())
+		return
+	}
+
+	dst := newAuditConn(conn, func(sent, received int64, duration time.Duration) {
+		logger.Info("udp session closed",
+			"dest", meta.Addr,
+			"addr", addr,
+			"sent", sent,
+			"received", received,
+			"duration", duration.String(),
+		)
+	})
+
+	defer func() { _ = dst.Close() }()
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept udp channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+
+		for {
+			n, err := readDatagram(ch, buf)
+			if err != nil {
+				_ = dst.Close()
+				return
+			}
+
+			_, _ = dst.Write(buf[:n])
+		}
+	}()
+
+	buf := make([]byte, maxDatagramSize)
+
+	for {
+		n, err := dst.Read(buf)
+		if err != nil {
+			// Such as the "connection refused" caused by the icmp unreachable of a previous datagram.
+			if !errors.Is(err, net.ErrClosed) {
+				continue
+			}
+
+			return
+		}
+
+		err = writeDatagram(ch, buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// checkForward resolves the addr and checks it with the [Servant.ForwardRules],
+// it returns the resolved address to dial.
+func (s *Servant) checkForward(ctx context.Context, addr string) (string, error) {
+	host, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid address: %w", err)
+	}
+
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return "", fmt.Errorf("invalid port: %w", err)
+	}
+
+	ip := net.ParseIP(host)
+	domain := ""
+
+	if ip == nil {
+		domain = host
+
+		_, ip, err = resolver{s.resolver()}.Resolve(ctx, host)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if !s.ForwardRules.Allowed(domain, ip, port) {
+		return "", fmt.Errorf("destination is not allowed: %s", addr)
+	}
+
+	return net.JoinHostPort(ip.String(), p), nil
+}
+
+// writeDatagram frames the datagram with a 2-byte big-endian length prefix.
+func writeDatagram(w io.Writer, b []byte) error {
+	frame := make([]byte, 2+len(b)) //nolint: mnd
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+
+	_, err := w.Write(frame)
+
+	return err
+}
+
+func readDatagram(r io.Reader, buf []byte) (int, error) {
+	var size [2]byte
+
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return 0, err
+	}
+
+	return io.ReadFull(r, buf[:binary.BigEndian.Uint16(size[:])])
+}
@@ -2,18 +2,84 @@ package dehub
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 
 	"github.com/gobwas/ws"
 	"github.com/ysmood/byframe"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 )
 
-func startTunnel(conn io.Writer) {
-	writeMsg(conn, "")
+// TracerName is the instrumentation scope name of the spans created by dehub.
+const TracerName = "github.com/ysmood/dehub"
+
+// The propagator is fixed so that the trace can cross the hops
+// even if the global propagator is not set by the user.
+var tracePropagator = propagation.TraceContext{}
+
+// The returned tracer is a no-op until a tracer provider is set via [otel.SetTracerProvider].
+func defaultTracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+func injectTrace(ctx context.Context) propagation.MapCarrier {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	return carrier
+}
+
+func extractTrace(carrier propagation.MapCarrier) context.Context {
+	return tracePropagator.Extract(context.Background(), carrier)
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// startTunnel acks the header of the peer, the peers before the versioning only understand the empty string.
+func startTunnel(conn io.Writer, peerVersion int) {
+	if peerVersion == 0 {
+		writeMsg(conn, "")
+		return
+	}
+
+	writeMsg(conn, &Ack{Version: ProtocolVersion})
+}
+
+// readAck reads the ack written by [startTunnel], or the error message of the peer.
+func readAck(conn io.Reader) (*Ack, error) {
+	raw, err := readMsg[json.RawMessage](conn)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg string
+	if json.Unmarshal(*raw, &msg) == nil {
+		return &Ack{Error: msg}, nil
+	}
+
+	var ack Ack
+
+	err = json.Unmarshal(*raw, &ack)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal ack: %w", err)
+	}
+
+	return &ack, nil
 }
 
 func writeMsg(conn io.Writer, msg any) {
@@ -25,19 +91,54 @@ func writeMsg(conn io.Writer, msg any) {
 	_, _ = conn.Write(byframe.Encode(b))
 }
 
+// The max size of a message frame, the messages are small headers, the limit prevents
+// a bad peer from making the reader allocate a huge buffer.
+const maxMsgSize = 1 << 20
+
+// ErrMsgTooLarge is returned when the size of a message from the peer exceeds the limit.
+var ErrMsgTooLarge = errors.New("message is too large")
+
+// readMsg reads exactly one frame from the conn,
+// the data after the frame is left unread for the next reader of the conn.
 func readMsg[T any](conn io.Reader) (*T, error) {
-	s := byframe.NewScanner(conn)
+	header := []byte{}
+	b := make([]byte, 1)
+
+	var size int
+
+	for {
+		_, err := io.ReadFull(conn, b)
+		if err != nil {
+			return nil, err
+		}
+
+		header = append(header, b[0])
+
+		l, _, sufficient := byframe.DecodeHeader(header)
+		if sufficient {
+			size = l
+			break
+		}
+
+		if len(header) >= len(byframe.EncodeHeader(maxMsgSize)) {
+			return nil, ErrMsgTooLarge
+		}
+	}
+
+	if size > maxMsgSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMsgTooLarge, size)
+	}
 
-	s.Scan()
+	frame := make([]byte, size)
 
-	err := s.Err()
+	_, err := io.ReadFull(conn, frame)
 	if err != nil {
 		return nil, err
 	}
 
 	var msg T
 
-	err = json.Unmarshal(s.Frame(), &msg)
+	err = json.Unmarshal(frame, &msg)
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +146,17 @@ func readMsg[T any](conn io.Reader) (*T, error) {
 	return &msg, nil
 }
 
+func randomToken() (string, error) {
+	b := make([]byte, 16) //nolint: mnd
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate token: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
 func WebsocketUpgrade(conn io.ReadWriter) error {
 	_, err := ws.Upgrade(conn)
 	return err
@@ -1,14 +1,31 @@
 package utils
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"net"
 	"os"
 	"os/exec"
+	"runtime"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
-func MountNFS(addr *net.TCPAddr, localDir string) error {
+// DefaultNFSOptions of the kernel nfs client, the soft mount makes the file operations fail with timeout
+// instead of hanging forever when the servant disappears.
+func DefaultNFSOptions() string {
+	if runtime.GOOS == "darwin" {
+		return "vers=3,nolocks,soft,timeo=50,retrans=2,actimeo=1"
+	}
+
+	return "vers=3,nolock,soft,timeo=50,retrans=2,actimeo=1"
+}
+
+// MountNFS mounts the nfs server at the addr to the localDir with the mount options,
+// such as "vers=3,nolock,soft", the port options are always set to the port of the addr.
+func MountNFS(addr *net.TCPAddr, localDir string, options string) error {
 	err := os.MkdirAll(localDir, 0o755) //nolint: mnd
 	if err != nil {
 		return fmt.Errorf("failed to create mount directory: %w", err)
@@ -25,10 +42,13 @@ func MountNFS(addr *net.TCPAddr, localDir string) error {
 
 	port := strconv.Itoa(addr.Port)
 
-	_ = exec.Command("umount", "-f", localDir).Run()
+	opts := fmt.Sprintf("port=%s,mountport=%s", port, port)
+	if options != "" {
+		opts += "," + options
+	}
 
 	out, err := exec.Command("mount",
-		"-o", fmt.Sprintf("port=%s,mountport=%s", port, port),
+		"-o", opts,
 		"-t", "nfs",
 		"127.0.0.1:",
 		localDir,
@@ -48,3 +68,94 @@ func UnmountNFS(localDir string) error {
 
 	return nil
 }
+
+// IsStaleMount reports whether the dir is a mount point whose server is gone.
+func IsStaleMount(dir string) bool {
+	_, err := os.Stat(dir)
+
+	return errors.Is(err, syscall.ENOTCONN) || errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ETIMEDOUT)
+}
+
+// ForceUnmount detaches the mount point even if the server is gone.
+func ForceUnmount(dir string) error {
+	var cmds [][]string
+
+	switch runtime.GOOS {
+	case "linux":
+		cmds = [][]string{{"umount", "-f", "-l", dir}, {"fusermount", "-u", "-z", dir}}
+	default:
+		cmds = [][]string{{"umount", "-f", dir}}
+	}
+
+	var errs []error
+
+	for _, args := range cmds {
+		out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, fmt.Errorf("%s: %w: %s", args[0], err, strings.TrimSpace(string(out))))
+	}
+
+	return fmt.Errorf("failed to unmount: %w", errors.Join(errs...))
+}
+
+// Mounts lists the mount points created by dehub, either the FUSE or the kernel nfs ones.
+// It only works on linux, it returns nil on other platforms.
+func Mounts() ([]string, error) {
+	f, err := os.Open("/proc/self/mounts")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+
+		return nil, fmt.Errorf("failed to open mount table: %w", err)
+	}
+
+	defer func() { _ = f.Close() }()
+
+	list := []string{}
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 { //nolint: mnd
+			continue
+		}
+
+		src, dir, typ := fields[0], unescapeMount(fields[1]), fields[2]
+
+		if typ == "fuse.dehub" || (strings.HasPrefix(typ, "nfs") && strings.HasPrefix(src, "127.0.0.1:")) {
+			list = append(list, dir)
+		}
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %w", err)
+	}
+
+	return list, nil
+}
+
+// unescapeMount decodes the octal escapes such as "\040" for space in the mount table.
+func unescapeMount(s string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if n, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+
+				continue
+			}
+		}
+
+		b.WriteByte(s[i])
+	}
+
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package dehub
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"path"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Expose registers a value for the masters to inspect via [Master.Vars], the fn is called on each inspection,
+// its result is marshaled as JSON. The expvar variables of the host process are always exposed.
+func (s *Servant) Expose(name string, fn func() any) {
+	s.exposed.Store(name, fn)
+}
+
+// Vars writes the variables of the servant host process to the out as JSON lines, one object per line.
+// If the meta.Interval is zero, only one line is written, or it keeps watching until the connection is closed.
+func (m *Master) Vars(out io.Writer, meta VarsMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal VarsMeta: %w", err)
+	}
+
+	ch, err := m.OpenChannel(CommandVars, b)
+	if err != nil {
+		return fmt.Errorf("failed to open vars channel: %w", err)
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	_, err = io.Copy(out, ch)
+	if err != nil {
+		return fmt.Errorf("failed to read vars: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Servant) vars(newChan ssh.NewChannel) {
+	var meta VarsMeta
+	err := json.Unmarshal(newChan.ExtraData(), &meta)
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, err.Error())
+		return
+	}
+
+	if meta.Pattern == "" {
+		meta.Pattern = "*"
+	}
+
+	_, err = path.Match(meta.Pattern, "")
+	if err != nil {
+		_ = newChan.Reject(UnmarshalMetaFailed, fmt.Sprintf("invalid vars pattern: %s", err))
+		return
+	}
+
+	ch, _, err := newChan.Accept()
+	if err != nil {
+		s.Logger.Error("failed to accept vars channel", "err", err)
+		return
+	}
+
+	defer func() { _ = ch.Close() }()
+
+	closed := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(io.Discard, ch)
+		close(closed)
+	}()
+
+	for {
+		b, err := json.Marshal(s.collectVars(meta.Pattern))
+		if err != nil {
+			s.Logger.Error("failed to marshal vars", "err", err)
+			return
+		}
+
+		_, err = ch.Write(append(b, '\n'))
+		if err != nil || meta.Interval <= 0 {
+			return
+		}
+
+		select {
+		case <-closed:
+			return
+		case <-time.After(meta.Interval):
+		}
+	}
+}
+
+// The exposed values take precedence over the expvar ones with the same name.
+func (s *Servant) collectVars(pattern string) map[string]json.RawMessage {
+	vars := map[string]json.RawMessage{}
+
+	expvar.Do(func(kv expvar.KeyValue) {
+		if ok, _ := path.Match(pattern, kv.Key); ok {
+			vars[kv.Key] = json.RawMessage(kv.Value.String())
+		}
+	})
+
+	s.exposed.Range(func(name string, fn func() any) bool {
+		if ok, _ := path.Match(pattern, name); !ok {
+			return true
+		}
+
+		b, err := json.Marshal(fn())
+		if err != nil {
+			b, _ = json.Marshal(fmt.Sprintf("failed to marshal: %s", err))
+		}
+
+		vars[name] = b
+
+		return true
+	})
+
+	return vars
+}
@@ -0,0 +1,174 @@
+package dehub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ProtocolVersion of dehub, it's increased when the protocol between the master, hub, and servant changes.
+// Version 0 is the protocol before the versioning, it doesn't send the version.
+const ProtocolVersion = 1
+
+// ServantInfoRequest is the ssh global request that the master sends after the handshake to get the [ServantInfo].
+const ServantInfoRequest = "servant-info@dehub"
+
+// ServantInfo is the protocol version and capabilities of a servant.
+type ServantInfo struct {
+	Version int
+
+	// Commands that the servant can handle.
+	Commands []Command
+}
+
+// The prefix of the ssh version string of the servant and master, the [ProtocolVersion] follows it.
+// The ones before the versioning use the default version string of the ssh lib.
+const sshVersionPrefix = "SSH-2.0-dehub_v"
+
+// The commands of the servants before the versioning, they never read the ssh global requests,
+// so the [ServantInfoRequest] must not be sent to them.
+var legacyCommands = []Command{CommandExec, CommandForwardSocks5, CommandShareDir}
+
+// ErrUnsupportedCommand is returned when the servant doesn't support the command, usually it needs an upgrade.
+var ErrUnsupportedCommand = errors.New("command is not supported by the servant")
+
+// Supports returns true if the servant can handle the cmd.
+func (i ServantInfo) Supports(cmd Command) bool {
+	return slices.Contains(i.Commands, cmd)
+}
+
+// ServantInfo returns the info of the servant that the master currently connects to,
+// it's empty before the [Master.Connect] succeeds.
+func (m *Master) ServantInfo() ServantInfo {
+	c := m.conn()
+	if c == nil {
+		return ServantInfo{}
+	}
+
+	return c.info
+}
+
+// sshVersion is the ssh version string of the servant and master that carries the [ProtocolVersion].
+func sshVersion() string {
+	return sshVersionPrefix + strconv.Itoa(ProtocolVersion)
+}
+
+// peerVersion parses the [ProtocolVersion] from the ssh version string of the peer,
+// it returns 0 for the peers before the versioning.
+func peerVersion(sshVersion []byte) int {
+	v, ok := strings.CutPrefix(string(sshVersion), sshVersionPrefix)
+	if !ok {
+		return 0
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+
+	return n
+}
+
+// requestInfo of the servant, the version is known from the ssh handshake,
+// so the request is only sent to the servants that can reply it.
+func (m *Master) requestInfo(conn ssh.Conn) (ServantInfo, error) {
+	version := peerVersion(conn.ServerVersion())
+	if version == 0 {
+		m.Logger.Warn("the servant doesn't support the protocol versioning, upgrade the servant to use all the features",
+			slog.Int("masterVersion", ProtocolVersion))
+
+		return ServantInfo{Version: 0, Commands: legacyCommands}, nil
+	}
+
+	ok, payload, err := conn.SendRequest(ServantInfoRequest, true, nil)
+	if err != nil {
+		return ServantInfo{}, fmt.Errorf("failed to request servant info: %w", err)
+	}
+
+	if !ok {
+		return ServantInfo{}, fmt.Errorf("servant rejected the info request, version %d", version)
+	}
+
+	var info ServantInfo
+
+	err = json.Unmarshal(payload, &info)
+	if err != nil {
+		return ServantInfo{}, fmt.Errorf("failed to unmarshal servant info: %w", err)
+	}
+
+	if info.Version < ProtocolVersion {
+		m.Logger.Warn("the servant uses an older dehub protocol, upgrade the servant to use all the features",
+			slog.Int("servantVersion", info.Version), slog.Int("masterVersion", ProtocolVersion))
+	}
+
+	return info, nil
+}
+
+// OpenChannel opens the channel of the cmd on the servant, such as a custom command registered by [Servant.Handle].
+// The channel requests from the servant are discarded.
+// It returns [ErrUnsupportedCommand] if the servant doesn't handle the cmd.
+func (m *Master) OpenChannel(cmd Command, meta []byte) (ssh.Channel, error) {
+	c := m.conn()
+
+	// The servants of version 0 never respond to an unknown channel type, fail early instead of waiting forever.
+	if c.info.Version == 0 && !c.info.Supports(cmd) {
+		return nil, fmt.Errorf("%w: %s, the servant protocol version is %d, upgrade the servant to version %d",
+			ErrUnsupportedCommand, cmd, c.info.Version, ProtocolVersion)
+	}
+
+	ch, reqs, err := c.OpenChannel(cmd.String(), meta)
+	if err != nil {
+		var openErr *ssh.OpenChannelError
+		if errors.As(err, &openErr) && openErr.Reason == ssh.UnknownChannelType {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedCommand, cmd)
+		}
+
+		return nil, err
+	}
+
+	go ssh.DiscardRequests(reqs)
+
+	return ch, nil
+}
+
+// info of the servant for the [ServantInfoRequest].
+func (s *Servant) info() ServantInfo {
+	cmds := []Command{}
+
+	s.handlers.Range(func(cmd Command, _ func(context.Context, ssh.NewChannel)) bool {
+		cmds = append(cmds, cmd)
+		return true
+	})
+
+	slices.Sort(cmds)
+
+	return ServantInfo{Version: ProtocolVersion, Commands: cmds}
+}
+
+// handleRequests replies the global requests from the master, the unknown ones are replied false,
+// which is also how the keepalive requests are replied.
+func (s *Servant) handleRequests(reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case ServantInfoRequest:
+			b, err := json.Marshal(s.info())
+			if err != nil {
+				_ = req.Reply(false, nil)
+				continue
+			}
+
+			_ = req.Reply(true, b)
+		default:
+			if req.WantReply {
+				_ = req.Reply(false, nil)
+			}
+		}
+	}
+}
@@ -6,6 +6,8 @@ type Map[K comparable, V any] struct {
 	m sync.Map
 }
 
+func (m *Map[K, V]) CompareAndDelete(key K, old V) bool { return m.m.CompareAndDelete(key, old) }
+
 func (m *Map[K, V]) Delete(key K) { m.m.Delete(key) }
 
 func (m *Map[K, V]) Load(key K) (V, bool) {
@@ -22,6 +22,7 @@ func main() {
 	setupHubCLI(app)
 	setupServantCLI(app)
 	setupMasterCLI(app)
+	setupSyncCLI(app)
 
 	err := app.Run(os.Args)
 	if err != nil {
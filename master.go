@@ -1,9 +1,17 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
 
 	cli "github.com/jawher/mow.cli"
 	dehub "github.com/ysmood/dehub/lib"
@@ -15,18 +23,51 @@ type masterConf struct {
 	id        string
 	hubAddr   string
 	websocket bool
+	tlsCA     string
+	keepalive keepaliveConf
+	reconnect int
 
 	prvKey  string
 	pubKeys []string
 
 	outputFile string
+	traceFile  string
 
 	socks5    string
 	httpProxy string
+	proxyAuth string
+	udp       []string
 
 	nfsAddr   string
 	remoteDir string
 	localDir  string
+	readOnly  bool
+	nfsCache  int
+	nfsOpts   string
+
+	pprof        string
+	pprofSeconds int
+	pprofFile    string
+
+	info    bool
+	ps      bool
+	inspect int
+	json    bool
+
+	diag        []string
+	diagTimeout int
+
+	vars         string
+	varsInterval int
+
+	logs      bool
+	logsLevel string
+	logsMatch []string
+	logsRaise bool
+
+	dlv       string
+	dlvPID    int
+	dlvRemote string
 
 	cmdName string
 	cmdArgs []string
@@ -42,9 +83,19 @@ func setupMasterCLI(app *cli.Cli) {
 
 			c.StringArgPtr(&conf.id, "ID_PREFIX", "", "The id prefix of the servant to command, "+
 				"it will connect to the first servant id that match the id prefix.")
-			c.StringOptPtr(&conf.hubAddr, "a addr", "dehub.ysmood.org:8813", "The address of the hub server.")
+			c.StringOptPtr(&conf.hubAddr, "a addr", "dehub.ysmood.org:8813",
+				"The address of the hub server, use quic://host:port to connect via QUIC, "+
+					"it falls back to tcp if udp is blocked. Use http+poll://host:port or https+poll://host/path "+
+					"for the HTTP long-polling when only plain HTTP requests are allowed.")
 			c.BoolOptPtr(&conf.websocket, "w ws", false,
 				"Use websocket to connect to hub. If set, the addr should be a websocket address.")
+			c.StringOptPtr(&conf.tlsCA, "tls-ca", "",
+				"The CA certificate file to verify the hub when connecting via QUIC, such as the --tls-cert of the hub. "+
+					"If not set, the hub isn't verified, the ssh keys still authenticate the master and servant end-to-end.")
+			conf.keepalive.setup(c)
+			c.IntOptPtr(&conf.reconnect, "reconnect", 3, //nolint: mnd
+				"The seconds to wait between the attempts to reconnect when the connection to the servant is lost, "+
+					"the forwarding listeners stay open during the reconnect, 0 to exit instead.")
 
 			c.StringOptPtr(&conf.prvKey, "p private-key", "", "The private key file path.")
 			c.StringsOptPtr(&conf.pubKeys, "k public-keys", nil,
@@ -52,13 +103,71 @@ func setupMasterCLI(app *cli.Cli) {
 					"The github user id must be prefix with @ .")
 
 			c.StringOptPtr(&conf.outputFile, "o output", "tmp/dehub-master.log", "The file path to append the output.")
+			c.StringOptPtr(&conf.traceFile, "trace-file", "",
+				"Append the OpenTelemetry spans as OTLP/JSON lines to the file, use - for stdout.")
 
 			c.StringOptPtr(&conf.socks5, "s socks5", "", "The address of the socks5 server.")
 			c.StringOptPtr(&conf.httpProxy, "x http-proxy", "", "The address of the http proxy server.")
-
-			c.StringOptPtr(&conf.nfsAddr, "n nfs-addr", "", "The address of the nfs server.")
+			c.StringOptPtr(&conf.proxyAuth, "http-proxy-auth", "",
+				"Require the basic auth for the http proxy server and its PAC file, the format is user:password .")
+			c.StringsOptPtr(&conf.udp, "U udp", nil,
+				"Forward the local udp port to the remote address on the servant side, the format is "+
+					"[local_host:]local_port:remote_host:remote_port, such as 5353:10.0.0.10:53 .")
+
+			c.StringOptPtr(&conf.nfsAddr, "n nfs-addr", "",
+				"The address of the nfs server, if set, the kernel nfs client will be used to mount instead of FUSE.")
 			c.StringOptPtr(&conf.remoteDir, "r remote-dir", ".", "The remote directory to serve.")
-			c.StringOptPtr(&conf.localDir, "l local-dir", "", "The local directory to sync.")
+			c.StringOptPtr(&conf.localDir, "l local-dir", "",
+				"The local directory to mount the remote directory, FUSE is used by default which doesn't require root.")
+			c.BoolOptPtr(&conf.readOnly, "ro", false, "Mount the remote directory as read-only.")
+			c.IntOptPtr(&conf.nfsCache, "nfs-cache", dehub.DefaultNFSCacheLimit,
+				"The number of the file handles that the servant caches for the nfs server.")
+			c.StringOptPtr(&conf.nfsOpts, "nfs-opts", utils.DefaultNFSOptions(),
+				"The options of the kernel nfs client, such as vers, nolock, soft, timeo, retrans, and actimeo, "+
+					"the soft mount fails the file operations instead of hanging when the servant disappears.")
+
+			c.StringOptPtr(&conf.pprof, "pprof", "",
+				"Capture a runtime profile of the servant process, such as cpu, heap, allocs, goroutine, mutex, block, "+
+					"or trace for the execution trace.")
+			c.IntOptPtr(&conf.pprofSeconds, "pprof-seconds", 30, //nolint: mnd
+				"The seconds to collect the cpu profile, execution trace, mutex or block samples.")
+			c.StringOptPtr(&conf.pprofFile, "pprof-file", "",
+				"The file path to save the profile, defaults to tmp/dehub-<type>.pprof or tmp/dehub-trace.trace .")
+
+			c.BoolOptPtr(&conf.info, "info", false,
+				"Print the protocol version and the commands that the servant supports as JSON.")
+			c.BoolOptPtr(&conf.ps, "ps", false, "List the processes on the servant side, read from /proc .")
+			c.IntOptPtr(&conf.inspect, "inspect", 0,
+				"Print the status, open fds, sockets, and threads of the process of the pid on the servant side.")
+			c.BoolOptPtr(&conf.json, "json", false, "Print the output of the ps, inspect, or diag as JSON.")
+
+			c.StringsOptPtr(&conf.diag, "diag", nil,
+				"Run network diagnosis on the servant side, the format is op[:target], such as "+
+					"dns:example.com, tcp:example.com:443, http:https://example.com, listen, interfaces .")
+			c.IntOptPtr(&conf.diagTimeout, "diag-timeout", 10, "The timeout seconds of each diagnosis.") //nolint: mnd
+
+			c.StringOptPtr(&conf.vars, "vars", "",
+				"Print the expvar and exposed variables of the servant host process as JSON, "+
+					"the value is the glob pattern of the variable names, use '*' for all.")
+			c.IntOptPtr(&conf.varsInterval, "vars-interval", 0,
+				"The seconds to watch the variables at the interval, 0 means only print once.")
+
+			c.BoolOptPtr(&conf.logs, "logs", false,
+				"Stream the logs of the servant host process to stdout as JSON lines, "+
+					"the host process must install the dehub.LogTap .")
+			c.StringOptPtr(&conf.logsLevel, "logs-level", "info", "The min level of the logs, such as debug, info, warn, error.")
+			c.StringsOptPtr(&conf.logsMatch, "logs-match", nil,
+				"Only receive the logs that have the attribute, the format is key=value, such as req.id=123 .")
+			c.BoolOptPtr(&conf.logsRaise, "logs-raise", false,
+				"Raise the log level of the host process to the logs-level until the master disconnects.")
+
+			c.StringOptPtr(&conf.dlv, "dlv", "",
+				"The local address to expose the Delve debugger server of the servant, such as 127.0.0.1:2345 .")
+			c.IntOptPtr(&conf.dlvPID, "dlv-pid", 0,
+				"The pid of the remote process for delve to attach, 0 means the servant process itself.")
+			c.StringOptPtr(&conf.dlvRemote, "dlv-remote", "",
+				"The address of an already-running headless Delve server on the servant side, "+
+					"if set, the dlv-pid will be ignored.")
 
 			c.StringOptPtr(&conf.cmdName, "c cmd", "", "The command to run.")
 			c.StringArgPtr(&conf.cmdName, "CMD", "", "The command to run.")
@@ -69,20 +178,14 @@ func setupMasterCLI(app *cli.Cli) {
 }
 
 func runMaster(conf masterConf) { //nolint: funlen
-	logger := output(false)
-	checkKey := publicKeys(logger, conf.pubKeys)
+	defer setupTracing("dehub-master", conf.traceFile)()
 
-	master := dehub.NewMaster(dehub.ServantID(conf.id), privateKey(conf.prvKey), func(key ssh.PublicKey) bool {
-		if len(conf.pubKeys) == 0 {
-			return readLine("Do you trust the servant public key:\n"+ssh.FingerprintSHA256(key)+"\n"+
-				`Input ENTER to trust, input any other to abort: `) == ""
-		}
+	logger := output(false)
 
-		return checkKey(key)
-	})
-	master.Logger = logger
+	tlsConf := tlsCA(conf.tlsCA)
 
-	e(master.Connect(mustDial(conf.websocket, conf.hubAddr)))
+	master := connectMaster(logger, conf.id, conf.prvKey, conf.pubKeys, conf.websocket, conf.hubAddr,
+		tlsConf, conf.keepalive.get())
 
 	wait := false
 
@@ -103,50 +206,218 @@ func runMaster(conf masterConf) { //nolint: funlen
 		l, err := net.Listen("tcp", conf.httpProxy)
 		e(err)
 
-		logger.Info("http proxy server on", "addr", l.Addr().String())
+		logger.Info("http proxy server on", "addr", l.Addr().String(), "pac", "http://"+l.Addr().String()+"/proxy.pac")
 
-		go func() { e(master.ForwardHTTP(l)) }()
+		user, password, _ := strings.Cut(conf.proxyAuth, ":")
+		opts := dehub.HTTPProxyOptions{User: user, Password: password}
+
+		go func() { e(master.ForwardHTTPWithOptions(l, opts)) }()
 
 		wait = true
 	}
 
-	// Forward dir
-	if conf.nfsAddr != "" {
-		fsSrv, err := net.Listen("tcp", conf.nfsAddr)
+	// Forward udp
+	for _, spec := range conf.udp {
+		local, remote := parseUDPForward(spec)
+
+		conn, err := net.ListenPacket("udp", local)
 		e(err)
 
-		go func() { e(master.ServeNFS(conf.remoteDir, fsSrv, 0)) }()
+		logger.Info("udp forward on", "addr", conn.LocalAddr().String(), "remote", remote)
 
-		logger.Info("nfs server on", "addr", fsSrv.Addr().String())
+		go func() { e(master.ForwardUDP(conn, remote)) }()
 
-		localDir := conf.localDir
-		if localDir == "" {
-			localDir, err = os.MkdirTemp("", "dehub-nfs")
-			e(err)
-		}
+		wait = true
+	}
+
+	// Forward dir
+	if conf.nfsAddr != "" || conf.localDir != "" {
+		defer mountDir(master, logger, conf)()
 
-		e(utils.MountNFS(fsSrv.Addr().(*net.TCPAddr), localDir))
-		defer func() {
-			e(utils.UnmountNFS(localDir))
-			logger.Info("nfs unmounted", "dir", localDir)
+		wait = true
+	}
+
+	if conf.info {
+		printJSON(master.ServantInfo())
+	}
+
+	// Explore processes
+	if conf.ps {
+		runPS(master, conf.json)
+	}
+
+	if conf.inspect != 0 {
+		runInspect(master, conf.inspect, conf.json)
+	}
+
+	// Network diagnosis
+	if len(conf.diag) > 0 {
+		runDiag(master, conf.diag, time.Duration(conf.diagTimeout)*time.Second, conf.json)
+	}
+
+	// Inspect vars
+	if conf.vars != "" {
+		e(master.Vars(os.Stdout, dehub.VarsMeta{
+			Pattern:  conf.vars,
+			Interval: time.Duration(conf.varsInterval) * time.Second,
+		}))
+	}
+
+	// Tap logs
+	if conf.logs {
+		go func() { e(master.TapLogs(os.Stdout, logTapMeta(conf))) }()
+
+		wait = true
+	}
+
+	// Forward delve
+	if conf.dlv != "" {
+		l, err := net.Listen("tcp", conf.dlv)
+		e(err)
+
+		logger.Info("delve server on", "addr", l.Addr().String(), "connect", "dlv connect "+l.Addr().String())
+
+		go func() {
+			e(master.ForwardDebugger(l, dehub.DebugMeta{Addr: conf.dlvRemote, PID: conf.dlvPID}))
 		}()
-		logger.Info("nfs mounted", "dir", localDir)
 
 		wait = true
 	}
 
+	if conf.pprof != "" {
+		runProfile(master, conf)
+	}
+
 	// Run remote shell command
 	if conf.cmdName != "" {
 		logger.Info("run command", "cmd", conf.cmdName, "args", conf.cmdArgs)
 		logger.Info("output log to", "file", conf.outputFile)
+		logger.Info("type ~? after a newline for the escape sequences")
 
 		master.Logger = outputToFile(conf.outputFile)
 
-		e(master.Exec(os.Stdin, os.Stdout, conf.cmdName, conf.cmdArgs...))
+		e(master.Exec(newEscapeReader(os.Stdin, master), os.Stdout, conf.cmdName, conf.cmdArgs...))
 	} else if wait {
+		closed := make(chan error, 1)
+		go func() {
+			if conf.reconnect <= 0 {
+				closed <- master.Wait()
+				return
+			}
+
+			closed <- master.KeepConnected(context.Background(), func() (io.ReadWriteCloser, error) {
+				return dial(logger, conf.websocket, conf.hubAddr, tlsConf, conf.keepalive.get())
+			}, time.Duration(conf.reconnect)*time.Second)
+		}()
+
 		// Capture CTRL+C
 		c := make(chan os.Signal, 1)
 		signal.Notify(c, os.Interrupt)
-		<-c
+
+		select {
+		case <-c:
+		case err := <-closed:
+			e(err)
+		}
+	}
+}
+
+// connectMaster connects to the servant via the hub, if no public keys are set,
+// the user will be asked to trust the servant public key.
+func connectMaster(logger *slog.Logger, id, prvKey string, pubKeys []string, websocket bool, hubAddr string,
+	tlsConf *tls.Config, keepalive dehub.Keepalive,
+) *dehub.Master {
+	checkKey := publicKeys(logger, pubKeys)
+
+	master := dehub.NewMaster(dehub.ServantID(id), privateKey(prvKey), func(key ssh.PublicKey) bool {
+		if len(pubKeys) == 0 {
+			return readLine("Do you trust the servant public key:\n"+ssh.FingerprintSHA256(key)+"\n"+
+				`Input ENTER to trust, input any other to abort: `) == ""
+		}
+
+		return checkKey(key)
+	})
+	master.Logger = logger
+	master.Keepalive = keepalive
+
+	e(master.Connect(mustDial(logger, websocket, hubAddr, tlsConf, keepalive)))
+
+	return master
+}
+
+func runProfile(master *dehub.Master, conf masterConf) {
+	path := conf.pprofFile
+	if path == "" {
+		ext := "pprof"
+		if conf.pprof == string(dehub.ProfileTrace) {
+			ext = "trace"
+		}
+
+		path = fmt.Sprintf("tmp/dehub-%s.%s", conf.pprof, ext)
 	}
+
+	_ = os.MkdirAll(filepath.Dir(path), 0o755) //nolint: mnd
+
+	f, err := os.Create(path)
+	e(err)
+
+	defer func() { _ = f.Close() }()
+
+	typ := dehub.ProfileType(conf.pprof)
+	duration := time.Duration(conf.pprofSeconds) * time.Second
+
+	switch typ { //nolint: exhaustive
+	case dehub.ProfileCPU, dehub.ProfileTrace, dehub.ProfileMutex, dehub.ProfileBlock:
+		master.Logger.Info("collecting profile", "type", typ, "duration", duration.String())
+	default:
+		duration = 0
+	}
+
+	e(master.Profile(f, typ, duration))
+
+	tool := "pprof"
+	if typ == dehub.ProfileTrace {
+		tool = "trace"
+	}
+
+	master.Logger.Info("profile saved", "file", path, "open", fmt.Sprintf("go tool %s %s", tool, path))
+}
+
+func logTapMeta(conf masterConf) dehub.LogTapMeta {
+	var level slog.Level
+	e(level.UnmarshalText([]byte(conf.logsLevel)))
+
+	match := map[string]string{}
+
+	for _, m := range conf.logsMatch {
+		k, v, found := strings.Cut(m, "=")
+		if !found {
+			e(fmt.Errorf("invalid logs-match format, expect key=value: %s", m))
+		}
+
+		match[k] = v
+	}
+
+	return dehub.LogTapMeta{Level: level, Match: match, Raise: conf.logsRaise}
+}
+
+// parseUDPForward parses the "[local_host:]local_port:remote_host:remote_port",
+// the local host defaults to 127.0.0.1 .
+func parseUDPForward(spec string) (string, string) {
+	i := strings.LastIndexByte(spec, ':')
+	if i > 0 {
+		i = strings.LastIndexByte(spec[:i], ':')
+	}
+
+	if i <= 0 {
+		e(fmt.Errorf("invalid udp forward format, expect [local_host:]local_port:remote_host:remote_port: %s", spec))
+	}
+
+	local, remote := spec[:i], spec[i+1:]
+
+	if !strings.Contains(local, ":") {
+		local = "127.0.0.1:" + local
+	}
+
+	return local, remote
 }
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+
+	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/fusefs"
+	"github.com/ysmood/dehub/lib/utils"
+)
+
+// mountDir mounts the remote directory with the kernel nfs client if the nfs address is set,
+// otherwise with FUSE. It returns the function to unmount.
+// The dir is unmounted automatically once the tunnel to the servant is closed.
+func mountDir(master *dehub.Master, logger *slog.Logger, conf masterConf) func() {
+	recoverStaleMounts(logger, conf.localDir)
+
+	addr := conf.nfsAddr
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+
+	fsSrv, err := net.Listen("tcp", addr)
+	e(err)
+
+	closed := make(chan struct{})
+
+	go func() {
+		e(master.ServeNFSWithMeta(fsSrv, dehub.MountDirMeta{
+			Path:       conf.remoteDir,
+			CacheLimit: conf.nfsCache,
+			ReadOnly:   conf.readOnly,
+		}))
+		close(closed)
+	}()
+
+	logger.Info("nfs server on", "addr", fsSrv.Addr().String())
+
+	localDir := conf.localDir
+	if localDir == "" {
+		localDir, err = os.MkdirTemp("", "dehub-nfs")
+		e(err)
+	}
+
+	kind := "nfs"
+	unmount := func() error { return utils.UnmountNFS(localDir) }
+
+	if conf.nfsAddr == "" {
+		srv, err := fusefs.Mount(fsSrv.Addr().String(), localDir)
+		e(err)
+
+		kind = "fuse"
+		unmount = srv.Unmount
+	} else {
+		e(utils.MountNFS(fsSrv.Addr().(*net.TCPAddr), localDir, conf.nfsOpts))
+	}
+
+	logger.Info(kind+" mounted", "dir", localDir)
+
+	var once sync.Once
+
+	done := func() {
+		once.Do(func() {
+			err := unmount()
+			if err != nil {
+				err = utils.ForceUnmount(localDir)
+			}
+
+			if err != nil {
+				logger.Error("failed to unmount", "dir", localDir, "err", err)
+				return
+			}
+
+			logger.Info(kind+" unmounted", "dir", localDir)
+		})
+	}
+
+	go func() {
+		<-closed
+		logger.Warn("tunnel closed, unmounting", "dir", localDir)
+		_ = fsSrv.Close()
+		done()
+	}()
+
+	return done
+}
+
+// recoverStaleMounts unmounts the dehub mounts left by the previous runs that were not unmounted cleanly,
+// and the localDir if it's a stale mount point.
+func recoverStaleMounts(logger *slog.Logger, localDir string) {
+	list, err := utils.Mounts()
+	if err != nil {
+		logger.Warn("failed to list mounts", "err", err)
+	}
+
+	if localDir != "" {
+		list = append(list, localDir)
+	}
+
+	for _, dir := range list {
+		if !utils.IsStaleMount(dir) {
+			continue
+		}
+
+		err := utils.ForceUnmount(dir)
+		if err != nil {
+			logger.Warn("failed to recover stale mount", "dir", dir, "err", err)
+			continue
+		}
+
+		logger.Info("recovered stale mount", "dir", dir)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/procfs"
+)
+
+func runPS(master *dehub.Master, asJSON bool) {
+	list, err := master.Processes()
+	e(err)
+
+	if asJSON {
+		printJSON(list)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint: mnd
+
+	fmt.Fprintln(w, "PID\tPPID\tSTATE\tCPU\tRSS\tFDS\tSOCKETS\tTHREADS\tCMD")
+
+	for _, p := range list {
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			p.PID, p.PPID, p.State, p.CPU, formatBytes(p.RSS), formatCount(p.FDs), formatCount(p.Sockets),
+			p.Threads, processCmd(p))
+	}
+
+	e(w.Flush())
+}
+
+func runInspect(master *dehub.Master, pid int, asJSON bool) {
+	d, err := master.Inspect(pid)
+	e(err)
+
+	if asJSON {
+		printJSON(d)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0) //nolint: mnd
+
+	fmt.Fprintf(w, "PID\t%d\n", d.PID)
+	fmt.Fprintf(w, "PPID\t%d\n", d.PPID)
+	fmt.Fprintf(w, "CMD\t%s\n", processCmd(d.Process))
+	fmt.Fprintf(w, "EXE\t%s\n", d.Exe)
+	fmt.Fprintf(w, "CWD\t%s\n", d.Cwd)
+	fmt.Fprintf(w, "STATE\t%s\n", d.State)
+	fmt.Fprintf(w, "CPU\t%s\n", d.CPU)
+	fmt.Fprintf(w, "RSS\t%s\n", formatBytes(d.RSS))
+
+	section(w, "STATUS")
+
+	keys := make([]string, 0, len(d.Status))
+	for k := range d.Status {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s\t%s\n", k, d.Status[k])
+	}
+
+	section(w, fmt.Sprintf("FDS (%s)", formatCount(d.FDs)))
+
+	for _, fd := range d.FDList {
+		fmt.Fprintf(w, "%d\t%s\n", fd.Num, fd.Target)
+	}
+
+	section(w, fmt.Sprintf("SOCKETS (%s)", formatCount(d.Sockets)))
+
+	for _, s := range d.SocketList {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", s.FD, s.Proto, s.Local, s.Remote, s.State)
+	}
+
+	section(w, fmt.Sprintf("THREADS (%d)", d.Threads))
+
+	for _, t := range d.ThreadList {
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", t.TID, t.Name, t.State, t.CPU)
+	}
+
+	e(w.Flush())
+}
+
+func section(w io.Writer, title string) {
+	fmt.Fprintf(w, "\n%s\n", title)
+}
+
+func processCmd(p procfs.Process) string {
+	if len(p.Cmdline) == 0 {
+		// Kernel threads have no cmdline.
+		return "[" + p.Name + "]"
+	}
+
+	return strings.Join(p.Cmdline, " ")
+}
+
+func formatCount(n int) string {
+	if n < 0 {
+		return "-"
+	}
+
+	return fmt.Sprint(n)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	e(enc.Encode(v))
+}
@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net"
 	"time"
 
 	cli "github.com/jawher/mow.cli"
@@ -11,12 +14,22 @@ type servantConf struct {
 	id            string
 	hubAddr       string
 	websocket     bool
+	tlsCA         string
 	retryInterval RetryInterval
+	keepalive     keepaliveConf
 
 	prvKey  string
 	pubKeys []string
 
+	allow []string
+	deny  []string
+	dns   string
+
+	shareRoots    []string
+	shareReadOnly bool
+
 	jsonOutput bool
+	traceFile  string
 }
 
 func setupServantCLI(app *cli.Cli) {
@@ -27,34 +40,75 @@ func setupServantCLI(app *cli.Cli) {
 
 			c.Spec = "-p [OPTIONS] PUBLIC_KEYS..."
 
-			c.StringOptPtr(&conf.hubAddr, "a addr", "dehub.ysmood.org:8813", "The address of the hub server.")
+			c.StringOptPtr(&conf.hubAddr, "a addr", "dehub.ysmood.org:8813",
+				"The address of the hub server, use quic://host:port to connect via QUIC, "+
+					"it falls back to tcp if udp is blocked. Use http+poll://host:port or https+poll://host/path "+
+					"for the HTTP long-polling when only plain HTTP requests are allowed.")
 			c.StringOptPtr(&conf.id, "i id", id(), "The id of the servant. It should be unique.")
 			c.BoolOptPtr(&conf.websocket, "w ws", false,
 				"Use websocket to connect to hub. If set, the addr should be a websocket address.")
+			c.StringOptPtr(&conf.tlsCA, "tls-ca", "",
+				"The CA certificate file to verify the hub when connecting via QUIC, such as the --tls-cert of the hub. "+
+					"If not set, the hub isn't verified, the ssh keys still authenticate the master and servant end-to-end.")
 			c.VarOpt("r retry-interval", &conf.retryInterval, "The retry interval in seconds.")
+			conf.keepalive.setup(c)
 
 			c.StringOptPtr(&conf.prvKey, "p private-key", "", "The private key file path.")
 			c.StringsArgPtr(&conf.pubKeys, "PUBLIC_KEYS", nil,
 				"The list of github user id, public key content, or path that are allowed to connect to the servant. "+
 					"The github user id must be prefix with @ .")
 
+			c.StringsOptPtr(&conf.allow, "allow", nil,
+				"Only allow the forwarding to the destinations, such as 10.0.0.0/8, *.example.com:443, *:8000-9000 .")
+			c.StringsOptPtr(&conf.deny, "deny", nil,
+				"Deny the forwarding to the destinations, it takes precedence over the --allow, such as 169.254.169.254 .")
+			c.StringOptPtr(&conf.dns, "dns", "",
+				"The address of the DNS server to resolve the forwarding destinations, such as 10.0.0.10:53 .")
+
+			c.StringsOptPtr(&conf.shareRoots, "share-root", nil,
+				"Only allow the masters to mount the directories inside the roots, defaults to allow all.")
+			c.BoolOptPtr(&conf.shareReadOnly, "share-ro", false,
+				"Only allow the masters to mount the directories as read-only.")
+
 			c.BoolOptPtr(&conf.jsonOutput, "j json", true, "json output to stdout")
+			c.StringOptPtr(&conf.traceFile, "trace-file", "",
+				"Append the OpenTelemetry spans as OTLP/JSON lines to the file, use - for stdout.")
 
 			c.Action = func() { runServant(conf) }
 		})
 }
 
 func runServant(conf servantConf) {
+	defer setupTracing("dehub-servant", conf.traceFile)()
+
 	logger := output(conf.jsonOutput)
 	servant := dehub.NewServant(dehub.ServantID(conf.id), privateKey(conf.prvKey), publicKeys(logger, conf.pubKeys))
 	servant.Logger = logger
+	servant.Resolver = resolver(conf.dns)
+	servant.Keepalive = conf.keepalive.get()
+
+	rules, err := dehub.NewForwardRules(conf.allow, conf.deny)
+	e(err)
+
+	servant.ForwardRules = rules
+	servant.ShareRoots = conf.shareRoots
+	servant.ShareReadOnly = conf.shareReadOnly
+
+	tlsConf := tlsCA(conf.tlsCA)
 
 	for {
-		conn, err := dial(conf.websocket, conf.hubAddr)
+		conn, err := dial(logger, conf.websocket, conf.hubAddr, tlsConf, servant.Keepalive)
+		if err == nil {
+			err = servant.Run(conn)
+		}
+
+		if errors.Is(err, dehub.ErrServantReplaced) {
+			logger.Error("stop reconnecting, another servant with the same id has taken the place", "id", conf.id)
+			cli.Exit(1)
+		}
+
 		if err != nil {
 			logger.Error("failed to connect to the hub", "err", err)
-		} else {
-			servant.Serve(conn)()
 		}
 
 		logger.Info("servant retries to connect to the hub", "wait", conf.retryInterval.String())
@@ -62,3 +116,16 @@ func runServant(conf servantConf) {
 		time.Sleep(conf.retryInterval.Get())
 	}
 }
+
+func resolver(addr string) *net.Resolver {
+	if addr == "" {
+		return nil
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+}
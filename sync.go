@@ -0,0 +1,164 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	cli "github.com/jawher/mow.cli"
+	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/dirsync"
+)
+
+type syncConf struct {
+	id        string
+	hubAddr   string
+	websocket bool
+	tlsCA     string
+	keepalive keepaliveConf
+
+	prvKey  string
+	pubKeys []string
+
+	src string
+	dst string
+
+	include  []string
+	exclude  []string
+	delete   bool
+	dryRun   bool
+	watch    bool
+	interval int
+}
+
+func setupSyncCLI(app *cli.Cli) {
+	app.Command("sync",
+		"Sync a directory between the servant and the master, only the changed blocks of the files are transferred. "+
+			"The remote path is prefixed with a colon, such as ':/var/log/app ./logs' to pull "+
+			"or './conf :/etc/app' to push.",
+		func(c *cli.Cmd) {
+			var conf syncConf
+
+			c.Spec = "[OPTIONS] ID_PREFIX SRC DST"
+
+			c.StringArgPtr(&conf.id, "ID_PREFIX", "", "The id prefix of the servant to sync with.")
+			c.StringArgPtr(&conf.src, "SRC", "", "The source directory.")
+			c.StringArgPtr(&conf.dst, "DST", "", "The destination directory.")
+
+			c.StringOptPtr(&conf.hubAddr, "a addr", "dehub.ysmood.org:8813",
+				"The address of the hub server, use quic://host:port to connect via QUIC, "+
+					"it falls back to tcp if udp is blocked. Use http+poll://host:port or https+poll://host/path "+
+					"for the HTTP long-polling when only plain HTTP requests are allowed.")
+			c.BoolOptPtr(&conf.websocket, "w ws", false,
+				"Use websocket to connect to hub. If set, the addr should be a websocket address.")
+			c.StringOptPtr(&conf.tlsCA, "tls-ca", "",
+				"The CA certificate file to verify the hub when connecting via QUIC, such as the --tls-cert of the hub. "+
+					"If not set, the hub isn't verified, the ssh keys still authenticate the master and servant end-to-end.")
+			conf.keepalive.setup(c)
+
+			c.StringOptPtr(&conf.prvKey, "p private-key", "", "The private key file path.")
+			c.StringsOptPtr(&conf.pubKeys, "k public-keys", nil,
+				"The list of github user id, public key content, or path that are trusted. "+
+					"The github user id must be prefix with @ .")
+
+			c.StringsOptPtr(&conf.include, "include", nil,
+				"Only sync the files that match the glob patterns, a pattern matches the relative path or the file name.")
+			c.StringsOptPtr(&conf.exclude, "exclude", nil,
+				"Skip the files and directories that match the glob patterns, such as '*.log' or 'node_modules' .")
+			c.BoolOptPtr(&conf.delete, "delete", false,
+				"Delete the files in the destination that don't exist in the source.")
+			c.BoolOptPtr(&conf.dryRun, "n dry-run", false, "Only print the changes without applying them.")
+			c.BoolOptPtr(&conf.watch, "watch", false,
+				"Keep the local directory mirrored from the servant, it implies the delete, only works for pull.")
+			c.IntOptPtr(&conf.interval, "interval", 2, "The seconds between each sync of the watch.") //nolint: mnd
+
+			c.Action = func() { runSync(conf) }
+		})
+}
+
+func runSync(conf syncConf) {
+	remote, local, pull := parseSyncPaths(conf.src, conf.dst)
+
+	if conf.watch && !pull {
+		e(errors.New("the watch only works for pull, the source should be the remote path"))
+	}
+
+	logger := output(false)
+
+	master := connectMaster(logger, conf.id, conf.prvKey, conf.pubKeys, conf.websocket, conf.hubAddr,
+		tlsCA(conf.tlsCA), conf.keepalive.get())
+
+	dir, err := master.OpenDir(dehub.SyncMeta{Path: remote, ReadOnly: pull})
+	e(err)
+
+	defer func() { _ = dir.Close() }()
+
+	var src, dst dirsync.Side = &dirsync.Local{Root: local}, dir
+	if pull {
+		e(os.MkdirAll(local, 0o755)) //nolint: mnd
+
+		src, dst = dir, &dirsync.Local{Root: local}
+	}
+
+	opts := dirsync.Options{
+		Include: conf.include,
+		Exclude: conf.exclude,
+		Delete:  conf.delete || conf.watch,
+		DryRun:  conf.dryRun,
+	}
+
+	changes, err := dirsync.Sync(src, dst, opts)
+	printChanges(changes)
+	e(err)
+
+	if !conf.watch {
+		return
+	}
+
+	logger.Info("watching", "remote", remote, "local", local)
+
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+
+	for {
+		select {
+		case <-interrupt:
+			return
+		case <-time.After(time.Duration(conf.interval) * time.Second):
+		}
+
+		changes, err := dirsync.Sync(src, dst, opts)
+		printChanges(changes)
+		e(err)
+	}
+}
+
+// parseSyncPaths returns the remote path, local path, and whether it's a pull.
+func parseSyncPaths(src, dst string) (string, string, bool) {
+	remoteSrc, isPull := strings.CutPrefix(src, ":")
+	remoteDst, isPush := strings.CutPrefix(dst, ":")
+
+	if isPull == isPush {
+		e(fmt.Errorf("one and only one of the SRC and DST should be the remote path prefixed with a colon: %s %s",
+			src, dst))
+	}
+
+	if isPull {
+		return remoteSrc, dst, true
+	}
+
+	return remoteDst, src, false
+}
+
+func printChanges(changes []dirsync.Change) {
+	for _, c := range changes {
+		if c.Type != dirsync.ChangeDelete && c.Entry.Mode.IsRegular() {
+			_, _ = fmt.Fprintf(os.Stdout, "%s %s (%d/%d bytes sent)\n", c.Type, c.Entry.Path, c.Transferred, c.Entry.Size)
+		} else {
+			_, _ = fmt.Fprintf(os.Stdout, "%s %s\n", c.Type, c.Entry.Path)
+		}
+	}
+}
@@ -4,11 +4,13 @@ import (
 	"bufio"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"net/http"
@@ -20,6 +22,11 @@ import (
 	cli "github.com/jawher/mow.cli"
 	"github.com/lmittmann/tint"
 	dehub "github.com/ysmood/dehub/lib"
+	"github.com/ysmood/dehub/lib/otlpfile"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/term"
 )
@@ -39,6 +46,34 @@ func outputToFile(path string) *slog.Logger {
 	return slog.New(slog.NewTextHandler(f, nil))
 }
 
+// setupTracing exports the spans to the path as OTLP/JSON lines, "-" means stdout.
+// The returned function flushes the pending spans.
+func setupTracing(serviceName, path string) func() {
+	if path == "" {
+		return func() {}
+	}
+
+	var w io.Writer = os.Stdout
+
+	if path != "-" {
+		_ = os.MkdirAll(filepath.Dir(path), 0o755) //nolint: mnd
+
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644) //nolint: mnd
+		e(err)
+
+		w = f
+	}
+
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(otlpfile.New(w)),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(serviceName))),
+	)
+
+	otel.SetTracerProvider(tp)
+
+	return func() { _ = tp.Shutdown(context.Background()) }
+}
+
 const dialTimeout = time.Second * 10
 
 func privateKey(path string) ssh.Signer {
@@ -184,14 +219,43 @@ func getGithubPubkey(userID string) ([][]byte, error) {
 	return list, nil
 }
 
-func mustDial(websocket bool, addr string) net.Conn {
-	conn, err := dial(websocket, addr)
+func mustDial(logger *slog.Logger, websocket bool, addr string, tlsConf *tls.Config, keepalive dehub.Keepalive,
+) net.Conn {
+	conn, err := dial(logger, websocket, addr, tlsConf, keepalive)
 	e(err)
 
 	return conn
 }
 
-func dial(websocket bool, addr string) (net.Conn, error) {
+// dial the hub, if the addr is a quic:// address and the udp is blocked,
+// it falls back to the tcp or websocket on the same host and port.
+// The tlsConf verifies the QUIC hub, see [tlsCA].
+func dial(logger *slog.Logger, websocket bool, addr string, tlsConf *tls.Config, keepalive dehub.Keepalive,
+) (net.Conn, error) {
+	if dehub.IsHTTPPollAddr(addr) {
+		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+		defer cancel()
+
+		return dehub.DialHTTPPoll(ctx, addr)
+	}
+
+	if dehub.IsQUICAddr(addr) {
+		ctx, cancel := context.WithTimeout(context.Background(), dehub.QUICDialTimeout)
+		defer cancel()
+
+		conn, err := dehub.DialQUIC(ctx, addr, tlsConf, keepalive)
+		if err == nil {
+			return conn, nil
+		}
+
+		addr = strings.TrimPrefix(addr, dehub.QUICScheme)
+		if websocket {
+			addr = "ws://" + addr
+		}
+
+		logger.Warn("failed to connect via quic, fall back", "addr", addr, "err", err)
+	}
+
 	if websocket {
 		ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
 		defer cancel()
@@ -263,3 +327,37 @@ func (d *RetryInterval) Get() time.Duration {
 
 	return time.Duration(*d)
 }
+
+// tlsCA returns the tls config that verifies the QUIC hub with the CA certificates in the PEM file,
+// it returns nil if the file is not set, then the hub isn't verified.
+func tlsCA(file string) *tls.Config {
+	if file == "" {
+		return nil
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(readFile(file)) {
+		e(fmt.Errorf("no certificate found in the tls ca file: %s", file))
+	}
+
+	return &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS13}
+}
+
+type keepaliveConf struct {
+	interval int
+	timeout  int
+}
+
+func (k *keepaliveConf) setup(c *cli.Cmd) {
+	c.IntOptPtr(&k.interval, "keepalive", int(dehub.DefaultKeepalive.Interval.Seconds()),
+		"The seconds between the keepalive pings to detect the dead peers, 0 to disable.")
+	c.IntOptPtr(&k.timeout, "keepalive-timeout", int(dehub.DefaultKeepalive.Timeout.Seconds()),
+		"The seconds to wait for the reply of each keepalive ping before the peer is considered dead.")
+}
+
+func (k *keepaliveConf) get() dehub.Keepalive {
+	return dehub.Keepalive{
+		Interval: time.Duration(k.interval) * time.Second,
+		Timeout:  time.Duration(k.timeout) * time.Second,
+	}
+}